@@ -0,0 +1,24 @@
+package main
+
+import (
+	"fmt"
+
+	"lenslockedbr.com/models"
+)
+
+// grantAdmin gives the admin role to the user with the email address,
+// which is how the first admin gets access to the admin console.
+func grantAdmin(services *models.Services, email string) {
+
+	user, err := services.User.ByEmail(email)
+	if err != nil {
+		panic(err)
+	}
+
+	user.Role = models.RoleAdmin
+	if err := services.User.Update(user); err != nil {
+		panic(err)
+	}
+
+	fmt.Printf("%s is now an admin.\n", user.Email)
+}
@@ -5,6 +5,11 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"time"
+
+	"lenslockedbr.com/email"
+	"lenslockedbr.com/hash"
+	"lenslockedbr.com/models"
 )
 
 type Config struct {
@@ -13,8 +18,48 @@ type Config struct {
 	Pepper  string `json:"pepper"`
 	HMACKey string `json:"hmac_key"`
 
-	Database PostgresConfig `json:"database"`
-	Mailgun  MailgunConfig  `json:"mailgun"`
+	// To rotate the pepper or the HMAC key, give the new one an ID
+	// and move the old one, along with its previous ID (which is
+	// empty if it never had one), to the previous keys. Values made
+	// with a previous key are re-hashed with the current one the
+	// next time they are used. Run the app with -keys to see how
+	// many records still use a previous key.
+	PepperID         string     `json:"pepper_id"`
+	PreviousPeppers  []hash.Key `json:"previous_peppers"`
+	HMACKeyID        string     `json:"hmac_key_id"`
+	PreviousHMACKeys []hash.Key `json:"previous_hmac_keys"`
+
+	Database  PostgresConfig  `json:"database"`
+	Mailgun   MailgunConfig   `json:"mailgun"`
+	Email     EmailConfig     `json:"email"`
+	RateLimit RateLimitConfig `json:"rate_limit"`
+	OIDC      OIDCConfig      `json:"oidc"`
+
+	// PasswordHash holds the argon2id cost parameters. Changing
+	// them is safe: existing hashes are upgraded on the next login.
+	PasswordHash hash.Argon2Params `json:"password_hash"`
+
+	// BreachCorpus is the path to an optional copy of the Have I
+	// Been Pwned password hashes, ordered by hash. When provided,
+	// passwords found in it are rejected.
+	BreachCorpus string `json:"breach_corpus"`
+
+	// BaseURL is the scheme and host used for the links in our
+	// emails, eg: https://www.lenslockedbr.com
+	BaseURL string `json:"base_url"`
+
+	// ResetTokenTTL is how long a password reset link works for,
+	// written as a Go duration, eg: "2h" or "30m".
+	ResetTokenTTL string `json:"reset_token_ttl"`
+
+	// SupportEmail is where the messages sent through the contact
+	// form are forwarded to, support@lenslockedbr.com by default.
+	SupportEmail string `json:"support_email"`
+
+	// TrustedProxies are the addresses, or CIDRs, of the proxies in
+	// front of the app whose X-Forwarded-For headers are honored.
+	// Only loopback is trusted by default, where Caddy runs.
+	TrustedProxies []string `json:"trusted_proxies"`
 }
 
 func DefaultConfig() Config {
@@ -24,6 +69,12 @@ func DefaultConfig() Config {
 		Pepper:   "foobar",
 		HMACKey:  "secret-hmac-key",
 		Database: DefaultPostgresConfig(),
+		RateLimit: RateLimitConfig{
+			Store: "memory",
+		},
+		PasswordHash:  hash.DefaultArgon2Params(),
+		BaseURL:       "http://localhost:3000",
+		ResetTokenTTL: "12h",
 	}
 }
 
@@ -31,6 +82,134 @@ func (c Config) IsProd() bool {
 	return c.Env == "prod"
 }
 
+func (c Config) PepperKeyring() hash.Keyring {
+	return hash.NewKeyring(hash.Key{ID: c.PepperID, Secret: c.Pepper},
+		c.PreviousPeppers...)
+}
+
+func (c Config) HMACKeyring() hash.Keyring {
+	return hash.NewKeyring(hash.Key{ID: c.HMACKeyID, Secret: c.HMACKey},
+		c.PreviousHMACKeys...)
+}
+
+// PasswordHashParams returns the argon2id params from the config, or
+// the default ones if none were provided.
+func (c Config) PasswordHashParams() hash.Argon2Params {
+	if c.PasswordHash.Time == 0 || c.PasswordHash.Memory == 0 {
+		return hash.DefaultArgon2Params()
+	}
+
+	p := c.PasswordHash
+	if p.Threads == 0 {
+		p.Threads = 1
+	}
+	if p.KeyLen == 0 {
+		p.KeyLen = hash.DefaultArgon2Params().KeyLen
+	}
+	if p.SaltLen == 0 {
+		p.SaltLen = hash.DefaultArgon2Params().SaltLen
+	}
+
+	return p
+}
+
+// ResetTTL parses ResetTokenTTL, returning the default one if none or
+// an invalid one was provided.
+func (c Config) ResetTTL() time.Duration {
+	if c.ResetTokenTTL == "" {
+		return models.DefaultResetTTL
+	}
+
+	ttl, err := time.ParseDuration(c.ResetTokenTTL)
+	if err != nil || ttl <= 0 {
+		log.Printf("Invalid reset_token_ttl %q, using %s\n",
+			c.ResetTokenTTL, models.DefaultResetTTL)
+		return models.DefaultResetTTL
+	}
+
+	return ttl
+}
+
+// UserConfig returns the settings of the user service.
+func (c Config) UserConfig() models.UserConfig {
+	return models.UserConfig{
+		PasswordHash: c.PasswordHashParams(),
+		BreachCorpus: c.BreachCorpus,
+		ResetTTL:     c.ResetTTL(),
+	}
+}
+
+// EmailSender returns the sender chosen by Email.Provider. When none is
+// chosen, emails are sent with Mailgun in production and written to
+// files everywhere else.
+func (c Config) EmailSender() (email.Sender, error) {
+
+	provider := c.Email.Provider
+	if provider == "" {
+		provider = "file"
+		if c.IsProd() {
+			provider = "mailgun"
+		}
+	}
+
+	switch provider {
+	case "mailgun":
+		return email.NewMailgunSender(c.Mailgun.Domain,
+			c.Mailgun.APIKey, c.Mailgun.PublicAPIKey), nil
+	case "smtp":
+		smtpCfg := c.Email.SMTP
+		if smtpCfg.Port == 0 {
+			smtpCfg.Port = 587
+		}
+		return email.NewSMTPSender(smtpCfg.Host, smtpCfg.Port,
+			smtpCfg.Username, smtpCfg.Password), nil
+	case "file":
+		dir := c.Email.Dir
+		if dir == "" {
+			dir = "tmp/mail"
+		}
+		return email.NewFileSender(dir)
+	case "log":
+		return email.NewLogSender(), nil
+	}
+
+	return nil, fmt.Errorf("unknown email provider %q", provider)
+}
+
+// EmailFrom returns the address our emails are sent from. Unless one
+// is provided, it is on the Mailgun domain when there is one.
+func (c Config) EmailFrom() string {
+	if c.Email.From != "" {
+		return c.Email.From
+	}
+
+	if c.Mailgun.Domain != "" {
+		return "we@" + c.Mailgun.Domain
+	}
+
+	return "we@lenslockedbr.com"
+}
+
+// SupportAddress returns the address the contact form messages are
+// forwarded to.
+func (c Config) SupportAddress() string {
+	if c.SupportEmail != "" {
+		return c.SupportEmail
+	}
+
+	return "support@lenslockedbr.com"
+}
+
+// Proxies returns the TrustedProxies, or loopback if none were
+// provided.
+func (c Config) Proxies() []string {
+	if len(c.TrustedProxies) > 0 {
+		return c.TrustedProxies
+	}
+
+	return []string{"127.0.0.1/8", "::1"}
+}
+
 func LoadConfig(configReq bool) Config {
 	// Open the config file
 	f, err := os.Open(".config")
@@ -94,4 +273,53 @@ type MailgunConfig struct {
 	APIKey       string `json:"api_key"`
 	PublicAPIKey string `json:"public_api_key"`
 	Domain       string `json:"domain"`
+
+	// WebhookSigningKey verifies the webhooks Mailgun sends about
+	// bounces and complaints. They are not accepted without it.
+	WebhookSigningKey string `json:"webhook_signing_key"`
+}
+
+// EmailConfig chooses how emails are sent. Provider is "mailgun",
+// "smtp", "file" or "log". The file provider writes the emails to the
+// maildir in Dir, tmp/mail by default.
+type EmailConfig struct {
+	Provider string     `json:"provider"`
+	From     string     `json:"from"`
+	Dir      string     `json:"dir"`
+	SMTP     SMTPConfig `json:"smtp"`
+}
+
+// SMTPConfig is the SMTP server emails are sent through. Port defaults
+// to 587, the submission port.
+type SMTPConfig struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type RateLimitConfig struct {
+	// Store is either "memory" or "postgres". The postgres store
+	// should be used when running more than one instance of the
+	// application so that they all share the same limits.
+	Store string `json:"store"`
+}
+
+func (c RateLimitConfig) UsePostgres() bool {
+	return c.Store == "postgres"
+}
+
+// OIDCConfig is the OpenID Connect provider users can sign in with.
+// The redirect URL to register with it is BaseURL followed by
+// /auth/oidc/callback.
+type OIDCConfig struct {
+	// Name is shown on the login button, eg: Google
+	Name         string `json:"name"`
+	Issuer       string `json:"issuer"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+}
+
+func (c OIDCConfig) Enabled() bool {
+	return c.Issuer != "" && c.ClientID != ""
 }
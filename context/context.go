@@ -8,7 +8,9 @@ import (
 type privateKey string
 
 const (
-	userKey privateKey = "user"
+	userKey         privateKey = "user"
+	impersonatorKey privateKey = "impersonator"
+	notificationKey privateKey = "notifications"
 )
 
 func WithUser(ctx context.Context, user *models.User) context.Context {
@@ -24,3 +26,39 @@ func User(ctx context.Context) *models.User {
 
 	return nil
 }
+
+// WithImpersonator stores the admin who is acting as the user set with
+// WithUser.
+func WithImpersonator(ctx context.Context, admin *models.User) context.Context {
+	return context.WithValue(ctx, impersonatorKey, admin)
+}
+
+// Impersonator returns the admin acting as the current user, or nil
+// when the user is acting as themselves.
+func Impersonator(ctx context.Context) *models.User {
+	if temp := ctx.Value(impersonatorKey); temp != nil {
+		if admin, ok := temp.(*models.User); ok {
+			return admin
+		}
+	}
+
+	return nil
+}
+
+// WithNotifications stores the unread notifications of the current
+// user, so they can be listed in the navbar.
+func WithNotifications(ctx context.Context,
+	notifications []models.Notification) context.Context {
+	return context.WithValue(ctx, notificationKey, notifications)
+}
+
+// Notifications returns the unread notifications of the current user.
+func Notifications(ctx context.Context) []models.Notification {
+	if temp := ctx.Value(notificationKey); temp != nil {
+		if notifications, ok := temp.([]models.Notification); ok {
+			return notifications
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,633 @@
+package controllers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"lenslockedbr.com/context"
+	"lenslockedbr.com/email"
+	"lenslockedbr.com/middleware"
+	"lenslockedbr.com/models"
+	"lenslockedbr.com/realip"
+	"lenslockedbr.com/views"
+)
+
+// auditDateLayout is how dates are entered to filter the audit log.
+const auditDateLayout = "2006-01-02"
+
+type AdminSearchForm struct {
+	Query string `schema:"q"`
+}
+
+// AdminAuditForm filters the audit log. Dates are YYYY-MM-DD and both
+// are inclusive.
+type AdminAuditForm struct {
+	Action  string `schema:"action"`
+	UserID  uint   `schema:"user_id"`
+	ActorID uint   `schema:"actor_id"`
+	IP      string `schema:"ip"`
+	Since   string `schema:"since"`
+	Until   string `schema:"until"`
+}
+
+// adminUsers is what the list of users is rendered with.
+type adminUsers struct {
+	Query string
+	Users []models.User
+}
+
+// adminUser is what the details of a user are rendered with.
+type adminUser struct {
+	User           *models.User
+	Galleries      []adminGallery
+	Usage          string
+	Impersonations []adminImpersonation
+}
+
+type adminGallery struct {
+	models.Gallery
+	Images int
+	Usage  string
+}
+
+type adminImpersonation struct {
+	models.Impersonation
+	Admin string
+}
+
+// adminAudit is what the audit log is rendered with.
+type adminAudit struct {
+	Form    AdminAuditForm
+	Actions []string
+	Events  []models.AuditEvent
+}
+
+// adminEmails is what the outbox is rendered with.
+type adminEmails struct {
+	Dead    []models.OutboxMessage
+	Pending []models.OutboxMessage
+}
+
+// Admin is the console operators use to look after users.
+type Admin struct {
+	UsersView  *views.View
+	UserView   *views.View
+	AuditView  *views.View
+	EmailsView *views.View
+	us         models.UserService
+	gs         models.GalleryService
+	is         models.ImageService
+	imps       models.ImpersonationService
+	as         models.AuditService
+	obs        models.OutboxService
+	emailer    *email.Client
+}
+
+func NewAdmin(us models.UserService, gs models.GalleryService,
+	is models.ImageService, imps models.ImpersonationService,
+	as models.AuditService, obs models.OutboxService,
+	emailer *email.Client) *Admin {
+	return &Admin{
+		UsersView: views.NewView("bootstrap", false,
+			"admin/users"),
+		UserView: views.NewView("bootstrap", false,
+			"admin/user"),
+		AuditView: views.NewView("bootstrap", false,
+			"admin/audit"),
+		EmailsView: views.NewView("bootstrap", false,
+			"admin/emails"),
+		us:      us,
+		gs:      gs,
+		is:      is,
+		imps:    imps,
+		as:      as,
+		obs:     obs,
+		emailer: emailer,
+	}
+}
+
+// Users lists the newest users, or the ones matching the search.
+//
+// GET /admin/users?q=
+func (a *Admin) Users(w http.ResponseWriter, r *http.Request) {
+
+	var vd views.Data
+	var form AdminSearchForm
+
+	if err := parseURLParams(r, &form); err != nil {
+		vd.SetAlert(err)
+		a.UsersView.Render(w, r, vd)
+		return
+	}
+
+	users, err := a.us.Search(form.Query)
+	if err != nil {
+		vd.SetAlert(err)
+	}
+
+	vd.Yield = adminUsers{
+		Query: form.Query,
+		Users: users,
+	}
+	a.UsersView.Render(w, r, vd)
+}
+
+// User shows a user along with their galleries, how much storage they
+// use and who impersonated them.
+//
+// GET /admin/users/:id
+func (a *Admin) User(w http.ResponseWriter, r *http.Request) {
+
+	user, err := a.userByID(w, r)
+	if err != nil {
+		return
+	}
+
+	var vd views.Data
+
+	galleries, err := a.gs.ByUserID(user.ID)
+	if err != nil {
+		vd.SetAlert(err)
+		a.UserView.Render(w, r, vd)
+		return
+	}
+
+	data := adminUser{
+		User:      user,
+		Galleries: make([]adminGallery, len(galleries)),
+	}
+
+	var total int64
+	for i, gallery := range galleries {
+		images, err := a.is.ByGalleryID(gallery.ID)
+		if err != nil {
+			vd.SetAlert(err)
+			a.UserView.Render(w, r, vd)
+			return
+		}
+
+		usage, err := a.is.Usage(gallery.ID)
+		if err != nil {
+			vd.SetAlert(err)
+			a.UserView.Render(w, r, vd)
+			return
+		}
+		total += usage
+
+		data.Galleries[i] = adminGallery{
+			Gallery: gallery,
+			Images:  len(images),
+			Usage:   formatBytes(usage),
+		}
+	}
+	data.Usage = formatBytes(total)
+
+	impersonations, err := a.imps.ByUserID(user.ID)
+	if err != nil {
+		vd.SetAlert(err)
+		a.UserView.Render(w, r, vd)
+		return
+	}
+
+	for _, i := range impersonations {
+		ai := adminImpersonation{Impersonation: i}
+		if admin, err := a.us.ByID(i.AdminID); err == nil {
+			ai.Admin = admin.Email
+		}
+		data.Impersonations = append(data.Impersonations, ai)
+	}
+
+	vd.Yield = data
+	a.UserView.Render(w, r, vd)
+}
+
+// Disable prevents the user from signing in.
+//
+// POST /admin/users/:id/disable
+func (a *Admin) Disable(w http.ResponseWriter, r *http.Request) {
+
+	user, err := a.userByID(w, r)
+	if err != nil {
+		return
+	}
+
+	if user.ID == context.User(r.Context()).ID {
+		a.redirectToUser(w, r, user, models.ErrDisableSelf)
+		return
+	}
+
+	if err := a.us.Disable(user); err != nil {
+		a.redirectToUser(w, r, user, err)
+		return
+	}
+
+	audit(a.as, r, models.AuditEvent{
+		Action: models.AuditAdminDisabled,
+		UserID: user.ID,
+	})
+
+	a.redirectToUser(w, r, user, nil)
+}
+
+// Enable lets a disabled user sign in again.
+//
+// POST /admin/users/:id/enable
+func (a *Admin) Enable(w http.ResponseWriter, r *http.Request) {
+
+	user, err := a.userByID(w, r)
+	if err != nil {
+		return
+	}
+
+	if err := a.us.Enable(user); err != nil {
+		a.redirectToUser(w, r, user, err)
+		return
+	}
+
+	audit(a.as, r, models.AuditEvent{
+		Action: models.AuditAdminEnabled,
+		UserID: user.ID,
+	})
+
+	a.redirectToUser(w, r, user, nil)
+}
+
+// ResetPassword emails the user the instructions to reset their
+// password, just like if they asked for it themselves.
+//
+// POST /admin/users/:id/reset
+func (a *Admin) ResetPassword(w http.ResponseWriter, r *http.Request) {
+
+	user, err := a.userByID(w, r)
+	if err != nil {
+		return
+	}
+
+	err = a.us.InitiateReset(user.Email, func(token string,
+		sender email.Sender) error {
+		return a.emailer.Via(sender).ResetPw(user.Email, token)
+	})
+	if err == nil {
+		audit(a.as, r, models.AuditEvent{
+			Action: models.AuditAdminResetPassword,
+			UserID: user.ID,
+		})
+	}
+	a.redirectToUser(w, r, user, err)
+}
+
+// Impersonate signs the admin in as the user, until they stop or the
+// impersonation expires. The admin keeps their own session.
+//
+// POST /admin/users/:id/impersonate
+func (a *Admin) Impersonate(w http.ResponseWriter, r *http.Request) {
+
+	user, err := a.userByID(w, r)
+	if err != nil {
+		return
+	}
+
+	admin := context.User(r.Context())
+
+	i, err := a.imps.Start(admin, user, realip.FromRequest(r))
+	if err != nil {
+		a.redirectToUser(w, r, user, err)
+		return
+	}
+
+	audit(a.as, r, models.AuditEvent{
+		Action:     models.AuditImpersonateStarted,
+		UserID:     user.ID,
+		TargetType: "impersonation",
+		TargetID:   i.ID,
+	})
+
+	cookie := http.Cookie{
+		Name:     middleware.ImpersonationCookie,
+		Value:    i.Token,
+		Path:     "/",
+		Expires:  i.ExpiresAt,
+		HttpOnly: true,
+	}
+	http.SetCookie(w, &cookie)
+
+	alert := views.Alert{
+		Level:   views.AlertLvlWarning,
+		Message: "You are now signed in as " + user.Email + ".",
+	}
+	views.RedirectAlert(w, r, "/galleries", http.StatusFound, alert)
+}
+
+// StopImpersonating ends the impersonation and takes the admin back
+// to the user they were impersonating.
+//
+// POST /admin/impersonation/stop
+func (a *Admin) StopImpersonating(w http.ResponseWriter, r *http.Request) {
+
+	urlStr := "/admin/users"
+
+	if i := stopImpersonation(a.imps, a.as, w, r); i != nil {
+		urlStr = fmt.Sprintf("/admin/users/%d", i.UserID)
+	}
+
+	http.Redirect(w, r, urlStr, http.StatusFound)
+}
+
+// stopImpersonation ends the impersonation in the request's cookie, if
+// any, and clears the cookie. It returns the impersonation ended, or
+// nil when there was none.
+func stopImpersonation(imps models.ImpersonationService,
+	as models.AuditService, w http.ResponseWriter,
+	r *http.Request) *models.Impersonation {
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     middleware.ImpersonationCookie,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+
+	cookie, err := r.Cookie(middleware.ImpersonationCookie)
+	if err != nil {
+		return nil
+	}
+
+	i, err := imps.ByToken(cookie.Value)
+	if err != nil {
+		return nil
+	}
+
+	if err := imps.Stop(i); err != nil {
+		log.Println(err)
+	}
+	audit(as, r, models.AuditEvent{
+		Action:     models.AuditImpersonateStopped,
+		ActorID:    i.AdminID,
+		UserID:     i.UserID,
+		TargetType: "impersonation",
+		TargetID:   i.ID,
+	})
+
+	return i
+}
+
+// AuditLog shows the newest events in the audit log, narrowed down by
+// the filters.
+//
+// GET /admin/audit?action=&user_id=&actor_id=&ip=&since=&until=
+func (a *Admin) AuditLog(w http.ResponseWriter, r *http.Request) {
+
+	var vd views.Data
+	var form AdminAuditForm
+
+	data := adminAudit{Actions: models.AuditActions}
+
+	if err := parseURLParams(r, &form); err != nil {
+		vd.SetAlert(err)
+		vd.Yield = data
+		a.AuditView.Render(w, r, vd)
+		return
+	}
+	data.Form = form
+
+	filter := models.AuditFilter{
+		Action:  form.Action,
+		UserID:  form.UserID,
+		ActorID: form.ActorID,
+		IP:      form.IP,
+	}
+
+	var err error
+	if form.Since != "" {
+		filter.Since, err = time.Parse(auditDateLayout, form.Since)
+	}
+	if err == nil && form.Until != "" {
+		filter.Until, err = time.Parse(auditDateLayout, form.Until)
+		// Until is inclusive, so include the whole day
+		filter.Until = filter.Until.AddDate(0, 0, 1)
+	}
+	if err != nil {
+		vd.AlertError("Dates must be written as YYYY-MM-DD.")
+		vd.Yield = data
+		a.AuditView.Render(w, r, vd)
+		return
+	}
+
+	data.Events, err = a.as.Search(filter)
+	if err != nil {
+		vd.SetAlert(err)
+	}
+
+	vd.Yield = data
+	a.AuditView.Render(w, r, vd)
+}
+
+// Emails shows the emails that could not be delivered, along with the
+// ones still waiting to be.
+//
+// GET /admin/emails
+func (a *Admin) Emails(w http.ResponseWriter, r *http.Request) {
+
+	var vd views.Data
+	var data adminEmails
+
+	var err error
+	data.Dead, err = a.obs.ByStatus(models.OutboxDead)
+	if err == nil {
+		data.Pending, err = a.obs.ByStatus(models.OutboxPending)
+	}
+	if err != nil {
+		vd.SetAlert(err)
+	}
+
+	vd.Yield = data
+	a.EmailsView.Render(w, r, vd)
+}
+
+// RetryEmail sends an email that could not be delivered again.
+//
+// POST /admin/emails/:id/retry
+func (a *Admin) RetryEmail(w http.ResponseWriter, r *http.Request) {
+
+	m, err := a.outboxMessageByID(w, r)
+	if err != nil {
+		return
+	}
+
+	err = a.obs.Retry(m)
+	if err == nil {
+		a.auditEmail(r, models.AuditEmailRetried, m)
+	}
+	a.redirectToEmails(w, r, err)
+}
+
+// DiscardEmail deletes an email that could not be delivered, so it is
+// never sent.
+//
+// POST /admin/emails/:id/discard
+func (a *Admin) DiscardEmail(w http.ResponseWriter, r *http.Request) {
+
+	m, err := a.outboxMessageByID(w, r)
+	if err != nil {
+		return
+	}
+
+	err = a.obs.Delete(m.ID)
+	if err == nil {
+		a.auditEmail(r, models.AuditEmailDiscarded, m)
+	}
+	a.redirectToEmails(w, r, err)
+}
+
+/////////////////////////////////////////////////////////////////////
+//
+// Helper methods
+//
+/////////////////////////////////////////////////////////////////////
+
+// userByID looks up the user from the id in the URL. If there is an
+// error it is written to the response, so the caller only needs to
+// return.
+func (a *Admin) userByID(w http.ResponseWriter, r *http.Request) (*models.User, error) {
+
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusNotFound)
+		return nil, err
+	}
+
+	user, err := a.us.ByID(uint(id))
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			http.Error(w, "User not found", http.StatusNotFound)
+		default:
+			http.Error(w, "Whoops! Something went wrong.",
+				http.StatusInternalServerError)
+		}
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// redirectToUser takes the admin back to the user's page, telling them
+// whether what they did worked.
+func (a *Admin) redirectToUser(w http.ResponseWriter, r *http.Request,
+	user *models.User, err error) {
+
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Done!",
+	}
+
+	if pErr, ok := err.(views.PublicError); ok {
+		alert.Level = views.AlertLvlError
+		alert.Message = pErr.Public()
+	} else if err != nil {
+		log.Println(err)
+		alert.Level = views.AlertLvlError
+		alert.Message = views.AlertMsgGeneric
+	}
+
+	urlStr := fmt.Sprintf("/admin/users/%d", user.ID)
+	views.RedirectAlert(w, r, urlStr, http.StatusFound, alert)
+}
+
+// outboxMessageByID looks up the message of the outbox from the id in
+// the URL. If there is an error it is written to the response, so the
+// caller only needs to return.
+func (a *Admin) outboxMessageByID(w http.ResponseWriter,
+	r *http.Request) (*models.OutboxMessage, error) {
+
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid email ID", http.StatusNotFound)
+		return nil, err
+	}
+
+	m, err := a.obs.ByID(uint(id))
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			http.Error(w, "Email not found", http.StatusNotFound)
+		default:
+			http.Error(w, "Whoops! Something went wrong.",
+				http.StatusInternalServerError)
+		}
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// auditEmail records what the admin did to a message of the outbox,
+// about its recipient when they have an account.
+func (a *Admin) auditEmail(r *http.Request, action string,
+	m *models.OutboxMessage) {
+
+	e := models.AuditEvent{
+		Action:     action,
+		TargetType: "email",
+		TargetID:   m.ID,
+		Detail:     m.Recipient,
+	}
+
+	recipient := m.Recipient
+	if addr, err := mail.ParseAddress(recipient); err == nil {
+		recipient = addr.Address
+	}
+	if user, err := a.us.ByEmail(recipient); err == nil {
+		e.UserID = user.ID
+	}
+
+	audit(a.as, r, e)
+}
+
+// redirectToEmails takes the admin back to the outbox, telling them
+// whether what they did worked.
+func (a *Admin) redirectToEmails(w http.ResponseWriter, r *http.Request,
+	err error) {
+
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Done!",
+	}
+
+	if pErr, ok := err.(views.PublicError); ok {
+		alert.Level = views.AlertLvlError
+		alert.Message = pErr.Public()
+	} else if err != nil {
+		log.Println(err)
+		alert.Level = views.AlertLvlError
+		alert.Message = views.AlertMsgGeneric
+	}
+
+	views.RedirectAlert(w, r, "/admin/emails", http.StatusFound, alert)
+}
+
+// formatBytes formats a size in bytes for humans, eg: 1.5 MB
+func formatBytes(n int64) string {
+
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div),
+		"KMGTPE"[exp])
+}
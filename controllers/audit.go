@@ -0,0 +1,36 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+
+	"lenslockedbr.com/context"
+	"lenslockedbr.com/models"
+	"lenslockedbr.com/realip"
+)
+
+// audit records the event in the audit log, filling in who did it and
+// from where. The actor defaults to the current user, and when an
+// admin is impersonating them the admin is recorded as well.
+// Failing to record an event is logged but never fails the request.
+func audit(as models.AuditService, r *http.Request, e models.AuditEvent) {
+
+	if as == nil {
+		return
+	}
+
+	ctx := r.Context()
+	if user := context.User(ctx); user != nil && e.ActorID == 0 {
+		e.ActorID = user.ID
+	}
+	if admin := context.Impersonator(ctx); admin != nil {
+		e.ImpersonatorID = admin.ID
+	}
+
+	e.IP = realip.FromRequest(r)
+	e.UserAgent = r.UserAgent()
+
+	if err := as.Create(&e); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,222 @@
+package controllers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"lenslockedbr.com/context"
+	"lenslockedbr.com/email"
+	"lenslockedbr.com/models"
+	"lenslockedbr.com/views"
+)
+
+type InviteForm struct {
+	Email string `schema:"email"`
+	Role  string `schema:"role"`
+}
+
+type AcceptInviteForm struct {
+	Token string `schema:"token"`
+}
+
+// acceptInvite is what the invitation page is rendered with.
+type acceptInvite struct {
+	Token    string
+	SignedIn bool
+}
+
+// Collaborators lets the owner of a gallery invite other people to
+// contribute to it.
+type Collaborators struct {
+	AcceptView    *views.View
+	cs            models.CollaboratorService
+	galleries     *Galleries
+	notifications *Notifications
+	emailer       *email.Client
+}
+
+// NewCollaborators creates the controller for the collaborators of
+// galleries. Galleries is needed to look up and authorize them, and
+// Notifications to tell the owners when their invitations are accepted.
+func NewCollaborators(cs models.CollaboratorService, galleries *Galleries,
+	notifications *Notifications, emailer *email.Client) *Collaborators {
+	return &Collaborators{
+		AcceptView: views.NewView("bootstrap", false,
+			"galleries/accept_invite"),
+		cs:            cs,
+		galleries:     galleries,
+		notifications: notifications,
+		emailer:       emailer,
+	}
+}
+
+// Invite emails someone an invitation to contribute to the gallery.
+//
+// POST /galleries/:id/collaborators
+func (c *Collaborators) Invite(w http.ResponseWriter, r *http.Request) {
+
+	gallery, err := c.galleries.authorizedGallery(w, r,
+		models.PermManage)
+	if err != nil {
+		return
+	}
+
+	var form InviteForm
+	if err := parseForm(r, &form); err != nil {
+		c.redirectToGallery(w, r, gallery, err)
+		return
+	}
+
+	user := context.User(r.Context())
+
+	inviter := user.Name
+	if inviter == "" {
+		inviter = user.Email
+	}
+
+	collaborator, err := c.cs.Invite(gallery, user, form.Email, form.Role,
+		func(token string, sender email.Sender) error {
+			return c.emailer.Via(sender).Invite(
+				strings.TrimSpace(form.Email), inviter,
+				gallery.Title, token,
+				time.Now().Add(models.InviteTTL))
+		})
+	if err == nil {
+		c.galleries.audit(r, models.AuditCollaboratorInvited, gallery,
+			collaborator.Email)
+	}
+	c.redirectToGallery(w, r, gallery, err)
+}
+
+// Revoke revokes an invitation, or removes a collaborator who already
+// accepted it.
+//
+// POST /galleries/:id/collaborators/:collaborator_id/revoke
+func (c *Collaborators) Revoke(w http.ResponseWriter, r *http.Request) {
+
+	gallery, err := c.galleries.authorizedGallery(w, r,
+		models.PermManage)
+	if err != nil {
+		return
+	}
+
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["collaborator_id"])
+	if err != nil {
+		c.redirectToGallery(w, r, gallery, models.ErrIDInvalid)
+		return
+	}
+
+	collaborator, err := c.cs.ByID(uint(id))
+	if err == nil && collaborator.GalleryID != gallery.ID {
+		err = models.ErrNotFound
+	}
+	if err != nil {
+		c.redirectToGallery(w, r, gallery, err)
+		return
+	}
+
+	err = c.cs.Revoke(collaborator)
+	if err == nil {
+		c.galleries.audit(r, models.AuditCollaboratorRevoked, gallery,
+			collaborator.Email)
+	}
+	c.redirectToGallery(w, r, gallery, err)
+}
+
+// Accept displays a button that accepts the invitation with the token
+// provided in the URL. Users who aren't signed in are asked to first.
+//
+// GET /invites/accept?token=
+func (c *Collaborators) Accept(w http.ResponseWriter, r *http.Request) {
+
+	var vd views.Data
+	var form AcceptInviteForm
+
+	if err := parseURLParams(r, &form); err != nil {
+		vd.SetAlert(err)
+	}
+
+	vd.Yield = acceptInvite{
+		Token:    form.Token,
+		SignedIn: context.User(r.Context()) != nil,
+	}
+	c.AcceptView.Render(w, r, vd)
+}
+
+// CompleteAccept makes the current user a collaborator on the gallery
+// they were invited to.
+//
+// POST /invites/accept
+func (c *Collaborators) CompleteAccept(w http.ResponseWriter, r *http.Request) {
+
+	var vd views.Data
+	var form AcceptInviteForm
+
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		vd.Yield = acceptInvite{SignedIn: true}
+		c.AcceptView.Render(w, r, vd)
+		return
+	}
+	vd.Yield = acceptInvite{Token: form.Token, SignedIn: true}
+
+	user := context.User(r.Context())
+
+	collaborator, err := c.cs.Accept(form.Token, user)
+	if err != nil {
+		vd.SetAlert(err)
+		c.AcceptView.Render(w, r, vd)
+		return
+	}
+
+	urlStr := fmt.Sprintf("/galleries/%d/edit", collaborator.GalleryID)
+
+	gallery, err := c.galleries.gs.ByID(collaborator.GalleryID)
+	if err != nil {
+		log.Println(err)
+	} else {
+		c.notifications.Notify(collaborator.InvitedByID,
+			models.Notification{
+				Kind:    models.NotifyInviteAccepted,
+				Actor:   displayName(user),
+				Subject: gallery.Title,
+				URL:     urlStr,
+			})
+	}
+
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "You can now contribute to this gallery.",
+	}
+	views.RedirectAlert(w, r, urlStr, http.StatusFound, alert)
+}
+
+// redirectToGallery takes the owner back to the edit page of the
+// gallery, telling them whether what they did worked.
+func (c *Collaborators) redirectToGallery(w http.ResponseWriter,
+	r *http.Request, gallery *models.Gallery, err error) {
+
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Done!",
+	}
+
+	if pErr, ok := err.(views.PublicError); ok {
+		alert.Level = views.AlertLvlError
+		alert.Message = pErr.Public()
+	} else if err != nil {
+		log.Println(err)
+		alert.Level = views.AlertLvlError
+		alert.Message = views.AlertMsgGeneric
+	}
+
+	urlStr := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	views.RedirectAlert(w, r, urlStr, http.StatusFound, alert)
+}
@@ -0,0 +1,264 @@
+package controllers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/gorilla/mux"
+
+	"lenslockedbr.com/context"
+	"lenslockedbr.com/models"
+	"lenslockedbr.com/views"
+)
+
+// CommentForm is a comment on a gallery, or on one of its images when
+// Image is set. ParentID is the comment it replies to, if any.
+type CommentForm struct {
+	Body     string `schema:"body"`
+	Image    string `schema:"image"`
+	ParentID uint   `schema:"parent_id"`
+}
+
+type CommentSettingsForm struct {
+	Disabled bool `schema:"disabled"`
+}
+
+// Comments lets the users who can see a gallery comment on it and on
+// its images, and those who manage it moderate the comments.
+type Comments struct {
+	cms           models.CommentService
+	galleries     *Galleries
+	notifications *Notifications
+}
+
+// NewComments creates the controller for the comments on galleries.
+// Galleries is needed to look up and authorize them, and Notifications
+// to tell the owners about new comments.
+func NewComments(cms models.CommentService, galleries *Galleries,
+	notifications *Notifications) *Comments {
+	return &Comments{
+		cms:           cms,
+		galleries:     galleries,
+		notifications: notifications,
+	}
+}
+
+// Create comments on the gallery, or on one of its images.
+//
+// POST /galleries/:id/comments
+func (c *Comments) Create(w http.ResponseWriter, r *http.Request) {
+
+	gallery, err := c.galleries.viewableGallery(w, r)
+	if err != nil {
+		return
+	}
+
+	var form CommentForm
+	if err := parseForm(r, &form); err != nil {
+		c.redirectToComments(w, r, gallery.ID, "", err)
+		return
+	}
+
+	if form.Image != "" {
+		if _, ok := findImage(gallery, form.Image); !ok {
+			c.redirectToComments(w, r, gallery.ID, "",
+				models.ErrNotFound)
+			return
+		}
+	}
+
+	user := context.User(r.Context())
+
+	comment := models.Comment{
+		Image:    form.Image,
+		ParentID: form.ParentID,
+		UserID:   user.ID,
+		Body:     form.Body,
+	}
+	if err := c.cms.Post(gallery, &comment); err != nil {
+		c.redirectToComments(w, r, gallery.ID, form.Image, err)
+		return
+	}
+
+	if gallery.UserID != user.ID {
+		c.notifications.Notify(gallery.UserID, models.Notification{
+			Kind:    models.NotifyComment,
+			Actor:   displayName(user),
+			Subject: gallery.Title,
+			URL:     commentsURL(gallery.ID, comment.Image),
+		})
+	}
+
+	c.redirectToComments(w, r, gallery.ID, comment.Image, nil)
+}
+
+// Delete deletes the comment along with its replies. Authors can
+// delete their own comments, and those who manage the gallery any of
+// them.
+//
+// POST /galleries/:id/comments/:comment_id/delete
+func (c *Comments) Delete(w http.ResponseWriter, r *http.Request) {
+
+	gallery, err := c.galleries.viewableGallery(w, r)
+	if err != nil {
+		return
+	}
+
+	comment, err := c.commentByID(w, r, gallery)
+	if err != nil {
+		return
+	}
+
+	user := context.User(r.Context())
+
+	if comment.UserID != user.ID {
+		err = c.galleries.gs.Authorize(user, gallery, models.PermManage)
+		if err != nil {
+			c.redirectToComments(w, r, gallery.ID, comment.Image, err)
+			return
+		}
+	}
+
+	err = c.cms.Delete(comment.ID)
+	c.redirectToComments(w, r, gallery.ID, comment.Image, err)
+}
+
+// Hide hides the comment, and its replies, from everyone but those who
+// manage the gallery.
+//
+// POST /galleries/:id/comments/:comment_id/hide
+func (c *Comments) Hide(w http.ResponseWriter, r *http.Request) {
+	c.setHidden(w, r, true)
+}
+
+// Unhide shows a hidden comment to everyone again.
+//
+// POST /galleries/:id/comments/:comment_id/unhide
+func (c *Comments) Unhide(w http.ResponseWriter, r *http.Request) {
+	c.setHidden(w, r, false)
+}
+
+// Settings enables or disables the comments on the gallery. Existing
+// comments are still shown when they are disabled.
+//
+// POST /galleries/:id/comments/settings
+func (c *Comments) Settings(w http.ResponseWriter, r *http.Request) {
+
+	gallery, err := c.galleries.authorizedGallery(w, r, models.PermManage)
+	if err != nil {
+		return
+	}
+
+	var form CommentSettingsForm
+	err = parseForm(r, &form)
+	if err == nil {
+		gallery.CommentsDisabled = form.Disabled
+		err = c.galleries.gs.Update(gallery)
+	}
+
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Comments enabled.",
+	}
+	if gallery.CommentsDisabled {
+		alert.Message = "Comments disabled."
+	}
+
+	if pErr, ok := err.(views.PublicError); ok {
+		alert.Level = views.AlertLvlError
+		alert.Message = pErr.Public()
+	} else if err != nil {
+		log.Println(err)
+		alert.Level = views.AlertLvlError
+		alert.Message = views.AlertMsgGeneric
+	}
+
+	urlStr := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	views.RedirectAlert(w, r, urlStr, http.StatusFound, alert)
+}
+
+func (c *Comments) setHidden(w http.ResponseWriter, r *http.Request,
+	hidden bool) {
+
+	gallery, err := c.galleries.authorizedGallery(w, r, models.PermManage)
+	if err != nil {
+		return
+	}
+
+	comment, err := c.commentByID(w, r, gallery)
+	if err != nil {
+		return
+	}
+
+	comment.Hidden = hidden
+	err = c.cms.Update(comment)
+	c.redirectToComments(w, r, gallery.ID, comment.Image, err)
+}
+
+// commentByID looks up the comment from the comment_id in the URL,
+// making sure it is on the gallery. If there is an error it is written
+// to the response, so the caller only needs to return.
+func (c *Comments) commentByID(w http.ResponseWriter, r *http.Request,
+	gallery *models.Gallery) (*models.Comment, error) {
+
+	id, err := strconv.Atoi(mux.Vars(r)["comment_id"])
+	if err != nil {
+		http.Error(w, "Invalid comment ID", http.StatusNotFound)
+		return nil, err
+	}
+
+	comment, err := c.cms.ByID(uint(id))
+	if err == nil && comment.GalleryID != gallery.ID {
+		err = models.ErrNotFound
+	}
+
+	switch err {
+	case nil:
+		return comment, nil
+	case models.ErrNotFound:
+		http.Error(w, "Comment not found", http.StatusNotFound)
+	default:
+		http.Error(w, "Whoops! Something went wrong.",
+			http.StatusInternalServerError)
+	}
+
+	return nil, err
+}
+
+// redirectToComments takes the user back to the comments on the image
+// of the gallery, or on the gallery itself when image is empty,
+// telling them whether what they did worked.
+func (c *Comments) redirectToComments(w http.ResponseWriter,
+	r *http.Request, galleryID uint, image string, err error) {
+
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Done!",
+	}
+
+	if pErr, ok := err.(views.PublicError); ok {
+		alert.Level = views.AlertLvlError
+		alert.Message = pErr.Public()
+	} else if err != nil {
+		log.Println(err)
+		alert.Level = views.AlertLvlError
+		alert.Message = views.AlertMsgGeneric
+	}
+
+	views.RedirectAlert(w, r, commentsURL(galleryID, image),
+		http.StatusFound, alert)
+}
+
+// commentsURL is where the comments on the image of the gallery, or on
+// the gallery itself when image is empty, are shown.
+func commentsURL(galleryID uint, image string) string {
+	if image == "" {
+		return fmt.Sprintf("/galleries/%d#comments", galleryID)
+	}
+
+	return fmt.Sprintf("/galleries/%d/images/%s#comments", galleryID,
+		url.PathEscape(image))
+}
@@ -0,0 +1,139 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"lenslockedbr.com/context"
+	"lenslockedbr.com/email"
+	"lenslockedbr.com/models"
+	"lenslockedbr.com/realip"
+	"lenslockedbr.com/views"
+)
+
+// ContactForm is the contact form. Token records when it was rendered,
+// and Website is a field people never see, so only bots fill it in.
+type ContactForm struct {
+	Name    string `schema:"name"`
+	Email   string `schema:"email"`
+	Message string `schema:"message"`
+	Token   string `schema:"token"`
+	Website string `schema:"website"`
+}
+
+// Contact forwards the messages sent through the contact form to the
+// support address, and keeps a copy of them.
+type Contact struct {
+	NewView      *views.View
+	cs           models.ContactService
+	emailer      *email.Client
+	supportEmail string
+}
+
+func NewContact(cs models.ContactService, emailer *email.Client,
+	supportEmail string) *Contact {
+	return &Contact{
+		NewView: views.NewView("bootstrap", false,
+			"static/contact"),
+		cs:           cs,
+		emailer:      emailer,
+		supportEmail: supportEmail,
+	}
+}
+
+// New renders the contact form, filled in with the name and email
+// address of the user when they are signed in.
+//
+// GET /contact
+func (c *Contact) New(w http.ResponseWriter, r *http.Request) {
+
+	var form ContactForm
+
+	if user := context.User(r.Context()); user != nil {
+		form.Name = user.Name
+		form.Email = user.Email
+	}
+
+	c.render(w, r, views.Data{}, form)
+}
+
+// Create stores the message and forwards it to the support address.
+// Messages from bots are dropped, but they are told it was sent so
+// they have no reason to try again.
+//
+// POST /contact
+func (c *Contact) Create(w http.ResponseWriter, r *http.Request) {
+
+	var vd views.Data
+	var form ContactForm
+
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		c.render(w, r, vd, form)
+		return
+	}
+
+	ip := realip.FromRequest(r)
+
+	if form.Website != "" {
+		log.Printf("contact: dropping message from %s, the honeypot "+
+			"was filled in\n", ip)
+		c.redirectSent(w, r)
+		return
+	}
+
+	if err := c.cs.CheckFormToken(form.Token, time.Now()); err != nil {
+		vd.SetAlert(err)
+		c.render(w, r, vd, form)
+		return
+	}
+
+	message := models.ContactMessage{
+		Name:      form.Name,
+		Email:     form.Email,
+		Message:   form.Message,
+		IP:        ip,
+		UserAgent: r.UserAgent(),
+	}
+	if user := context.User(r.Context()); user != nil {
+		message.UserID = user.ID
+	}
+
+	if err := c.cs.Create(&message); err != nil {
+		vd.SetAlert(err)
+		c.render(w, r, vd, form)
+		return
+	}
+
+	// The message is stored, so it isn't lost if this fails
+	err := c.emailer.Contact(c.supportEmail, message.Name, message.Email,
+		message.Message)
+	if err != nil {
+		log.Printf("contact: forwarding message %d: %v\n", message.ID,
+			err)
+	}
+
+	c.redirectSent(w, r)
+}
+
+// render renders the contact form with a fresh token, so the time it
+// takes to fill it in is measured from now.
+func (c *Contact) render(w http.ResponseWriter, r *http.Request,
+	vd views.Data, form ContactForm) {
+
+	form.Token = c.cs.FormToken(time.Now())
+	form.Website = ""
+
+	vd.Yield = form
+	c.NewView.Render(w, r, vd)
+}
+
+func (c *Contact) redirectSent(w http.ResponseWriter, r *http.Request) {
+	alert := views.Alert{
+		Level: views.AlertLvlSuccess,
+		Message: "Thanks! We got your message and will get back to " +
+			"you soon.",
+	}
+	views.RedirectAlert(w, r, "/", http.StatusFound, alert)
+}
@@ -0,0 +1,91 @@
+package controllers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"lenslockedbr.com/email"
+	"lenslockedbr.com/views"
+)
+
+type EmailPreviewForm struct {
+	Locale string `schema:"locale"`
+	Format string `schema:"format"`
+}
+
+// emailsIndex is what the list of emails is rendered with.
+type emailsIndex struct {
+	Emails  []string
+	Locales []string
+}
+
+// Emails lets developers look at every email we send, in every
+// locale, without having to trigger them. It must only be used in
+// development.
+type Emails struct {
+	IndexView *views.View
+	emailer   *email.Client
+}
+
+func NewEmails(emailer *email.Client) *Emails {
+	return &Emails{
+		IndexView: views.NewView("bootstrap", false, "dev/emails"),
+		emailer:   emailer,
+	}
+}
+
+// Index lists the emails, with links to preview each of them.
+//
+// GET /dev/emails
+func (e *Emails) Index(w http.ResponseWriter, r *http.Request) {
+
+	var vd views.Data
+
+	vd.Yield = emailsIndex{
+		Emails:  e.emailer.Emails(),
+		Locales: email.Locales,
+	}
+	e.IndexView.Render(w, r, vd)
+}
+
+// Preview renders the email with sample data, as HTML or as plain
+// text when format=text.
+//
+// GET /dev/emails/:name?locale=&format=
+func (e *Emails) Preview(w http.ResponseWriter, r *http.Request) {
+
+	var form EmailPreviewForm
+	if err := parseURLParams(r, &form); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if form.Locale == "" {
+		form.Locale = email.DefaultLocale
+	}
+
+	message, err := e.emailer.Preview(mux.Vars(r)["name"], form.Locale)
+	switch err {
+	case nil:
+	case email.ErrTemplateNotFound:
+		http.NotFound(w, r)
+		return
+	default:
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if form.Format == "text" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintf(w, "From: %s\nTo: %s\nSubject: %s\n\n%s",
+			message.From, message.To, message.Subject, message.Text)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, message.HTML)
+}
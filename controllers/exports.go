@@ -0,0 +1,89 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"lenslockedbr.com/context"
+	"lenslockedbr.com/models"
+	"lenslockedbr.com/views"
+)
+
+type ExportForm struct {
+	Token string `schema:"token"`
+}
+
+type Exports struct {
+	es models.ExportService
+}
+
+func NewExports(es models.ExportService) *Exports {
+	return &Exports{
+		es: es,
+	}
+}
+
+// Create requests a new export of the current user's data. The export
+// is built in the background and a download link is emailed once it
+// is ready.
+//
+// POST /account/export
+func (e *Exports) Create(w http.ResponseWriter, r *http.Request) {
+
+	user := context.User(r.Context())
+
+	if _, err := e.es.Request(user.ID); err != nil {
+		var vd views.Data
+		vd.SetAlert(err)
+		views.RedirectAlert(w, r, "/account", http.StatusFound,
+			*vd.Alert)
+		return
+	}
+
+	alert := views.Alert{
+		Level: views.AlertLvlInfo,
+		Message: "We are preparing your data. You will receive an " +
+			"email with a download link once it is ready.",
+	}
+	views.RedirectAlert(w, r, "/account", http.StatusFound, alert)
+}
+
+// Download sends the ZIP file of an export to its owner, as long as
+// the token is valid and the export hasn't expired.
+//
+// GET /account/export/download
+func (e *Exports) Download(w http.ResponseWriter, r *http.Request) {
+
+	var form ExportForm
+	if err := parseURLParams(r, &form); err != nil {
+		http.Error(w, "Invalid download link", http.StatusBadRequest)
+		return
+	}
+
+	export, err := e.es.ByToken(form.Token)
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			http.Error(w, "This download link is not valid "+
+				"anymore.", http.StatusNotFound)
+		default:
+			http.Error(w, "Whoops! Something went wrong.",
+				http.StatusInternalServerError)
+		}
+		return
+	}
+
+	user := context.User(r.Context())
+	if export.UserID != user.ID || export.Status != models.ExportReady ||
+		export.ExpiresAt == nil || time.Now().After(*export.ExpiresAt) {
+		http.Error(w, "This download link is not valid anymore.",
+			http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf(
+		"attachment; filename=\"lenslockedbr-export-%s.zip\"",
+		export.CreatedAt.Format("2006-01-02")))
+	http.ServeFile(w, r, export.Path())
+}
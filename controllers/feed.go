@@ -0,0 +1,142 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+
+	"lenslockedbr.com/context"
+	"lenslockedbr.com/models"
+	"lenslockedbr.com/views"
+)
+
+// FeedForm is the page of the feed to show, Before being the ID of
+// the last activity on the previous page.
+type FeedForm struct {
+	Before uint `schema:"before"`
+}
+
+// Feed shows users what the people they follow published lately.
+type Feed struct {
+	IndexView *views.View
+	acts      models.ActivityService
+	us        models.UserService
+	gs        models.GalleryService
+}
+
+// feedPage is what the feed view is rendered with. Next is the before
+// of the following page, and zero on the last one.
+type feedPage struct {
+	Items []feedItem
+	Next  uint
+}
+
+// feedItem is an activity along with who published it and the gallery
+// it was published on. Image is nil when the gallery itself was.
+type feedItem struct {
+	models.Activity
+	Author  *models.User
+	Gallery *models.Gallery
+	Image   *models.Image
+}
+
+func NewFeed(acts models.ActivityService, us models.UserService,
+	gs models.GalleryService) *Feed {
+	return &Feed{
+		IndexView: views.NewView("bootstrap", false,
+			"feed/index"),
+		acts: acts,
+		us:   us,
+		gs:   gs,
+	}
+}
+
+// Index renders a page of the feed of the current user, the newest
+// activities first.
+//
+// GET /feed
+func (f *Feed) Index(w http.ResponseWriter, r *http.Request) {
+
+	var vd views.Data
+	var form FeedForm
+
+	if err := parseURLParams(r, &form); err != nil {
+		vd.SetAlert(err)
+		f.IndexView.Render(w, r, vd)
+		return
+	}
+
+	user := context.User(r.Context())
+
+	// One more than a page tells us whether there is another one
+	activities, err := f.acts.Feed(user.ID, form.Before,
+		models.FeedPageSize+1)
+	if err != nil {
+		vd.SetAlert(err)
+		f.IndexView.Render(w, r, vd)
+		return
+	}
+
+	var page feedPage
+	if len(activities) > models.FeedPageSize {
+		activities = activities[:models.FeedPageSize]
+		page.Next = activities[len(activities)-1].ID
+	}
+
+	page.Items = f.items(activities)
+
+	vd.Yield = page
+	f.IndexView.Render(w, r, vd)
+}
+
+// items looks up who published the activities and on which galleries.
+// Activities whose author or gallery can't be found are left out, and
+// each of them is only looked up once.
+func (f *Feed) items(activities []models.Activity) []feedItem {
+
+	users := make(map[uint]*models.User)
+	galleries := make(map[uint]*models.Gallery)
+
+	items := make([]feedItem, 0, len(activities))
+
+	for _, a := range activities {
+		author, ok := users[a.UserID]
+		if !ok {
+			var err error
+			author, err = f.us.ByID(a.UserID)
+			if err != nil && err != models.ErrNotFound {
+				log.Println(err)
+			}
+			users[a.UserID] = author
+		}
+
+		gallery, ok := galleries[a.GalleryID]
+		if !ok {
+			var err error
+			gallery, err = f.gs.ByID(a.GalleryID)
+			if err != nil && err != models.ErrNotFound {
+				log.Println(err)
+			}
+			galleries[a.GalleryID] = gallery
+		}
+
+		if author == nil || gallery == nil {
+			continue
+		}
+
+		item := feedItem{
+			Activity: a,
+			Author:   author,
+			Gallery:  gallery,
+		}
+		if a.Image != "" {
+			item.Image = &models.Image{
+				GalleryID: gallery.ID,
+				Filename:  a.Image,
+			}
+		}
+
+		items = append(items, item)
+	}
+
+	return items
+}
@@ -2,6 +2,7 @@ package controllers
 
 import (
 	"fmt"
+	"log"
 	"net/http"
 	"strconv"
 
@@ -21,7 +22,88 @@ const (
 )
 
 type GalleryForm struct {
-	Title string `schema:"title"`
+	Title    string `schema:"title"`
+	StudioID uint   `schema:"studio_id"`
+	Public   bool   `schema:"public"`
+}
+
+// galleriesIndex is what the list of galleries is rendered with.
+type galleriesIndex struct {
+	Galleries []models.Gallery
+	Studios   []studioGalleries
+	Shared    []sharedGallery
+}
+
+// studioGalleries are the galleries of a studio the user is a member
+// of.
+type studioGalleries struct {
+	Studio     models.Studio
+	Membership *models.Membership
+	Galleries  []models.Gallery
+}
+
+// editGallery is what the edit gallery page is rendered with. What is
+// shown depends on what the user is allowed to do, eg: uploaders only
+// see the upload form.
+type editGallery struct {
+	*models.Gallery
+	CanEdit       bool
+	CanManage     bool
+	Collaborators []models.Collaborator
+	Roles         []string
+}
+
+// sharedGallery is a gallery the user collaborates on.
+type sharedGallery struct {
+	models.Gallery
+	Collaborator models.Collaborator
+}
+
+// showGallery is what a gallery is shown with, CommentCounts being how
+// many comments each image has.
+type showGallery struct {
+	*models.Gallery
+	CommentCounts map[string]int
+	Comments      commentsData
+}
+
+// showImage is what an image of a gallery is shown with.
+type showImage struct {
+	Gallery  *models.Gallery
+	Image    models.Image
+	Comments commentsData
+}
+
+// commentsData is what the comments on a gallery, or on one of its
+// images, are rendered with.
+type commentsData struct {
+	GalleryID   uint
+	Image       string
+	Threads     []commentThread
+	SignedIn    bool
+	Disabled    bool
+	CanModerate bool
+}
+
+type commentThread struct {
+	comment
+	Replies []comment
+}
+
+// comment is a comment along with the name of its author, and what the
+// current user can do to it.
+type comment struct {
+	models.Comment
+	Author      string
+	CanDelete   bool
+	CanModerate bool
+	CanReply    bool
+}
+
+// newGallery is what the new gallery form is rendered with, Studios
+// being the ones the user can create galleries in.
+type newGallery struct {
+	Studios []models.Studio
 }
 
 type Galleries struct {
@@ -29,36 +111,62 @@ type Galleries struct {
 	ShowView  *views.View
 	EditView  *views.View
 	IndexView *views.View
+	ImageView *views.View
 	gs        models.GalleryService
 	is        models.ImageService
+	ss        models.StudioService
+	cs        models.CollaboratorService
+	cms       models.CommentService
+	us        models.UserService
+	as        models.AuditService
+	acts      models.ActivityService
 	r         *mux.Router
 }
 
 func NewGalleries(gs models.GalleryService, is models.ImageService,
+	ss models.StudioService, cs models.CollaboratorService,
+	cms models.CommentService, us models.UserService,
+	as models.AuditService, acts models.ActivityService,
 	r *mux.Router) *Galleries {
 	return &Galleries{
 		NewView: views.NewView("bootstrap", false,
 			"galleries/new"),
 		ShowView: views.NewView("bootstrap", false,
-			"galleries/show"),
+			"galleries/show", "galleries/comments"),
 		EditView: views.NewView("bootstrap", false,
 			"galleries/edit"),
 		IndexView: views.NewView("bootstrap", false,
 			"galleries/index"),
-		gs: gs,
-		is: is,
-		r:  r,
+		ImageView: views.NewView("bootstrap", false,
+			"galleries/image", "galleries/comments"),
+		gs:   gs,
+		is:   is,
+		ss:   ss,
+		cs:   cs,
+		cms:  cms,
+		us:   us,
+		as:   as,
+		acts: acts,
+		r:    r,
 	}
 }
 
+// New renders the form to create a gallery, either for the user or
+// for one of their studios.
+//
+// GET /galleries/new
 func (g *Galleries) New(w http.ResponseWriter, r *http.Request) {
-	g.NewView.Render(w, r, nil)
+	var vd views.Data
+	vd.Yield = g.newGallery(r)
+	g.NewView.Render(w, r, vd)
 }
 
 func (g *Galleries) Create(w http.ResponseWriter, r *http.Request) {
 	var vd views.Data
 	var form GalleryForm
 
+	vd.Yield = g.newGallery(r)
+
 	if err := parseForm(r, &form); err != nil {
 		vd.SetAlert(err)
 		g.NewView.Render(w, r, vd)
@@ -68,16 +176,23 @@ func (g *Galleries) Create(w http.ResponseWriter, r *http.Request) {
 	user := context.User(r.Context())
 
 	gallery := models.Gallery{
-		Title:  form.Title,
-		UserID: user.ID,
+		Title:    form.Title,
+		UserID:   user.ID,
+		StudioID: form.StudioID,
 	}
 
-	if err := g.gs.Create(&gallery); err != nil {
+	err := g.gs.Authorize(user, &gallery, models.PermEdit)
+	if err == nil {
+		err = g.gs.Create(&gallery)
+	}
+	if err != nil {
 		vd.SetAlert(err)
 		g.NewView.Render(w, r, vd)
 		return
 	}
 
+	g.audit(r, models.AuditGalleryCreated, &gallery, gallery.Title)
+
 	url, err := g.r.Get(EditGallery).URL("id",
 		strconv.Itoa(int(gallery.ID)))
 	if err != nil {
@@ -89,50 +204,88 @@ func (g *Galleries) Create(w http.ResponseWriter, r *http.Request) {
 }
 
 func (g *Galleries) Show(w http.ResponseWriter, r *http.Request) {
-	gallery, err := g.galleryByID(w, r)
+	gallery, err := g.viewableGallery(w, r)
 	if err != nil {
 		return
 	}
 
+	counts, err := g.cms.ImageCounts(gallery.ID)
+	if err != nil {
+		log.Println(err)
+	}
+
 	var vd views.Data
-	vd.Yield = gallery
+	vd.Yield = showGallery{
+		Gallery:       gallery,
+		CommentCounts: counts,
+		Comments:      g.comments(r, gallery, ""),
+	}
 	g.ShowView.Render(w, r, vd)
 }
 
-func (g *Galleries) Edit(w http.ResponseWriter, r *http.Request) {
-	gallery, err := g.galleryByID(w, r)
+// Image shows an image of the gallery along with the comments on it.
+//
+// GET /galleries/:id/images/:filename
+func (g *Galleries) Image(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.viewableGallery(w, r)
 	if err != nil {
 		return
 	}
 
-	user := context.User(r.Context())
-	if gallery.UserID != user.ID {
-		http.Error(w, "You do not have permission to edit "+
-			"this gallery.",
-			http.StatusForbidden)
+	image, ok := findImage(gallery, mux.Vars(r)["filename"])
+	if !ok {
+		http.Error(w, "Image not found", http.StatusNotFound)
 		return
 	}
 
 	var vd views.Data
-	vd.Yield = gallery
-	g.EditView.Render(w, r, vd)
+	vd.Yield = showImage{
+		Gallery:  gallery,
+		Image:    image,
+		Comments: g.comments(r, gallery, image.Filename),
+	}
+	g.ImageView.Render(w, r, vd)
 }
 
-func (g *Galleries) Update(w http.ResponseWriter, r *http.Request) {
-	gallery, err := g.galleryByID(w, r)
+// ImageFile serves the file of an image of the gallery.
+//
+// GET /images/galleries/:id/:filename
+func (g *Galleries) ImageFile(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.viewableGallery(w, r)
 	if err != nil {
 		return
 	}
 
-	user := context.User(r.Context())
-	if gallery.UserID != user.ID {
-		http.Error(w, "Gallery not found.",
-			http.StatusForbidden)
+	image, ok := findImage(gallery, mux.Vars(r)["filename"])
+	if !ok {
+		http.Error(w, "Image not found", http.StatusNotFound)
+		return
+	}
+
+	// Whoever can see the gallery now may not be able to later
+	w.Header().Set("Cache-Control", "private")
+	http.ServeFile(w, r, image.RelativePath())
+}
+
+func (g *Galleries) Edit(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.authorizedGallery(w, r, models.PermUpload)
+	if err != nil {
+		return
+	}
+
+	var vd views.Data
+	vd.Yield = g.editGallery(r, gallery)
+	g.EditView.Render(w, r, vd)
+}
+
+func (g *Galleries) Update(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.authorizedGallery(w, r, models.PermEdit)
+	if err != nil {
 		return
 	}
 
 	var vd views.Data
-	vd.Yield = gallery
+	vd.Yield = g.editGallery(r, gallery)
 
 	var form GalleryForm
 
@@ -144,10 +297,22 @@ func (g *Galleries) Update(w http.ResponseWriter, r *http.Request) {
 
 	gallery.Title = form.Title
 
+	// Only the owner decides whether it is on their profile
+	published := false
+	user := context.User(r.Context())
+	if gallery.StudioID == 0 && gallery.UserID == user.ID {
+		published = form.Public && !gallery.Public
+		gallery.Public = form.Public
+	}
+
 	err = g.gs.Update(gallery)
 	if err != nil {
 		vd.SetAlert(err)
 	} else {
+		g.audit(r, models.AuditGalleryUpdated, gallery, gallery.Title)
+		if published {
+			g.activity(models.ActivityGalleryPublished, gallery, "")
+		}
 		vd.Alert = &views.Alert{
 			Level:   views.AlertLvlSuccess,
 			Message: "Gallery updated successfully!",
@@ -159,26 +324,36 @@ func (g *Galleries) Update(w http.ResponseWriter, r *http.Request) {
 
 func (g *Galleries) Delete(w http.ResponseWriter, r *http.Request) {
 
-	gallery, err := g.galleryByID(w, r)
+	gallery, err := g.authorizedGallery(w, r, models.PermManage)
 	if err != nil {
 		return
 	}
 
-	user := context.User(r.Context())
-	if gallery.UserID != user.ID {
-		http.Error(w, "You do not have permission to delete "+
-			"this gallery.",
-			http.StatusForbidden)
-		return
-	}
-
 	var vd views.Data
 
 	err = g.gs.Delete(gallery.ID)
 	if err != nil {
 		vd.SetAlert(err)
-		vd.Yield = gallery
+		vd.Yield = g.editGallery(r, gallery)
 		g.EditView.Render(w, r, vd)
+		return
+	}
+
+	g.audit(r, models.AuditGalleryDeleted, gallery, gallery.Title)
+
+	// The gallery is gone, so there is no point in keeping its
+	// images, collaborators or comments around.
+	if err := g.is.DeleteAll(gallery.ID); err != nil {
+		log.Println(err)
+	}
+	if err := g.cs.DeleteByGalleryID(gallery.ID); err != nil {
+		log.Println(err)
+	}
+	if err := g.cms.DeleteByGalleryID(gallery.ID); err != nil {
+		log.Println(err)
+	}
+	if err := g.acts.DeleteByGalleryID(gallery.ID); err != nil {
+		log.Println(err)
 	}
 
 	url, err := g.r.Get(IndexGallery).URL()
@@ -201,27 +376,67 @@ func (g *Galleries) Index(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	studios, err := g.ss.ByUserID(user.ID)
+	if err != nil {
+		http.Error(w, "Something went wrong.",
+			http.StatusInternalServerError)
+		return
+	}
+
+	data := galleriesIndex{Galleries: galleries}
+	for _, studio := range studios {
+		m, err := g.ss.Membership(studio.ID, user.ID)
+		if err != nil {
+			continue
+		}
+
+		galleries, err := g.gs.ByStudioID(studio.ID)
+		if err != nil {
+			http.Error(w, "Something went wrong.",
+				http.StatusInternalServerError)
+			return
+		}
+
+		data.Studios = append(data.Studios, studioGalleries{
+			Studio:     studio,
+			Membership: m,
+			Galleries:  galleries,
+		})
+	}
+
+	collaborations, err := g.cs.ByUserID(user.ID)
+	if err != nil {
+		http.Error(w, "Something went wrong.",
+			http.StatusInternalServerError)
+		return
+	}
+
+	for _, c := range collaborations {
+		gallery, err := g.gs.ByID(c.GalleryID)
+		if err != nil {
+			continue
+		}
+
+		data.Shared = append(data.Shared, sharedGallery{
+			Gallery:      *gallery,
+			Collaborator: c,
+		})
+	}
+
 	var vd views.Data
-	vd.Yield = galleries
+	vd.Yield = data
 	g.IndexView.Render(w, r, vd)
 }
 
 func (g *Galleries) ImageUpload(w http.ResponseWriter, r *http.Request) {
 
-	gallery, err := g.galleryByID(w, r)
+	gallery, err := g.authorizedGallery(w, r, models.PermUpload)
 	if err != nil {
 		return
 	}
 
-	user := context.User(r.Context())
-	if gallery.UserID != user.ID {
-		http.Error(w, "Gallery not found.",
-			http.StatusForbidden)
-		return
-	}
-
 	var vd views.Data
-	vd.Yield = gallery
+	vd.Yield = g.editGallery(r, gallery)
 
 	err = r.ParseMultipartForm(maxMultipartMem)
 	if err != nil {
@@ -249,6 +464,11 @@ func (g *Galleries) ImageUpload(w http.ResponseWriter, r *http.Request) {
 			g.EditView.Render(w, r, vd)
 			return
 		}
+
+		g.audit(r, models.AuditImageUploaded, gallery, f.Filename)
+		if gallery.Public && gallery.StudioID == 0 {
+			g.activity(models.ActivityImageAdded, gallery, f.Filename)
+		}
 	}
 
 	url, err := g.r.Get(EditGallery).
@@ -263,18 +483,11 @@ func (g *Galleries) ImageUpload(w http.ResponseWriter, r *http.Request) {
 
 func (g *Galleries) ImageDelete(w http.ResponseWriter, r *http.Request) {
 
-	gallery, err := g.galleryByID(w, r)
+	gallery, err := g.authorizedGallery(w, r, models.PermEdit)
 	if err != nil {
 		return
 	}
 
-	user := context.User(r.Context())
-	if gallery.UserID != user.ID {
-		http.Error(w, "You do not have permission to edit "+
-			"this gallery or image", http.StatusForbidden)
-		return
-	}
-
 	// Get the filname from the path
 	filename := mux.Vars(r)["filename"]
 	// Build the Image model
@@ -288,12 +501,21 @@ func (g *Galleries) ImageDelete(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		// Render the edit page with any error
 		var vd views.Data
-		vd.Yield = gallery
+		vd.Yield = g.editGallery(r, gallery)
 		vd.SetAlert(err)
 		g.EditView.Render(w, r, vd)
 		return
 	}
 
+	g.audit(r, models.AuditImageDeleted, gallery, filename)
+
+	if err := g.cms.DeleteByImage(gallery.ID, filename); err != nil {
+		log.Println(err)
+	}
+	if err := g.acts.DeleteByImage(gallery.ID, filename); err != nil {
+		log.Println(err)
+	}
+
 	// If all goes well, redirect to the edit gallery page
 	url, err := g.r.Get(EditGallery).
 		URL("id", fmt.Sprintf("%v", gallery.ID))
@@ -333,3 +555,222 @@ func (g *Galleries) galleryByID(w http.ResponseWriter, r *http.Request) (*models
 
 	return gallery, nil
 }
+
+// authorizedGallery looks up the gallery from the id in the URL and
+// checks that the current user is allowed to do perm to it. If there
+// is an error it is written to the response, so the caller only needs
+// to return.
+func (g *Galleries) authorizedGallery(w http.ResponseWriter, r *http.Request,
+	perm models.Permission) (*models.Gallery, error) {
+
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := g.authorize(w, r, gallery, perm); err != nil {
+		return nil, err
+	}
+
+	return gallery, nil
+}
+
+// viewableGallery looks up the gallery from the id in the URL and
+// checks that the current user can see it. Anyone can see public
+// galleries, signed in or not. If there is an error it is written to
+// the response, so the caller only needs to return.
+func (g *Galleries) viewableGallery(w http.ResponseWriter,
+	r *http.Request) (*models.Gallery, error) {
+
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return nil, err
+	}
+
+	if gallery.Public {
+		return gallery, nil
+	}
+
+	if err := g.authorize(w, r, gallery, models.PermView); err != nil {
+		return nil, err
+	}
+
+	return gallery, nil
+}
+
+// authorize checks that the current user is allowed to do perm to the
+// gallery, writing the error to the response when they aren't.
+func (g *Galleries) authorize(w http.ResponseWriter, r *http.Request,
+	gallery *models.Gallery, perm models.Permission) error {
+
+	user := context.User(r.Context())
+
+	err := g.gs.Authorize(user, gallery, perm)
+	switch err {
+	case nil:
+	case models.ErrForbidden:
+		http.Error(w, "You do not have permission to do that to "+
+			"this gallery.", http.StatusForbidden)
+	default:
+		http.Error(w, "Whoops! Something went wrong.",
+			http.StatusInternalServerError)
+	}
+
+	return err
+}
+
+// editGallery returns what the edit page needs to show the gallery to
+// the current user.
+func (g *Galleries) editGallery(r *http.Request,
+	gallery *models.Gallery) editGallery {
+
+	data := editGallery{
+		Gallery: gallery,
+		Roles:   models.CollaboratorRoles,
+	}
+
+	user := context.User(r.Context())
+
+	allowed, err := g.gs.Allowed(user, gallery)
+	if err != nil {
+		return data
+	}
+	data.CanEdit = allowed >= models.PermEdit
+	data.CanManage = allowed >= models.PermManage
+
+	if data.CanManage {
+		data.Collaborators, err = g.cs.ByGalleryID(gallery.ID)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+
+	return data
+}
+
+// comments returns the comments on the image of the gallery, or on the
+// gallery itself when image is empty, as the current user sees them.
+// Failing to look them up is logged, and the page is shown without
+// them.
+func (g *Galleries) comments(r *http.Request, gallery *models.Gallery,
+	image string) commentsData {
+
+	data := commentsData{
+		GalleryID: gallery.ID,
+		Image:     image,
+		Disabled:  gallery.CommentsDisabled,
+	}
+
+	user := context.User(r.Context())
+	if user != nil {
+		data.SignedIn = true
+		allowed, err := g.gs.Allowed(user, gallery)
+		data.CanModerate = err == nil && allowed >= models.PermManage
+	}
+
+	threads, err := g.cms.Threads(gallery.ID, image, data.CanModerate)
+	if err != nil {
+		log.Println(err)
+		return data
+	}
+
+	authors := make(map[uint]string)
+	withAuthor := func(c models.Comment) comment {
+		name, ok := authors[c.UserID]
+		if !ok {
+			name = "Someone"
+			if author, err := g.us.ByID(c.UserID); err == nil {
+				name = displayName(author)
+			}
+			authors[c.UserID] = name
+		}
+
+		return comment{
+			Comment: c,
+			Author:  name,
+			CanDelete: data.CanModerate ||
+				(user != nil && user.ID == c.UserID),
+			CanModerate: data.CanModerate,
+			CanReply:    data.SignedIn && !data.Disabled,
+		}
+	}
+
+	for _, t := range threads {
+		thread := commentThread{comment: withAuthor(t.Comment)}
+		for _, reply := range t.Replies {
+			thread.Replies = append(thread.Replies,
+				withAuthor(reply))
+		}
+		data.Threads = append(data.Threads, thread)
+	}
+
+	return data
+}
+
+// findImage returns the image of the gallery with the filename.
+func findImage(gallery *models.Gallery, filename string) (models.Image,
+	bool) {
+
+	for _, image := range gallery.Images {
+		if image.Filename == filename {
+			return image, true
+		}
+	}
+
+	return models.Image{}, false
+}
+
+// newGallery returns the studios the current user can create galleries
+// in, for the new gallery form.
+func (g *Galleries) newGallery(r *http.Request) newGallery {
+
+	var data newGallery
+
+	user := context.User(r.Context())
+
+	studios, err := g.ss.ByUserID(user.ID)
+	if err != nil {
+		log.Println(err)
+		return data
+	}
+
+	for _, studio := range studios {
+		m, err := g.ss.Membership(studio.ID, user.ID)
+		if err == nil && m.CanEdit() {
+			data.Studios = append(data.Studios, studio)
+		}
+	}
+
+	return data
+}
+
+// audit records something done to the gallery in the audit log, with
+// the detail being eg: the title of the gallery or name of the image.
+func (g *Galleries) audit(r *http.Request, action string,
+	gallery *models.Gallery, detail string) {
+
+	audit(g.as, r, models.AuditEvent{
+		Action:     action,
+		UserID:     gallery.UserID,
+		TargetType: "gallery",
+		TargetID:   gallery.ID,
+		Detail:     detail,
+	})
+}
+
+// activity records what was published on the gallery for the feeds of
+// those who follow its owner. Failing to is only logged, the feed is
+// not worth failing the request over.
+func (g *Galleries) activity(kind string, gallery *models.Gallery,
+	image string) {
+
+	err := g.acts.Create(&models.Activity{
+		UserID:    gallery.UserID,
+		Kind:      kind,
+		GalleryID: gallery.ID,
+		Image:     image,
+	})
+	if err != nil {
+		log.Println(err)
+	}
+}
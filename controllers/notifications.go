@@ -0,0 +1,282 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+
+	"lenslockedbr.com/context"
+	"lenslockedbr.com/email"
+	"lenslockedbr.com/models"
+	"lenslockedbr.com/views"
+)
+
+// NotificationPrefsForm holds the kinds of notifications the user
+// wants to be emailed, and how often.
+type NotificationPrefsForm struct {
+	Frequency string   `schema:"frequency"`
+	Email     []string `schema:"email"`
+}
+
+type UnsubscribeForm struct {
+	UserID uint   `schema:"user"`
+	Kind   string `schema:"kind"`
+	Token  string `schema:"token"`
+}
+
+// notificationPrefs is what the notification preferences are rendered
+// with.
+type notificationPrefs struct {
+	Frequency string
+	Kinds     []notificationKind
+}
+
+type notificationKind struct {
+	Kind        string
+	Description string
+	Email       bool
+}
+
+// unsubscribe is what the page confirming an unsubscribe link is
+// rendered with.
+type unsubscribe struct {
+	UnsubscribeForm
+	All         bool
+	Description string
+}
+
+// unsubscribed is what the unsubscribe page is rendered with.
+type unsubscribed struct {
+	All         bool
+	Description string
+}
+
+// Notifications lists the notifications of users and lets them choose
+// which ones they are emailed. Other controllers use Notify to create
+// them.
+type Notifications struct {
+	IndexView        *views.View
+	PrefsView        *views.View
+	UnsubscribeView  *views.View
+	UnsubscribedView *views.View
+	ns               models.NotificationService
+	us               models.UserService
+	emailer          *email.Client
+}
+
+func NewNotifications(ns models.NotificationService, us models.UserService,
+	emailer *email.Client) *Notifications {
+	return &Notifications{
+		IndexView: views.NewView("bootstrap", false,
+			"notifications/index"),
+		PrefsView: views.NewView("bootstrap", false,
+			"notifications/preferences"),
+		UnsubscribeView: views.NewView("bootstrap", false,
+			"notifications/unsubscribe"),
+		UnsubscribedView: views.NewView("bootstrap", false,
+			"notifications/unsubscribed"),
+		ns:      ns,
+		us:      us,
+		emailer: emailer,
+	}
+}
+
+// Index lists the latest notifications of the current user, and marks
+// them as read.
+//
+// GET /notifications
+func (n *Notifications) Index(w http.ResponseWriter, r *http.Request) {
+
+	var vd views.Data
+
+	user := context.User(r.Context())
+
+	notifications, err := n.ns.ByUserID(user.ID)
+	if err != nil {
+		vd.SetAlert(err)
+		n.IndexView.Render(w, r, vd)
+		return
+	}
+
+	if err := n.ns.MarkRead(user.ID); err != nil {
+		log.Println(err)
+	}
+
+	// They have been read now, so don't list them in the navbar
+	ctx := context.WithNotifications(r.Context(), nil)
+
+	vd.Yield = notifications
+	n.IndexView.Render(w, r.WithContext(ctx), vd)
+}
+
+// Prefs displays which notifications the current user is emailed, and
+// how often.
+//
+// GET /account/notifications
+func (n *Notifications) Prefs(w http.ResponseWriter, r *http.Request) {
+	n.renderPrefs(w, r, views.Data{})
+}
+
+// UpdatePrefs saves which notifications the current user is emailed,
+// and how often.
+//
+// POST /account/notifications
+func (n *Notifications) UpdatePrefs(w http.ResponseWriter, r *http.Request) {
+
+	var vd views.Data
+	var form NotificationPrefsForm
+
+	user := context.User(r.Context())
+
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		n.renderPrefs(w, r, vd)
+		return
+	}
+
+	emailed := make(map[string]bool, len(form.Email))
+	for _, kind := range form.Email {
+		emailed[kind] = true
+	}
+
+	for _, kind := range models.NotificationKinds {
+		err := n.ns.SetEmailPref(user.ID, kind, emailed[kind])
+		if err != nil {
+			vd.SetAlert(err)
+			n.renderPrefs(w, r, vd)
+			return
+		}
+	}
+
+	user.NotifyFrequency = form.Frequency
+	if err := n.us.Update(user); err != nil {
+		vd.SetAlert(err)
+		n.renderPrefs(w, r, vd)
+		return
+	}
+
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Your notification preferences have been saved.",
+	}
+	views.RedirectAlert(w, r, "/account/notifications", http.StatusFound,
+		alert)
+}
+
+// Unsubscribe displays a button that stops emailing the user a kind of
+// notification, or all of them. It is the link at the bottom of the
+// notification emails, which works without signing in. Following it
+// changes nothing, since mail scanners follow links too.
+//
+// GET /notifications/unsubscribe?user=&kind=&token=
+func (n *Notifications) Unsubscribe(w http.ResponseWriter, r *http.Request) {
+
+	var vd views.Data
+	var form UnsubscribeForm
+
+	if err := parseURLParams(r, &form); err != nil {
+		vd.SetAlert(err)
+		n.UnsubscribedView.Render(w, r, vd)
+		return
+	}
+
+	vd.Yield = unsubscribe{
+		UnsubscribeForm: form,
+		All:             form.Kind == models.NotifyAll,
+		Description:     models.NotificationDescription(form.Kind),
+	}
+	n.UnsubscribeView.Render(w, r, vd)
+}
+
+// CompleteUnsubscribe stops emailing the user a kind of notification,
+// or all of them. The button of Unsubscribe posts its form here, and
+// mail clients post to the URL of the link itself, with the body
+// List-Unsubscribe=One-Click (RFC 8058), which is why the parameters
+// are also read from the URL and no CSRF token is needed.
+//
+// POST /notifications/unsubscribe?user=&kind=&token=
+func (n *Notifications) CompleteUnsubscribe(w http.ResponseWriter,
+	r *http.Request) {
+
+	var vd views.Data
+	var form UnsubscribeForm
+
+	if err := parseURLParams(r, &form); err != nil {
+		vd.SetAlert(err)
+		n.UnsubscribedView.Render(w, r, vd)
+		return
+	}
+
+	err := n.ns.Unsubscribe(form.UserID, form.Kind, form.Token)
+	if err != nil {
+		vd.SetAlert(err)
+		n.UnsubscribedView.Render(w, r, vd)
+		return
+	}
+
+	vd.Yield = unsubscribed{
+		All:         form.Kind == models.NotifyAll,
+		Description: models.NotificationDescription(form.Kind),
+	}
+	n.UnsubscribedView.Render(w, r, vd)
+}
+
+// Notify notifies the user, emailing them right away if that is what
+// they prefer. Failing to notify is logged but never fails the
+// request.
+func (n *Notifications) Notify(userID uint, notification models.Notification) {
+
+	user, err := n.us.ByID(userID)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	instant, err := n.ns.Notify(user, &notification)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	if !instant {
+		return
+	}
+
+	notice := email.Notice{
+		Kind:    notification.Kind,
+		Actor:   notification.Actor,
+		Subject: notification.Subject,
+		URL:     notification.URL,
+	}
+	token := n.ns.UnsubscribeToken(user.ID, notification.Kind)
+
+	err = n.emailer.Notification(user.Email, notice, user.ID, token)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (n *Notifications) renderPrefs(w http.ResponseWriter, r *http.Request,
+	vd views.Data) {
+
+	user := context.User(r.Context())
+
+	prefs, err := n.ns.EmailPrefs(user.ID)
+	if err != nil {
+		vd.SetAlert(err)
+	}
+
+	kinds := make([]notificationKind, 0, len(models.NotificationKinds))
+	for _, kind := range models.NotificationKinds {
+		kinds = append(kinds, notificationKind{
+			Kind:        kind,
+			Description: models.NotificationDescription(kind),
+			Email:       prefs[kind],
+		})
+	}
+
+	vd.Yield = notificationPrefs{
+		Frequency: user.NotifyFrequency,
+		Kinds:     kinds,
+	}
+	n.PrefsView.Render(w, r, vd)
+}
@@ -0,0 +1,222 @@
+package controllers
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"strings"
+
+	"lenslockedbr.com/context"
+	"lenslockedbr.com/models"
+	"lenslockedbr.com/oidc"
+	"lenslockedbr.com/rand"
+	"lenslockedbr.com/views"
+)
+
+const (
+	// oidcCookie holds the state and nonce of a sign in that is in
+	// progress, so we can check them when the provider sends the
+	// user back.
+	oidcCookie = "oidc_state"
+	oidcPath   = "/auth/oidc"
+
+	oidcFailedMsg = "We couldn't sign you in with your account. " +
+		"Please try again."
+)
+
+type OIDC struct {
+	provider *oidc.Provider
+	is       models.IdentityService
+	users    *Users
+}
+
+// NewOIDC creates the controller that signs users in with an OpenID
+// Connect provider. Users is needed to start their sessions.
+func NewOIDC(provider *oidc.Provider, is models.IdentityService,
+	users *Users) *OIDC {
+	return &OIDC{
+		provider: provider,
+		is:       is,
+		users:    users,
+	}
+}
+
+// Login sends the user to the provider's login page.
+//
+// GET /auth/oidc
+func (o *OIDC) Login(w http.ResponseWriter, r *http.Request) {
+
+	state, err := rand.String(32)
+	if err != nil {
+		o.failed(w, r, err)
+		return
+	}
+
+	nonce, err := rand.String(32)
+	if err != nil {
+		o.failed(w, r, err)
+		return
+	}
+
+	authURL, err := o.provider.AuthCodeURL(r.Context(), state, nonce)
+	if err != nil {
+		o.failed(w, r, err)
+		return
+	}
+
+	// Lax so that the cookie comes back with the redirect from the
+	// provider, which is a top level navigation.
+	cookie := http.Cookie{
+		Name:     oidcCookie,
+		Value:    state + "." + nonce,
+		Path:     oidcPath,
+		MaxAge:   600,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	http.SetCookie(w, &cookie)
+
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// Callback is where the provider sends the user back to. When someone
+// is already signed in the identity is linked to their account,
+// otherwise the user it belongs to is signed in.
+//
+// GET /auth/oidc/callback
+func (o *OIDC) Callback(w http.ResponseWriter, r *http.Request) {
+
+	cookie, err := r.Cookie(oidcCookie)
+	if err != nil {
+		o.failed(w, r, err)
+		return
+	}
+
+	// The state and nonce are only good for a single attempt
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookie,
+		Path:     oidcPath,
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+
+	parts := strings.SplitN(cookie.Value, ".", 2)
+	if len(parts) != 2 {
+		o.failed(w, r, nil)
+		return
+	}
+	state, nonce := parts[0], parts[1]
+
+	got := r.URL.Query().Get("state")
+	if subtle.ConstantTimeCompare([]byte(got), []byte(state)) != 1 {
+		o.failed(w, r, nil)
+		return
+	}
+
+	// eg: the user refused to share their account with us
+	if e := r.URL.Query().Get("error"); e != "" {
+		log.Println("oidc:", e, r.URL.Query().Get("error_description"))
+		o.failed(w, r, nil)
+		return
+	}
+
+	claims, err := o.provider.Exchange(r.Context(),
+		r.URL.Query().Get("code"), nonce)
+	if err != nil {
+		o.failed(w, r, err)
+		return
+	}
+
+	ext := models.ExternalIdentity{
+		Issuer:        claims.Issuer,
+		Subject:       claims.Subject,
+		Email:         claims.Email,
+		EmailVerified: claims.EmailVerified,
+		Name:          claims.Name,
+	}
+
+	if user := context.User(r.Context()); user != nil {
+		o.link(w, r, user, ext)
+		return
+	}
+
+	user, err := o.is.SignIn(ext)
+	if err != nil {
+		o.failed(w, r, err)
+		return
+	}
+
+	if err := o.users.signIn(w, user); err != nil {
+		o.failed(w, r, err)
+		return
+	}
+
+	audit(o.users.audit, r, models.AuditEvent{
+		Action:  models.AuditLogin,
+		ActorID: user.ID,
+		Detail:  claims.Issuer,
+	})
+
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Welcome back " + user.Name,
+	}
+	views.RedirectAlert(w, r, "/galleries", http.StatusFound, alert)
+}
+
+func (o *OIDC) link(w http.ResponseWriter, r *http.Request,
+	user *models.User, ext models.ExternalIdentity) {
+
+	// An admin impersonating the user would otherwise be able to
+	// sign in as them with their own account at the provider
+	if context.Impersonator(r.Context()) != nil {
+		views.RedirectAlert(w, r, "/account", http.StatusFound,
+			views.Alert{
+				Level: views.AlertLvlError,
+				Message: "Accounts can't be linked while " +
+					"impersonating a user.",
+			})
+		return
+	}
+
+	alert := views.Alert{
+		Level: views.AlertLvlSuccess,
+		Message: "Your account has been linked, you can now use " +
+			"it to sign in.",
+	}
+
+	if err := o.is.Link(user, ext); err != nil {
+		alert.Level = views.AlertLvlError
+		alert.Message = oidcFailedMsg
+		if pErr, ok := err.(views.PublicError); ok {
+			alert.Message = pErr.Public()
+		} else {
+			log.Println(err)
+		}
+	} else {
+		audit(o.users.audit, r, models.AuditEvent{
+			Action: models.AuditIdentityLinked,
+			Detail: ext.Issuer,
+		})
+	}
+
+	views.RedirectAlert(w, r, "/account", http.StatusFound, alert)
+}
+
+// failed sends the user back to the login page. Only errors meant for
+// the public are shown to them, the rest are logged.
+func (o *OIDC) failed(w http.ResponseWriter, r *http.Request, err error) {
+
+	alert := views.Alert{
+		Level:   views.AlertLvlError,
+		Message: oidcFailedMsg,
+	}
+
+	if pErr, ok := err.(views.PublicError); ok {
+		alert.Message = pErr.Public()
+	} else if err != nil {
+		log.Println(err)
+	}
+
+	views.RedirectAlert(w, r, "/login", http.StatusFound, alert)
+}
@@ -0,0 +1,207 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"lenslockedbr.com/context"
+	"lenslockedbr.com/models"
+	"lenslockedbr.com/views"
+)
+
+// Profiles shows the public profiles of the users, where anyone can
+// browse the galleries they chose to make public, and signed in users
+// can follow them.
+type Profiles struct {
+	ShowView *views.View
+	us       models.UserService
+	gs       models.GalleryService
+	is       models.ImageService
+	fs       models.FollowService
+}
+
+// profile is what the profile view is rendered with. CanFollow is
+// false for visitors who aren't signed in and for the user themselves,
+// and Following is whether the visitor follows the user.
+type profile struct {
+	User      *models.User
+	Galleries []portfolioGallery
+	Followers int
+	CanFollow bool
+	Following bool
+}
+
+// portfolioGallery is a public gallery along with the image shown as
+// its cover, which is nil when it has no images yet.
+type portfolioGallery struct {
+	models.Gallery
+	Cover *models.Image
+}
+
+func NewProfiles(us models.UserService, gs models.GalleryService,
+	is models.ImageService, fs models.FollowService) *Profiles {
+	return &Profiles{
+		ShowView: views.NewView("bootstrap", false,
+			"profiles/show"),
+		us: us,
+		gs: gs,
+		is: is,
+		fs: fs,
+	}
+}
+
+// Show renders the profile of the user with the username in the URL.
+//
+// GET /u/:username
+func (p *Profiles) Show(w http.ResponseWriter, r *http.Request) {
+
+	user, err := p.userByUsername(w, r)
+	if err != nil {
+		return
+	}
+
+	galleries, err := p.gs.PublicByUserID(user.ID)
+	if err != nil {
+		log.Println(err)
+	}
+
+	data := profile{
+		User:      user,
+		Galleries: make([]portfolioGallery, 0, len(galleries)),
+	}
+
+	for _, gallery := range galleries {
+		pg := portfolioGallery{Gallery: gallery}
+
+		// The first image is the cover
+		images, err := p.is.ByGalleryID(gallery.ID)
+		if err != nil {
+			log.Println(err)
+		} else if len(images) > 0 {
+			pg.Cover = &images[0]
+		}
+
+		data.Galleries = append(data.Galleries, pg)
+	}
+
+	data.Followers, err = p.fs.CountFollowers(user.ID)
+	if err != nil {
+		log.Println(err)
+	}
+
+	if visitor := context.User(r.Context()); visitor != nil &&
+		visitor.ID != user.ID {
+		data.CanFollow = true
+		data.Following, err = p.fs.Exists(visitor.ID, user.ID)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+
+	var vd views.Data
+	vd.Yield = data
+	p.ShowView.Render(w, r, vd)
+}
+
+// Follow makes the current user follow the user with the username in
+// the URL, so what they publish shows up on their feed.
+//
+// POST /u/:username/follow
+func (p *Profiles) Follow(w http.ResponseWriter, r *http.Request) {
+
+	user, err := p.userByUsername(w, r)
+	if err != nil {
+		return
+	}
+
+	follower := context.User(r.Context())
+
+	err = p.fs.Create(&models.Follow{
+		FollowerID: follower.ID,
+		FolloweeID: user.ID,
+	})
+	p.redirectToProfile(w, r, user, "You are now following "+
+		displayName(user)+".", err)
+}
+
+// Unfollow stops the current user from following the user with the
+// username in the URL.
+//
+// POST /u/:username/unfollow
+func (p *Profiles) Unfollow(w http.ResponseWriter, r *http.Request) {
+
+	user, err := p.userByUsername(w, r)
+	if err != nil {
+		return
+	}
+
+	follower := context.User(r.Context())
+
+	err = p.fs.Delete(follower.ID, user.ID)
+	p.redirectToProfile(w, r, user, "You are no longer following "+
+		displayName(user)+".", err)
+}
+
+// userByUsername looks up the user from the username in the URL.
+// Disabled users have no profile. If there is an error it is written
+// to the response, so the caller only needs to return.
+func (p *Profiles) userByUsername(w http.ResponseWriter,
+	r *http.Request) (*models.User, error) {
+
+	user, err := p.us.ByUsername(mux.Vars(r)["username"])
+	if err == nil && user.Disabled() {
+		err = models.ErrNotFound
+	}
+
+	switch err {
+	case nil:
+		return user, nil
+	case models.ErrNotFound:
+		http.Error(w, "Profile not found", http.StatusNotFound)
+	default:
+		log.Println(err)
+		http.Error(w, "Whoops! Something went wrong.",
+			http.StatusInternalServerError)
+	}
+
+	return nil, err
+}
+
+// redirectToProfile takes the user back to the profile, telling them
+// whether what they did worked.
+func (p *Profiles) redirectToProfile(w http.ResponseWriter,
+	r *http.Request, user *models.User, message string, err error) {
+
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: message,
+	}
+
+	if pErr, ok := err.(views.PublicError); ok {
+		alert.Level = views.AlertLvlError
+		alert.Message = pErr.Public()
+	} else if err != nil {
+		log.Println(err)
+		alert.Level = views.AlertLvlError
+		alert.Message = views.AlertMsgGeneric
+	}
+
+	views.RedirectAlert(w, r, user.ProfileURL(), http.StatusFound, alert)
+}
+
+// displayName is how a user is named to everyone else, on their
+// profile, their comments and the notifications of others: their name,
+// or their username when they haven't set one. Their email address is
+// never shown, as comments can be read by anyone.
+func displayName(user *models.User) string {
+	switch {
+	case user.Name != "":
+		return user.Name
+	case user.Username != "":
+		return user.Username
+	default:
+		return "Someone"
+	}
+}
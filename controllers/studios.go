@@ -0,0 +1,348 @@
+package controllers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"lenslockedbr.com/context"
+	"lenslockedbr.com/models"
+	"lenslockedbr.com/views"
+)
+
+type StudioForm struct {
+	Name string `schema:"name"`
+}
+
+type MemberForm struct {
+	Email string `schema:"email"`
+	Role  string `schema:"role"`
+}
+
+// studioData is what a studio is rendered with. Membership is the one
+// of the current user.
+type studioData struct {
+	Studio     *models.Studio
+	Membership *models.Membership
+	Members    []studioMember
+	Galleries  []models.Gallery
+	Roles      []string
+}
+
+type studioMember struct {
+	models.Membership
+	Name  string
+	Email string
+}
+
+// Studios lets users create studios and manage who their members are.
+type Studios struct {
+	IndexView     *views.View
+	ShowView      *views.View
+	ss            models.StudioService
+	us            models.UserService
+	gs            models.GalleryService
+	notifications *Notifications
+}
+
+func NewStudios(ss models.StudioService, us models.UserService,
+	gs models.GalleryService, notifications *Notifications) *Studios {
+	return &Studios{
+		IndexView: views.NewView("bootstrap", false,
+			"studios/index"),
+		ShowView: views.NewView("bootstrap", false,
+			"studios/show"),
+		ss:            ss,
+		us:            us,
+		gs:            gs,
+		notifications: notifications,
+	}
+}
+
+// Index lists the studios the user is a member of.
+//
+// GET /studios
+func (s *Studios) Index(w http.ResponseWriter, r *http.Request) {
+	s.renderIndex(w, r, views.Data{})
+}
+
+// Create creates a studio with the current user as its owner.
+//
+// POST /studios
+func (s *Studios) Create(w http.ResponseWriter, r *http.Request) {
+
+	var vd views.Data
+	var form StudioForm
+
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		s.renderIndex(w, r, vd)
+		return
+	}
+
+	user := context.User(r.Context())
+
+	studio := models.Studio{Name: form.Name}
+	if err := s.ss.Create(&studio, user); err != nil {
+		vd.SetAlert(err)
+		s.renderIndex(w, r, vd)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/studios/%d", studio.ID),
+		http.StatusFound)
+}
+
+// Show shows the members and galleries of the studio, to its members.
+//
+// GET /studios/:id
+func (s *Studios) Show(w http.ResponseWriter, r *http.Request) {
+
+	studio, m, err := s.studioByID(w, r)
+	if err != nil {
+		return
+	}
+
+	var vd views.Data
+
+	data := studioData{
+		Studio:     studio,
+		Membership: m,
+		Roles:      models.StudioRoles,
+	}
+
+	members, err := s.ss.Members(studio.ID)
+	if err != nil {
+		vd.SetAlert(err)
+		s.ShowView.Render(w, r, vd)
+		return
+	}
+
+	for _, member := range members {
+		sm := studioMember{Membership: member}
+		if user, err := s.us.ByID(member.UserID); err == nil {
+			sm.Name = user.Name
+			sm.Email = user.Email
+		}
+		data.Members = append(data.Members, sm)
+	}
+
+	data.Galleries, err = s.gs.ByStudioID(studio.ID)
+	if err != nil {
+		vd.SetAlert(err)
+		s.ShowView.Render(w, r, vd)
+		return
+	}
+
+	vd.Yield = data
+	s.ShowView.Render(w, r, vd)
+}
+
+// AddMember adds the user with the email address to the studio. Only
+// owners can add members.
+//
+// POST /studios/:id/members
+func (s *Studios) AddMember(w http.ResponseWriter, r *http.Request) {
+
+	studio, m, err := s.studioByID(w, r)
+	if err != nil {
+		return
+	}
+
+	if !m.CanManage() {
+		s.redirectToStudio(w, r, studio, models.ErrForbidden)
+		return
+	}
+
+	var form MemberForm
+	if err := parseForm(r, &form); err != nil {
+		s.redirectToStudio(w, r, studio, err)
+		return
+	}
+
+	email := strings.ToLower(strings.TrimSpace(form.Email))
+	user, err := s.us.ByEmail(email)
+	if err != nil {
+		s.redirectToStudio(w, r, studio, err)
+		return
+	}
+
+	err = s.ss.AddMember(studio, user, form.Role)
+	if err == nil {
+		s.notifications.Notify(user.ID, models.Notification{
+			Kind:    models.NotifyStudioAdded,
+			Actor:   displayName(context.User(r.Context())),
+			Subject: studio.Name,
+			URL:     fmt.Sprintf("/studios/%d", studio.ID),
+		})
+	}
+	s.redirectToStudio(w, r, studio, err)
+}
+
+// SetRole changes the role of a member. Only owners can change roles.
+//
+// POST /studios/:id/members/:user_id/role
+func (s *Studios) SetRole(w http.ResponseWriter, r *http.Request) {
+
+	studio, m, err := s.studioByID(w, r)
+	if err != nil {
+		return
+	}
+
+	if !m.CanManage() {
+		s.redirectToStudio(w, r, studio, models.ErrForbidden)
+		return
+	}
+
+	member, err := s.memberByUserID(r, studio)
+	if err != nil {
+		s.redirectToStudio(w, r, studio, err)
+		return
+	}
+
+	var form MemberForm
+	if err := parseForm(r, &form); err != nil {
+		s.redirectToStudio(w, r, studio, err)
+		return
+	}
+
+	err = s.ss.SetRole(member, form.Role)
+	s.redirectToStudio(w, r, studio, err)
+}
+
+// RemoveMember removes a member from the studio. Owners can remove
+// anyone and everyone can remove themselves, to leave the studio.
+//
+// POST /studios/:id/members/:user_id/remove
+func (s *Studios) RemoveMember(w http.ResponseWriter, r *http.Request) {
+
+	studio, m, err := s.studioByID(w, r)
+	if err != nil {
+		return
+	}
+
+	member, err := s.memberByUserID(r, studio)
+	if err != nil {
+		s.redirectToStudio(w, r, studio, err)
+		return
+	}
+
+	leaving := member.ID == m.ID
+	if !leaving && !m.CanManage() {
+		s.redirectToStudio(w, r, studio, models.ErrForbidden)
+		return
+	}
+
+	if err := s.ss.RemoveMember(member); err != nil {
+		s.redirectToStudio(w, r, studio, err)
+		return
+	}
+
+	if leaving {
+		alert := views.Alert{
+			Level:   views.AlertLvlSuccess,
+			Message: "You have left " + studio.Name + ".",
+		}
+		views.RedirectAlert(w, r, "/studios", http.StatusFound, alert)
+		return
+	}
+
+	s.redirectToStudio(w, r, studio, nil)
+}
+
+/////////////////////////////////////////////////////////////////////
+//
+// Helper methods
+//
+/////////////////////////////////////////////////////////////////////
+
+func (s *Studios) renderIndex(w http.ResponseWriter, r *http.Request,
+	vd views.Data) {
+
+	user := context.User(r.Context())
+
+	studios, err := s.ss.ByUserID(user.ID)
+	if err != nil {
+		log.Println(err)
+	}
+
+	vd.Yield = studios
+	s.IndexView.Render(w, r, vd)
+}
+
+// studioByID looks up the studio from the id in the URL, along with
+// the membership of the current user. Studios are not found by users
+// who aren't members. If there is an error it is written to the
+// response, so the caller only needs to return.
+func (s *Studios) studioByID(w http.ResponseWriter,
+	r *http.Request) (*models.Studio, *models.Membership, error) {
+
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid studio ID", http.StatusNotFound)
+		return nil, nil, err
+	}
+
+	user := context.User(r.Context())
+
+	m, err := s.ss.Membership(uint(id), user.ID)
+	if err == nil {
+		var studio *models.Studio
+		studio, err = s.ss.ByID(m.StudioID)
+		if err == nil {
+			return studio, m, nil
+		}
+	}
+
+	switch err {
+	case models.ErrNotFound:
+		http.Error(w, "Studio not found", http.StatusNotFound)
+	default:
+		http.Error(w, "Whoops! Something went wrong.",
+			http.StatusInternalServerError)
+	}
+
+	return nil, nil, err
+}
+
+// memberByUserID looks up the membership of the user whose id is in the
+// URL.
+func (s *Studios) memberByUserID(r *http.Request,
+	studio *models.Studio) (*models.Membership, error) {
+
+	vars := mux.Vars(r)
+	userID, err := strconv.Atoi(vars["user_id"])
+	if err != nil {
+		return nil, models.ErrIDInvalid
+	}
+
+	return s.ss.Membership(studio.ID, uint(userID))
+}
+
+// redirectToStudio takes the user back to the studio's page, telling
+// them whether what they did worked.
+func (s *Studios) redirectToStudio(w http.ResponseWriter, r *http.Request,
+	studio *models.Studio, err error) {
+
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Done!",
+	}
+
+	if pErr, ok := err.(views.PublicError); ok {
+		alert.Level = views.AlertLvlError
+		alert.Message = pErr.Public()
+	} else if err != nil {
+		log.Println(err)
+		alert.Level = views.AlertLvlError
+		alert.Message = views.AlertMsgGeneric
+	}
+
+	urlStr := fmt.Sprintf("/studios/%d", studio.ID)
+	views.RedirectAlert(w, r, urlStr, http.StatusFound, alert)
+}
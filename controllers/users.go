@@ -2,16 +2,24 @@ package controllers
 
 import (
 	"fmt"
+	"log"
 	"net/http"
+	"strings"
 	"time"
 
 	"lenslockedbr.com/context"
 	"lenslockedbr.com/email"
 	"lenslockedbr.com/models"
 	"lenslockedbr.com/rand"
+	"lenslockedbr.com/realip"
 	"lenslockedbr.com/views"
 )
 
+// loginFailedMsg is shown for any failed login, regardless of whether
+// the email address exists, so the login form can't be used to find
+// out who has an account with us.
+const loginFailedMsg = "Invalid email address or password."
+
 type SignupForm struct {
 	Name     string `schema:"name"`
 	Age      int    `schema:"age"`
@@ -24,43 +32,122 @@ type LoginForm struct {
 	Password string `schema:"password"`
 }
 
+// loginData is what the login view is rendered with.
+type loginData struct {
+	Provider string
+}
+
+type LoginLinkForm struct {
+	Email string `schema:"email"`
+	Token string `schema:"token"`
+}
+
 type ResetPwForm struct {
 	Email    string `schema:"email"`
 	Token    string `schema:"token"`
 	Password string `schema:"password"`
 }
 
+type AccountNameForm struct {
+	Name string `schema:"name"`
+}
+
+type AccountProfileForm struct {
+	Username string `schema:"username"`
+	Bio      string `schema:"bio"`
+}
+
+type AccountLocaleForm struct {
+	Locale string `schema:"locale"`
+}
+
+type AccountEmailForm struct {
+	Email    string `schema:"email"`
+	Password string `schema:"password"`
+}
+
+type AccountPasswordForm struct {
+	Password    string `schema:"password"`
+	NewPassword string `schema:"new_password"`
+}
+
+type AccountDeleteForm struct {
+	Password string `schema:"password"`
+}
+
+type VerifyEmailForm struct {
+	Token string `schema:"token"`
+}
+
 type Users struct {
-	NewView      *views.View
-	LoginView    *views.View
-	ForgotPwView *views.View
-	ResetPwView  *views.View
+	NewView       *views.View
+	LoginView     *views.View
+	LoginLinkView *views.View
+	ForgotPwView  *views.View
+	ResetPwView   *views.View
+	AccountView   *views.View
+
+	// LoginProvider is the name of the OpenID Connect provider
+	// users can sign in with, eg: Google. Empty when there is none.
+	LoginProvider string
+
 	service      models.UserService
+	avatars      models.AvatarService
+	studios      models.StudioService
+	las          models.LoginAttemptService
+	audit        models.AuditService
+	imps         models.ImpersonationService
+	suppressions models.SuppressionService
 	emailer      *email.Client
 }
 
-func NewUsers(us models.UserService, emailer *email.Client) *Users {
+// accountData is what the account view is rendered with, the user's
+// fields are promoted so the forms can use them directly.
+type accountData struct {
+	*models.User
+	Events  []models.AuditEvent
+	Locales []localeOption
+}
+
+// localeOption is a language the user can choose to be emailed in.
+type localeOption struct {
+	Locale string
+	Name   string
+}
+
+func NewUsers(us models.UserService, avatars models.AvatarService,
+	studios models.StudioService, las models.LoginAttemptService,
+	as models.AuditService, imps models.ImpersonationService,
+	ss models.SuppressionService, emailer *email.Client) *Users {
 	return &Users{
 		NewView: views.NewView("bootstrap", false,
 			"users/new"),
 
 		LoginView: views.NewView("bootstrap", false,
 			"users/login"),
+		LoginLinkView: views.NewView("bootstrap", false,
+			"users/login_link"),
 		ForgotPwView: views.NewView("bootstrap", false,
 			"users/forgot_pw"),
 		ResetPwView: views.NewView("bootstrap", false,
 			"users/reset_pw"),
-		service: us,
-		emailer: emailer,
+		AccountView: views.NewView("bootstrap", false,
+			"users/account"),
+		service:      us,
+		avatars:      avatars,
+		studios:      studios,
+		las:          las,
+		audit:        as,
+		imps:         imps,
+		suppressions: ss,
+		emailer:      emailer,
 	}
 }
 
-//
 // New is used to render the form where a user can create a new
 // user account.
 //
 // GET /signup
-//
 func (u *Users) New(w http.ResponseWriter, r *http.Request) {
 
 	var form SignupForm
@@ -70,12 +157,10 @@ func (u *Users) New(w http.ResponseWriter, r *http.Request) {
 	u.NewView.Render(w, r, form)
 }
 
-//
 // Create is used to process the signup form when a user
 // tries to create a new user account.
 //
 // POST / signup
-//
 func (u *Users) Create(w http.ResponseWriter, r *http.Request) {
 	var vd views.Data
 	var form SignupForm
@@ -93,6 +178,7 @@ func (u *Users) Create(w http.ResponseWriter, r *http.Request) {
 		Age:      form.Age,
 		Email:    form.Email,
 		Password: form.Password,
+		Locale:   email.MatchLocale(r.Header.Get("Accept-Language")),
 	}
 
 	if err := u.service.Create(&user); err != nil {
@@ -119,7 +205,6 @@ func (u *Users) Create(w http.ResponseWriter, r *http.Request) {
 // in as an existing user(via email & pwd).
 //
 // POST /login
-//
 func (u *Users) Login(w http.ResponseWriter, r *http.Request) {
 
 	var vd views.Data
@@ -127,7 +212,14 @@ func (u *Users) Login(w http.ResponseWriter, r *http.Request) {
 	form := LoginForm{}
 	if err := parseForm(r, &form); err != nil {
 		vd.SetAlert(err)
-		u.LoginView.Render(w, r, vd)
+		u.renderLogin(w, r, vd)
+		return
+	}
+
+	ip := realip.FromRequest(r)
+	if err := u.las.Allow(form.Email, ip); err != nil {
+		vd.SetAlert(err)
+		u.renderLogin(w, r, vd)
 		return
 	}
 
@@ -136,23 +228,36 @@ func (u *Users) Login(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 
 		switch err {
-		case models.ErrNotFound:
-			vd.AlertError("No user exists with that " +
-				"email address")
+		case models.ErrNotFound, models.ErrPasswordIncorrect:
+			u.loginFailed(r, form.Email, ip)
+			vd.AlertError(loginFailedMsg)
+		case models.ErrAccountDisabled:
+			u.auditLoginFailed(r, form.Email, "account disabled")
+			vd.SetAlert(err)
 		default:
 			vd.SetAlert(err)
 		}
-		u.LoginView.Render(w, r, vd)
+		u.renderLogin(w, r, vd)
 		return
 	}
 
+	if err := u.las.Succeeded(form.Email); err != nil {
+		log.Println(err)
+	}
+
 	err = u.signIn(w, user)
 	if err != nil {
 		vd.SetAlert(err)
-		u.LoginView.Render(w, r, vd)
+		u.renderLogin(w, r, vd)
 		return
 	}
 
+	audit(u.audit, r, models.AuditEvent{
+		Action:  models.AuditLogin,
+		ActorID: user.ID,
+		Detail:  "password",
+	})
+
 	alert := views.Alert{
 		Level:   views.AlertLvlSuccess,
 		Message: "Welcome back " + user.Name,
@@ -161,12 +266,128 @@ func (u *Users) Login(w http.ResponseWriter, r *http.Request) {
 	views.RedirectAlert(w, r, "/galleries", http.StatusFound, alert)
 }
 
+// LoginPage displays the login form.
+//
+// GET /login
+func (u *Users) LoginPage(w http.ResponseWriter, r *http.Request) {
+	u.renderLogin(w, r, views.Data{})
+}
+
+func (u *Users) renderLogin(w http.ResponseWriter, r *http.Request,
+	vd views.Data) {
+
+	vd.Yield = loginData{
+		Provider: u.LoginProvider,
+	}
+
+	u.LoginView.Render(w, r, vd)
+}
+
+// RequestLoginLink emails the user a link that signs them in without
+// their password. Like InitiateReset it responds the same way whether
+// or not an account exists for the email address.
+//
+// POST /login/link
+func (u *Users) RequestLoginLink(w http.ResponseWriter, r *http.Request) {
+
+	var vd views.Data
+	var form LoginLinkForm
+
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.renderLogin(w, r, vd)
+		return
+	}
+
+	err := u.service.InitiateLoginLink(form.Email, func(token string,
+		sender email.Sender) error {
+		return u.emailer.Via(sender).LoginLink(form.Email, token,
+			models.LoginLinkTTL)
+	})
+	switch err {
+	case nil, models.ErrNotFound:
+	default:
+		vd.SetAlert(err)
+		u.renderLogin(w, r, vd)
+		return
+	}
+
+	alert := views.Alert{
+		Level: views.AlertLvlSuccess,
+		Message: "If an account exists for that email address, " +
+			"a sign in link has been emailed to it.",
+	}
+	views.RedirectAlert(w, r, "/login", http.StatusFound, alert)
+}
+
+// LoginLink displays a button that signs the user in with the token
+// from the link they were emailed. The token is only used once the
+// button is pressed, so email scanners that open links don't use it
+// up before the user does.
+//
+// GET /login/link/verify
+func (u *Users) LoginLink(w http.ResponseWriter, r *http.Request) {
+
+	var vd views.Data
+	var form LoginLinkForm
+
+	vd.Yield = &form
+	if err := parseURLParams(r, &form); err != nil {
+		vd.SetAlert(err)
+	}
+
+	u.LoginLinkView.Render(w, r, vd)
+}
+
+// CompleteLoginLink signs in the user that the token belongs to.
+//
+// POST /login/link/verify
+func (u *Users) CompleteLoginLink(w http.ResponseWriter, r *http.Request) {
+
+	var vd views.Data
+	var form LoginLinkForm
+
+	vd.Yield = &form
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.LoginLinkView.Render(w, r, vd)
+		return
+	}
+
+	user, err := u.service.CompleteLoginLink(form.Token)
+	if err != nil {
+		vd.SetAlert(err)
+		u.LoginLinkView.Render(w, r, vd)
+		return
+	}
+
+	if err := u.signIn(w, user); err != nil {
+		vd.SetAlert(err)
+		u.LoginLinkView.Render(w, r, vd)
+		return
+	}
+
+	audit(u.audit, r, models.AuditEvent{
+		Action:  models.AuditLogin,
+		ActorID: user.ID,
+		Detail:  "email link",
+	})
+
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Welcome back " + user.Name,
+	}
+	views.RedirectAlert(w, r, "/galleries", http.StatusFound, alert)
+}
+
 // Logout is used to delete a user's session cookie and invalidate
 // theis current remember token, which will sign the current user out.
+// An admin impersonating a user ends the impersonation and signs
+// themselves out, the user's own sessions are left alone.
 func (u *Users) Logout(w http.ResponseWriter, r *http.Request) {
 	// First expire the user's cookie
 	cookie := http.Cookie{
-		Name:     "remember_token",
+		Name:     "remember_cookie",
 		Value:    "",
 		Expires:  time.Now(),
 		HttpOnly: true,
@@ -174,14 +395,26 @@ func (u *Users) Logout(w http.ResponseWriter, r *http.Request) {
 
 	http.SetCookie(w, &cookie)
 
-	// Then we update the user with a new remember token
 	user := context.User(r.Context())
+	event := models.AuditEvent{
+		Action: models.AuditLogout,
+	}
+
+	if admin := context.Impersonator(r.Context()); admin != nil {
+		stopImpersonation(u.imps, u.audit, w, r)
+		user = admin
+		event.ActorID = admin.ID
+	}
+
+	// Then we update the user with a new remember token
 	// We are ignoring errors for now because they are unlikely,
 	// and even if they do occur we can't recover now that the
 	// user doesn't have a valid cookie
 	token, _ := rand.RememberToken()
 	user.Remember = token
 	u.service.Update(user)
+
+	audit(u.audit, r, event)
 	// Finally send the user to the home page
 	alert := views.Alert{
 		Level:   views.AlertLvlSuccess,
@@ -204,15 +437,22 @@ func (u *Users) InitiateReset(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	token, err := u.service.InitiateReset(form.Email)
-	if err != nil {
-		vd.SetAlert(err)
-		u.ForgotPwView.Render(w, r, vd)
-		return
-	}
-
-	err = u.emailer.ResetPw(form.Email, token)
-	if err != nil {
+	// Unknown email addresses get the same response as known ones,
+	// otherwise this form tells anyone who has an account with us.
+	err := u.service.InitiateReset(form.Email, func(token string,
+		sender email.Sender) error {
+		return u.emailer.Via(sender).ResetPw(form.Email, token)
+	})
+	switch err {
+	case nil:
+		if user, err := u.service.ByEmail(form.Email); err == nil {
+			audit(u.audit, r, models.AuditEvent{
+				Action: models.AuditResetRequested,
+				UserID: user.ID,
+			})
+		}
+	case models.ErrNotFound:
+	default:
 		vd.SetAlert(err)
 		u.ForgotPwView.Render(w, r, vd)
 		return
@@ -220,8 +460,9 @@ func (u *Users) InitiateReset(w http.ResponseWriter, r *http.Request) {
 
 	v := views.Alert{
 		Level: views.AlertLvlSuccess,
-		Message: "Instructions for reseting your password have " +
-			"been emailed to you.",
+		Message: "If an account exists for that email address, " +
+			"instructions for reseting your password have " +
+			"been emailed to it.",
 	}
 	views.RedirectAlert(w, r, "/reset", http.StatusFound, v)
 }
@@ -264,16 +505,468 @@ func (u *Users) CompleteReset(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	u.signIn(w, user)
+	audit(u.audit, r, models.AuditEvent{
+		Action: models.AuditPasswordReset,
+		UserID: user.ID,
+	})
+
+	if err := u.emailer.PasswordChanged(user.Email); err != nil {
+		log.Println(err)
+	}
+
+	// The password was reset either way, so they only have to log
+	// in with the new one
+	if err := u.signIn(w, user); err != nil {
+		log.Println(err)
+		vd.Alert = &views.Alert{
+			Level: views.AlertLvlWarning,
+			Message: "Your password has been reset and all your " +
+				"sessions have been signed out, but we couldn't " +
+				"log you in. Please log in with your new password.",
+		}
+		u.renderLogin(w, r, vd)
+		return
+	}
 
 	v := views.Alert{
 		Level: views.AlertLvlSuccess,
-		Message: "Your password has been reset and you have " +
-			"been logged in!",
+		Message: "Your password has been reset, all your other " +
+			"sessions have been signed out and you have been " +
+			"logged in!",
 	}
 	views.RedirectAlert(w, r, "/galleries", http.StatusFound, v)
 }
 
+// Account displays the account settings of the current user.
+//
+// GET /account
+func (u *Users) Account(w http.ResponseWriter, r *http.Request) {
+
+	u.renderAccount(w, r, views.Data{})
+}
+
+// UpdateName is used to change the name of the current user.
+//
+// POST /account/name
+func (u *Users) UpdateName(w http.ResponseWriter, r *http.Request) {
+
+	var vd views.Data
+	var form AccountNameForm
+
+	user := context.User(r.Context())
+
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.renderAccount(w, r, vd)
+		return
+	}
+
+	user.Name = strings.TrimSpace(form.Name)
+	if err := u.service.Update(user); err != nil {
+		vd.SetAlert(err)
+		u.renderAccount(w, r, vd)
+		return
+	}
+
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Your name has been updated.",
+	}
+	views.RedirectAlert(w, r, "/account", http.StatusFound, alert)
+}
+
+// UpdateProfile changes the username and bio shown on the public
+// profile of the current user.
+//
+// POST /account/profile
+func (u *Users) UpdateProfile(w http.ResponseWriter, r *http.Request) {
+
+	var vd views.Data
+	var form AccountProfileForm
+
+	user := context.User(r.Context())
+
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.renderAccount(w, r, vd)
+		return
+	}
+
+	user.Username = form.Username
+	user.Bio = form.Bio
+	if err := u.service.Update(user); err != nil {
+		vd.SetAlert(err)
+		u.renderAccount(w, r, vd)
+		return
+	}
+
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Your profile has been updated.",
+	}
+	views.RedirectAlert(w, r, "/account", http.StatusFound, alert)
+}
+
+// UploadAvatar replaces the avatar of the current user with the image
+// uploaded, cropped and resized to every one of models.AvatarSizes.
+//
+// POST /account/avatar
+func (u *Users) UploadAvatar(w http.ResponseWriter, r *http.Request) {
+
+	var vd views.Data
+
+	user := context.User(r.Context())
+
+	err := r.ParseMultipartForm(maxMultipartMem)
+	if err != nil {
+		vd.SetAlert(err)
+		u.renderAccount(w, r, vd)
+		return
+	}
+
+	file, header, err := r.FormFile("avatar")
+	if err != nil {
+		vd.SetAlert(models.ErrAvatarInvalid)
+		u.renderAccount(w, r, vd)
+		return
+	}
+	defer file.Close()
+
+	if header.Size > models.MaxAvatarBytes {
+		vd.SetAlert(models.ErrAvatarTooLarge)
+		u.renderAccount(w, r, vd)
+		return
+	}
+
+	if err := u.avatars.Create(user.ID, file); err != nil {
+		vd.SetAlert(err)
+		u.renderAccount(w, r, vd)
+		return
+	}
+
+	user.AvatarVersion = time.Now().Unix()
+	if err := u.service.Update(user); err != nil {
+		vd.SetAlert(err)
+		u.renderAccount(w, r, vd)
+		return
+	}
+
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Your avatar has been updated.",
+	}
+	views.RedirectAlert(w, r, "/account", http.StatusFound, alert)
+}
+
+// DeleteAvatar removes the avatar of the current user.
+//
+// POST /account/avatar/delete
+func (u *Users) DeleteAvatar(w http.ResponseWriter, r *http.Request) {
+
+	var vd views.Data
+
+	user := context.User(r.Context())
+
+	user.AvatarVersion = 0
+	if err := u.service.Update(user); err != nil {
+		vd.SetAlert(err)
+		u.renderAccount(w, r, vd)
+		return
+	}
+
+	// The user no longer points at the files, so they are only
+	// taking up space if this fails
+	if err := u.avatars.Delete(user.ID); err != nil {
+		log.Println(err)
+	}
+
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Your avatar has been removed.",
+	}
+	views.RedirectAlert(w, r, "/account", http.StatusFound, alert)
+}
+
+// UpdateLocale changes the language the current user is emailed in.
+//
+// POST /account/locale
+func (u *Users) UpdateLocale(w http.ResponseWriter, r *http.Request) {
+
+	var vd views.Data
+	var form AccountLocaleForm
+
+	user := context.User(r.Context())
+
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.renderAccount(w, r, vd)
+		return
+	}
+
+	user.Locale = email.MatchLocale(form.Locale)
+	if err := u.service.Update(user); err != nil {
+		vd.SetAlert(err)
+		u.renderAccount(w, r, vd)
+		return
+	}
+
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Your language has been updated.",
+	}
+	views.RedirectAlert(w, r, "/account", http.StatusFound, alert)
+}
+
+// ChangeEmail starts the process of changing the email address of the
+// current user. The change is only applied once the link emailed to
+// the new address is followed, and the current address is notified.
+//
+// POST /account/email
+func (u *Users) ChangeEmail(w http.ResponseWriter, r *http.Request) {
+
+	var vd views.Data
+	var form AccountEmailForm
+
+	user := context.User(r.Context())
+
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.renderAccount(w, r, vd)
+		return
+	}
+
+	newEmail := strings.TrimSpace(form.Email)
+
+	err := u.service.InitiateEmailChange(user, form.Password, newEmail,
+		func(token string, sender email.Sender) error {
+			emailer := u.emailer.Via(sender)
+			if err := emailer.VerifyEmail(newEmail, token); err != nil {
+				return err
+			}
+			return emailer.EmailChangeNotice(user.Email, newEmail)
+		})
+	if err != nil {
+		vd.SetAlert(err)
+		u.renderAccount(w, r, vd)
+		return
+	}
+
+	audit(u.audit, r, models.AuditEvent{
+		Action: models.AuditEmailChangeStarted,
+		Detail: newEmail,
+	})
+
+	alert := views.Alert{
+		Level: views.AlertLvlInfo,
+		Message: "We have sent a confirmation link to " + newEmail +
+			". Your email address will change once you follow it.",
+	}
+	views.RedirectAlert(w, r, "/account", http.StatusFound, alert)
+}
+
+// VerifyEmail completes an email address change using the token that
+// was emailed to the new address.
+//
+// GET /account/email/verify
+func (u *Users) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+
+	var vd views.Data
+	var form VerifyEmailForm
+
+	if err := parseURLParams(r, &form); err != nil {
+		vd.SetAlert(err)
+		views.RedirectAlert(w, r, "/account", http.StatusFound,
+			*vd.Alert)
+		return
+	}
+
+	user, err := u.service.CompleteEmailChange(form.Token)
+	if err != nil {
+		vd.SetAlert(err)
+		views.RedirectAlert(w, r, "/account", http.StatusFound,
+			*vd.Alert)
+		return
+	}
+
+	// The address has just been shown to receive our emails
+	if err := u.suppressions.DeleteByEmail(user.Email); err != nil {
+		log.Println(err)
+	}
+
+	audit(u.audit, r, models.AuditEvent{
+		Action: models.AuditEmailChanged,
+		UserID: user.ID,
+		Detail: user.Email,
+	})
+
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Your email address has been updated.",
+	}
+	views.RedirectAlert(w, r, "/account", http.StatusFound, alert)
+}
+
+// ReverifyEmail sends a link to the current email address of the user,
+// which confirms they still receive our emails at it after they
+// bounced or were reported as spam.
+//
+// POST /account/email/reverify
+func (u *Users) ReverifyEmail(w http.ResponseWriter, r *http.Request) {
+
+	var vd views.Data
+
+	user := context.User(r.Context())
+
+	err := u.service.InitiateEmailReverify(user, func(token string,
+		sender email.Sender) error {
+		return u.emailer.Via(sender).VerifyEmail(user.Email, token)
+	})
+	if err != nil {
+		vd.SetAlert(err)
+		u.renderAccount(w, r, vd)
+		return
+	}
+
+	alert := views.Alert{
+		Level: views.AlertLvlInfo,
+		Message: "We have sent a confirmation link to " + user.Email +
+			". Follow it to confirm you receive our emails.",
+	}
+	views.RedirectAlert(w, r, "/account", http.StatusFound, alert)
+}
+
+// ChangePassword updates the password of the current user after
+// checking the current one. Every other session is signed out.
+//
+// POST /account/password
+func (u *Users) ChangePassword(w http.ResponseWriter, r *http.Request) {
+
+	var vd views.Data
+	var form AccountPasswordForm
+
+	user := context.User(r.Context())
+
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.renderAccount(w, r, vd)
+		return
+	}
+
+	err := u.service.ChangePassword(user, form.Password,
+		form.NewPassword)
+	if err != nil {
+		vd.SetAlert(err)
+		u.renderAccount(w, r, vd)
+		return
+	}
+
+	audit(u.audit, r, models.AuditEvent{
+		Action: models.AuditPasswordChanged,
+	})
+
+	if err := u.emailer.PasswordChanged(user.Email); err != nil {
+		log.Println(err)
+	}
+
+	// The remember token was rotated, so we need a new cookie
+	if err := u.signIn(w, user); err != nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	alert := views.Alert{
+		Level: views.AlertLvlSuccess,
+		Message: "Your password has been changed and all your " +
+			"other sessions have been signed out.",
+	}
+	views.RedirectAlert(w, r, "/account", http.StatusFound, alert)
+}
+
+// DeleteAccount schedules the current user's account for deletion
+// after checking their password. Every other session is signed out,
+// and the deletion can be cancelled until the grace period is over.
+//
+// POST /account/delete
+func (u *Users) DeleteAccount(w http.ResponseWriter, r *http.Request) {
+
+	var vd views.Data
+	var form AccountDeleteForm
+
+	user := context.User(r.Context())
+
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.renderAccount(w, r, vd)
+		return
+	}
+
+	// The studios would be left with nobody to manage them
+	sole, err := u.studios.SoleOwned(user.ID)
+	if err == nil && len(sole) > 0 {
+		err = models.ErrSoleOwnerDeletion
+	}
+	if err != nil {
+		vd.SetAlert(err)
+		u.renderAccount(w, r, vd)
+		return
+	}
+
+	err = u.service.ScheduleDeletion(user, form.Password,
+		func(_ string, sender email.Sender) error {
+			return u.emailer.Via(sender).AccountDeletion(user.Email,
+				*user.PurgeAt)
+		})
+	if err != nil {
+		vd.SetAlert(err)
+		u.renderAccount(w, r, vd)
+		return
+	}
+
+	audit(u.audit, r, models.AuditEvent{
+		Action: models.AuditDeletionScheduled,
+	})
+
+	if err := u.signIn(w, user); err != nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	alert := views.Alert{
+		Level: views.AlertLvlWarning,
+		Message: "Your account will be deleted on " +
+			user.PurgeAt.Format("Jan 2, 2006") + ". You can " +
+			"cancel it until then.",
+	}
+	views.RedirectAlert(w, r, "/account", http.StatusFound, alert)
+}
+
+// CancelDeletion cancels a pending deletion of the current user's
+// account.
+//
+// POST /account/delete/cancel
+func (u *Users) CancelDeletion(w http.ResponseWriter, r *http.Request) {
+
+	var vd views.Data
+
+	user := context.User(r.Context())
+
+	if err := u.service.CancelDeletion(user); err != nil {
+		vd.SetAlert(err)
+		u.renderAccount(w, r, vd)
+		return
+	}
+
+	audit(u.audit, r, models.AuditEvent{
+		Action: models.AuditDeletionCancelled,
+	})
+
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Your account will no longer be deleted.",
+	}
+	views.RedirectAlert(w, r, "/account", http.StatusFound, alert)
+}
+
 // CookieTest is used to display cookies set on the current user
 func (u *Users) CookieTest(w http.ResponseWriter, r *http.Request) {
 	cookie, err := r.Cookie("remember_cookie")
@@ -297,9 +990,89 @@ func (u *Users) CookieTest(w http.ResponseWriter, r *http.Request) {
 //
 /////////////////////////////////////////////////////////////////////
 
+// loginFailed records a failed login attempt and, if it caused the
+// account to be locked, lets the account owner know by email.
+func (u *Users) loginFailed(r *http.Request, email, ip string) {
+
+	u.auditLoginFailed(r, email, "wrong email address or password")
+
+	locked, err := u.las.Failed(email, ip)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	if !locked {
+		return
+	}
+
+	user, err := u.service.ByEmail(email)
+	if err != nil {
+		// Nobody to notify if the account doesn't exist
+		return
+	}
+
+	until := time.Now().Add(models.LoginLockoutDuration)
+	if err := u.emailer.AccountLocked(user.Email, until); err != nil {
+		log.Println(err)
+	}
+}
+
+// auditLoginFailed records a failed login in the audit log of the
+// account, or with the email address that was tried if there is no
+// account for it.
+func (u *Users) auditLoginFailed(r *http.Request, email, detail string) {
+
+	event := models.AuditEvent{
+		Action: models.AuditLoginFailed,
+		Detail: detail,
+	}
+
+	if user, err := u.service.ByEmail(email); err == nil {
+		event.UserID = user.ID
+	} else {
+		event.Detail += ": " + email
+	}
+
+	audit(u.audit, r, event)
+}
+
+// renderAccount renders the account view for the current user, along
+// with their recent security events.
+func (u *Users) renderAccount(w http.ResponseWriter, r *http.Request,
+	vd views.Data) {
+
+	user := context.User(r.Context())
+
+	events, err := u.audit.ByUserID(user.ID, models.SecurityActions...)
+	if err != nil {
+		log.Println(err)
+	}
+
+	locales := make([]localeOption, 0, len(email.Locales))
+	for _, locale := range email.Locales {
+		locales = append(locales, localeOption{
+			Locale: locale,
+			Name:   email.LocaleNames[locale],
+		})
+	}
+
+	vd.Yield = accountData{
+		User:    user,
+		Events:  events,
+		Locales: locales,
+	}
+
+	u.AccountView.Render(w, r, vd)
+}
+
 // signIn is used to sign the given user in via cookies
 func (u *Users) signIn(w http.ResponseWriter, user *models.User) error {
 
+	if user.Disabled() {
+		return models.ErrAccountDisabled
+	}
+
 	// Set a remember token if none is found
 	if user.Remember == "" {
 
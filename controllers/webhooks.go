@@ -0,0 +1,137 @@
+package controllers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"lenslockedbr.com/email"
+	"lenslockedbr.com/models"
+)
+
+// maxWebhookBody is the largest webhook body we read, Mailgun events
+// are a few kilobytes.
+const maxWebhookBody = 1 << 20
+
+// mailgunEvent is the part of a Mailgun webhook we use.
+type mailgunEvent struct {
+	Signature struct {
+		Timestamp string `json:"timestamp"`
+		Token     string `json:"token"`
+		Signature string `json:"signature"`
+	} `json:"signature"`
+	EventData struct {
+		Event          string `json:"event"`
+		Severity       string `json:"severity"`
+		Recipient      string `json:"recipient"`
+		Reason         string `json:"reason"`
+		DeliveryStatus struct {
+			Description string `json:"description"`
+			Message     string `json:"message"`
+		} `json:"delivery-status"`
+	} `json:"event-data"`
+}
+
+// Webhooks receives the events of the email provider about the emails
+// we sent, so we stop emailing the addresses that bounce or complain.
+type Webhooks struct {
+	us                models.UserService
+	ss                models.SuppressionService
+	as                models.AuditService
+	mailgunSigningKey string
+}
+
+func NewWebhooks(us models.UserService, ss models.SuppressionService,
+	as models.AuditService, mailgunSigningKey string) *Webhooks {
+	return &Webhooks{
+		us:                us,
+		ss:                ss,
+		as:                as,
+		mailgunSigningKey: mailgunSigningKey,
+	}
+}
+
+// Mailgun records the permanent failures and spam complaints reported
+// by Mailgun. Other events are acknowledged and ignored.
+//
+// POST /webhooks/mailgun
+func (wh *Webhooks) Mailgun(w http.ResponseWriter, r *http.Request) {
+
+	var event mailgunEvent
+
+	body := http.MaxBytesReader(w, r.Body, maxWebhookBody)
+	if err := json.NewDecoder(body).Decode(&event); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	sig := event.Signature
+	if !email.VerifyMailgunWebhook(wh.mailgunSigningKey, sig.Timestamp,
+		sig.Token, sig.Signature) {
+		// Mailgun doesn't retry a 406, there is no point as the
+		// signature won't get any better.
+		http.Error(w, "Invalid signature", http.StatusNotAcceptable)
+		return
+	}
+
+	data := event.EventData
+
+	var reason, action string
+	switch {
+	case data.Event == "failed" && data.Severity == "permanent":
+		reason = models.SuppressionBounce
+		action = models.AuditEmailBounced
+	case data.Event == "complained":
+		reason = models.SuppressionComplaint
+		action = models.AuditEmailComplained
+	default:
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	detail := data.DeliveryStatus.Description
+	if detail == "" {
+		detail = data.DeliveryStatus.Message
+	}
+	if detail == "" {
+		detail = data.Reason
+	}
+
+	err := wh.ss.Suppress(data.Recipient, reason, detail)
+	if err != nil {
+		log.Println(err)
+		// Mailgun retries anything but a 2xx or a 406
+		http.Error(w, "Whoops! Something went wrong.",
+			http.StatusInternalServerError)
+		return
+	}
+
+	user, err := wh.us.ByEmail(data.Recipient)
+	switch err {
+	case nil:
+	case models.ErrNotFound:
+		// Eg: someone invited to a gallery
+		w.WriteHeader(http.StatusOK)
+		return
+	default:
+		log.Println(err)
+		http.Error(w, "Whoops! Something went wrong.",
+			http.StatusInternalServerError)
+		return
+	}
+
+	if err := wh.us.RequireEmailReverify(user); err != nil {
+		log.Println(err)
+		http.Error(w, "Whoops! Something went wrong.",
+			http.StatusInternalServerError)
+		return
+	}
+
+	audit(wh.as, r, models.AuditEvent{
+		Action: action,
+		UserID: user.ID,
+		Detail: detail,
+	})
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,52 @@
+package email
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// FileSender writes emails to a maildir instead of sending them, so
+// they can be read with any mail client during development. Each one
+// is written to the new/ directory as an .eml file.
+type FileSender struct {
+	dir string
+	n   uint64
+}
+
+// NewFileSender creates the tmp/, new/ and cur/ directories of the
+// maildir in dir if they don't exist yet.
+func NewFileSender(dir string) (*FileSender, error) {
+
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		err := os.MkdirAll(filepath.Join(dir, sub), 0700)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &FileSender{dir: dir}, nil
+}
+
+// Send writes the email to tmp/ first and then moves it to new/, so
+// mail clients never see half written emails.
+func (s *FileSender) Send(m *Message) error {
+
+	msg, err := m.Bytes()
+	if err != nil {
+		return err
+	}
+
+	n := atomic.AddUint64(&s.n, 1)
+	name := fmt.Sprintf("%d.%d_%d.eml", time.Now().UnixNano(),
+		os.Getpid(), n)
+
+	tmpPath := filepath.Join(s.dir, "tmp", name)
+	if err := os.WriteFile(tmpPath, msg, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, filepath.Join(s.dir, "new", name))
+}
@@ -0,0 +1,18 @@
+package email
+
+import (
+	"log"
+)
+
+// LogSender logs emails instead of sending them, along with their
+// plain text body so the links in them can be followed.
+type LogSender struct{}
+
+func NewLogSender() *LogSender {
+	return &LogSender{}
+}
+
+func (s *LogSender) Send(m *Message) error {
+	log.Printf("email: to %s: %s\n%s\n", m.To, m.Subject, m.Text)
+	return nil
+}
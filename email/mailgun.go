@@ -0,0 +1,77 @@
+package email
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"time"
+
+	mailgun "gopkg.in/mailgun/mailgun-go.v1"
+)
+
+// mailgunWebhookMaxAge is how old the timestamp of a webhook can be,
+// so that a captured request can't be replayed later on.
+const mailgunWebhookMaxAge = 15 * time.Minute
+
+// MailgunSender sends emails through the Mailgun API.
+type MailgunSender struct {
+	mg mailgun.Mailgun
+}
+
+func NewMailgunSender(domain, apiKey, publicKey string) *MailgunSender {
+	return &MailgunSender{
+		mg: mailgun.NewMailgun(domain, apiKey, publicKey),
+	}
+}
+
+func (s *MailgunSender) Send(m *Message) error {
+
+	message := mailgun.NewMessage(m.From, m.Subject, m.Text, m.To)
+	if m.HTML != "" {
+		message.SetHtml(m.HTML)
+	}
+	if m.ReplyTo != "" {
+		message.AddHeader("Reply-To", m.ReplyTo)
+	}
+	if m.ListUnsubscribe != "" {
+		message.AddHeader("List-Unsubscribe",
+			"<"+m.ListUnsubscribe+">")
+		message.AddHeader("List-Unsubscribe-Post",
+			listUnsubscribePost)
+	}
+
+	_, _, err := s.mg.Send(message)
+	return err
+}
+
+// VerifyMailgunWebhook returns true if the signature of a webhook was
+// made by Mailgun with the webhook signing key of the account, and is
+// recent.
+func VerifyMailgunWebhook(signingKey, timestamp, token,
+	signature string) bool {
+
+	if signingKey == "" {
+		return false
+	}
+
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+
+	age := time.Since(time.Unix(ts, 0))
+	if age > mailgunWebhookMaxAge || age < -mailgunWebhookMaxAge {
+		return false
+	}
+
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(signingKey))
+	mac.Write([]byte(timestamp + token))
+
+	return hmac.Equal(mac.Sum(nil), expected)
+}
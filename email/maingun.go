@@ -1,131 +1,360 @@
 package email
 
 import (
+	"errors"
 	"fmt"
+	"log"
+	"net/mail"
 	"net/url"
-
-	mailgun "gopkg.in/mailgun/mailgun-go.v1"
+	"strconv"
+	"strings"
+	"time"
 )
 
 const (
-	welcomeSubject = "Welcome to LensLockedBR.com!"
-	resetSubject   = "Instructions for reseting your password."
-	resetBaseURL   = "https://www.leandr0.net/reset"
+	// defaultBaseURL is used to build the links in our emails when
+	// no base URL is provided with WithBaseURL.
+	defaultBaseURL = "https://www.leandr0.net"
+
+	resetPath       = "/reset"
+	forgotPath      = "/forgot"
+	loginLinkPath   = "/login/link/verify"
+	verifyEmailPath = "/account/email/verify"
+	accountPath     = "/account"
+	exportPath      = "/account/export/download"
+	invitePath      = "/invites/accept"
+	unsubscribePath = "/notifications/unsubscribe"
+	prefsPath       = "/account/notifications"
 )
 
+// Notice is a notification, as it is emailed. Kind is one of the kinds
+// of notifications of the models package, and URL the path of what it
+// is about.
+type Notice struct {
+	Kind    string
+	Actor   string
+	Subject string
+	URL     string
+}
+
+// critical are the emails sent even to suppressed addresses, because
+// they are about the security of the account or were asked for.
+var critical = map[string]bool{
+	"reset":               true,
+	"password_changed":    true,
+	"login_link":          true,
+	"account_locked":      true,
+	"verify_email":        true,
+	"email_change_notice": true,
+	"account_deletion":    true,
+	"account_deleted":     true,
+	"export_ready":        true,
+	"export_failed":       true,
+	"contact":             true,
+}
+
+// ErrTemplateNotFound is returned when rendering an email that has no
+// template.
+var ErrTemplateNotFound = errors.New("email: template not found")
+
 //
-// Email Text
+// Structs and Methods
 //
 
-const welcomeText = `Hi there!
-
-Welcome to LensLockedBR.com! We really hope you enjoy using
-our application!
+type Client struct {
+	from        string
+	baseURL     string
+	sender      Sender
+	templateDir string
+	templates   *templates
+	localeFn    func(email string) string
+	suppressFn  func(email string) bool
+}
 
-Best regards,
+func (c *Client) Welcome(toName, toEmail string) error {
+	return c.send("welcome", buildEmail(toName, toEmail), nil)
+}
 
-LH
-`
-const resetTextTmpl = `Hi there! 
+func (c *Client) ResetPw(toEmail, token string) error {
+	return c.send("reset", toEmail, map[string]interface{}{
+		"URL":   c.tokenURL(resetPath, token),
+		"Token": token,
+	})
+}
 
-It appears that you have requested a password reset. If this was you, please follow the link below to update your password: 
+// PasswordChanged lets the account owner know that their password was
+// changed, in case it wasn't them.
+func (c *Client) PasswordChanged(toEmail string) error {
+	return c.send("password_changed", toEmail, map[string]interface{}{
+		"URL": c.url(forgotPath),
+	})
+}
 
-%s 
+// LoginLink sends a link that signs the user in without a password.
+// The link stops working after ttl.
+func (c *Client) LoginLink(toEmail, token string, ttl time.Duration) error {
+	return c.send("login_link", toEmail, map[string]interface{}{
+		"URL":     c.tokenURL(loginLinkPath, token),
+		"Minutes": int(ttl.Minutes()),
+	})
+}
 
-If you are asked for a token, please use the following value: 
+// AccountLocked lets the account owner know that their account was
+// temporarily locked after too many failed login attempts.
+func (c *Client) AccountLocked(toEmail string, until time.Time) error {
+	return c.send("account_locked", toEmail, map[string]interface{}{
+		"Until": until,
+		"URL":   c.url(forgotPath),
+	})
+}
 
-%s 
+// VerifyEmail sends the link used to confirm a new email address.
+func (c *Client) VerifyEmail(toEmail, token string) error {
+	return c.send("verify_email", toEmail, map[string]interface{}{
+		"URL": c.tokenURL(verifyEmailPath, token),
+	})
+}
 
-If you didn't request a password reset you can safely ignore this email and your account will not be changed. 
+// EmailChangeNotice lets the owner of an account know, on their
+// current address, that a change to newEmail was requested.
+func (c *Client) EmailChangeNotice(toEmail, newEmail string) error {
+	return c.send("email_change_notice", toEmail, map[string]interface{}{
+		"NewEmail": newEmail,
+	})
+}
 
-Best, LensLockedBR Support
-`
+// AccountDeletion confirms that the account will be deleted at
+// purgeAt and explains how to cancel it.
+func (c *Client) AccountDeletion(toEmail string, purgeAt time.Time) error {
+	return c.send("account_deletion", toEmail, map[string]interface{}{
+		"PurgeAt": purgeAt,
+		"URL":     c.url(accountPath),
+	})
+}
 
-//
-// Email HTML
-//
+// AccountDeleted confirms that the account was permanently deleted.
+func (c *Client) AccountDeleted(toEmail string) error {
+	return c.send("account_deleted", toEmail, nil)
+}
 
-const welcomeHTML = `Hi there!<br/><br/>
+// ExportReady sends the link used to download a data export.
+func (c *Client) ExportReady(toEmail, token string, expiresAt time.Time) error {
+	return c.send("export_ready", toEmail, map[string]interface{}{
+		"URL":       c.tokenURL(exportPath, token),
+		"ExpiresAt": expiresAt,
+	})
+}
 
-<p>Welcome to LensLockedBR.com! We really hope you enjoy using
-our application!</p>
+// ExportFailed tells the user the data export they asked for couldn't
+// be built, so they can ask for a new one.
+func (c *Client) ExportFailed(toEmail string) error {
+	return c.send("export_failed", toEmail, map[string]interface{}{
+		"URL": c.url(accountPath),
+	})
+}
 
-<p>Best regards,</p>
+// Invite sends the link that accepts an invitation to contribute to a
+// gallery.
+func (c *Client) Invite(toEmail, inviter, galleryTitle, token string,
+	expiresAt time.Time) error {
+	return c.send("invite", toEmail, map[string]interface{}{
+		"Inviter":   inviter,
+		"Gallery":   galleryTitle,
+		"URL":       c.tokenURL(invitePath, token),
+		"ExpiresAt": expiresAt,
+	})
+}
 
-<p>LH</p>
-`
+// Contact forwards a message sent through the contact form to the
+// support address, so it can be answered by replying to the email.
+// It is always written in DefaultLocale.
+func (c *Client) Contact(toEmail, name, fromEmail, text string) error {
+
+	m, err := c.render("contact", DefaultLocale, toEmail,
+		map[string]interface{}{
+			"Name":    name,
+			"Email":   fromEmail,
+			"Message": text,
+		})
+	if err != nil {
+		return err
+	}
 
-const resetHTMLTmpl = `Hi there!<br/> 
-<br/> 
-It appears that you have requested a password reset. If this was you, please follow the link below to update your password:<br/>
-<br/>
-<a href ="%s">%s</a><br/>
-<br/>
-If you are asked for a token, please use the following value:<br/>
-<br/>
-%s<br/>
-<br/>
-If you didn't request a password reset you can safely ignore this email and your account will not be changed.<br/>
-<br/>
-Best,<br/>
-LensLockedBR Support<br/>
-`
+	// The name is whatever was typed in the form, so it is quoted
+	replyTo := mail.Address{Name: name, Address: fromEmail}
+	m.ReplyTo = replyTo.String()
 
-//
-// Structs and Methods
-//
+	return c.sender.Send(m)
+}
 
-type Client struct {
-	from string
-	mg   mailgun.Mailgun
+// Notification emails a single notification to the user. The token is
+// the one of the link that unsubscribes them from its kind.
+func (c *Client) Notification(toEmail string, notice Notice, userID uint,
+	token string) error {
+	unsubscribeURL := c.unsubscribeURL(userID, notice.Kind, token)
+
+	return c.sendList("notification", toEmail, unsubscribeURL,
+		map[string]interface{}{
+			"Notice":         c.absNotice(notice),
+			"UnsubscribeURL": unsubscribeURL,
+			"PrefsURL":       c.url(prefsPath),
+		})
 }
 
-func (c *Client) Welcome(toName, toEmail string) error {
-	message := mailgun.NewMessage(c.from, welcomeSubject,
-		welcomeText,
-		buildEmail(toName, toEmail))
-	message.SetHtml(welcomeHTML)
+// Digest emails the notifications of the user in a single email. The
+// token is the one of the link that unsubscribes them from every kind
+// of notification.
+func (c *Client) Digest(toEmail string, notices []Notice, userID uint,
+	token string) error {
 
-	_, _, err := c.mg.Send(message)
-	return err
-}
+	abs := make([]Notice, 0, len(notices))
+	for _, notice := range notices {
+		abs = append(abs, c.absNotice(notice))
+	}
 
-func (c *Client) ResetPw(toEmail, token string) error {
+	unsubscribeURL := c.unsubscribeURL(userID, "all", token)
 
-	v := url.Values{}
-	v.Set("token", token)
+	return c.sendList("digest", toEmail, unsubscribeURL,
+		map[string]interface{}{
+			"Notices":        abs,
+			"UnsubscribeURL": unsubscribeURL,
+			"PrefsURL":       c.url(prefsPath),
+		})
+}
 
-	resetUrl := resetBaseURL + "?" + v.Encode()
+// Emails returns the names of every email we send, eg: to preview
+// them.
+func (c *Client) Emails() []string {
+	return c.templates.names()
+}
 
-	resetText := fmt.Sprintf(resetTextTmpl, resetUrl, token)
-	message := mailgun.NewMessage(c.from, resetSubject, resetText,
-		toEmail)
+// Preview renders the email in the locale with made up data, so it can
+// be looked at without triggering it.
+func (c *Client) Preview(name, locale string) (*Message, error) {
 
-	resetHTML := fmt.Sprintf(resetHTMLTmpl, resetUrl, resetUrl, token)
-	message.SetHtml(resetHTML)
-	_, _, err := c.mg.Send(message)
+	data, ok := c.previewData()[name]
+	if !ok {
+		return nil, ErrTemplateNotFound
+	}
 
-	return err
+	return c.render(name, locale, "Jane Doe <jane@example.com>", data)
+}
+
+// previewData is the made up data each email is previewed with.
+func (c *Client) previewData() map[string]map[string]interface{} {
+	return map[string]map[string]interface{}{
+		"welcome": nil,
+		"reset": {
+			"URL":   c.tokenURL(resetPath, "preview-token"),
+			"Token": "preview-token",
+		},
+		"password_changed": {
+			"URL": c.url(forgotPath),
+		},
+		"login_link": {
+			"URL":     c.tokenURL(loginLinkPath, "preview-token"),
+			"Minutes": 15,
+		},
+		"account_locked": {
+			"Until": time.Now().Add(15 * time.Minute),
+			"URL":   c.url(forgotPath),
+		},
+		"verify_email": {
+			"URL": c.tokenURL(verifyEmailPath, "preview-token"),
+		},
+		"email_change_notice": {
+			"NewEmail": "jane.doe@example.com",
+		},
+		"account_deletion": {
+			"PurgeAt": time.Now().Add(30 * 24 * time.Hour),
+			"URL":     c.url(accountPath),
+		},
+		"account_deleted": nil,
+		"export_ready": {
+			"URL":       c.tokenURL(exportPath, "preview-token"),
+			"ExpiresAt": time.Now().Add(7 * 24 * time.Hour),
+		},
+		"export_failed": {
+			"URL": c.url(accountPath),
+		},
+		"notification": {
+			"Notice": Notice{
+				Kind:    "invite.accepted",
+				Actor:   "Jane Doe",
+				Subject: "Summer 2026",
+				URL:     c.url("/galleries/1/edit"),
+			},
+			"UnsubscribeURL": c.unsubscribeURL(1, "invite.accepted",
+				"preview-token"),
+			"PrefsURL": c.url(prefsPath),
+		},
+		"digest": {
+			"Notices": []Notice{
+				{"invite.accepted", "Jane Doe", "Summer 2026",
+					c.url("/galleries/1/edit")},
+				{"studio.added", "John <Doe> & Sons", "Weddings",
+					c.url("/studios/1")},
+				{"comment.created", "Jane Doe", "Summer 2026",
+					c.url("/galleries/1")},
+			},
+			"UnsubscribeURL": c.unsubscribeURL(1, "all",
+				"preview-token"),
+			"PrefsURL": c.url(prefsPath),
+		},
+		"contact": {
+			"Name":    "John <Doe> & Sons",
+			"Email":   "john@example.com",
+			"Message": "Hi,\n\nCan I share a gallery with my clients?",
+		},
+		"invite": {
+			"Inviter":   "John <Doe> & Sons",
+			"Gallery":   `"Summer" <b>2026</b>`,
+			"URL":       c.tokenURL(invitePath, "preview-token"),
+			"ExpiresAt": time.Now().Add(7 * 24 * time.Hour),
+		},
+	}
 }
 
 type ClientConfig func(*Client)
 
 func NewClient(opts ...ClientConfig) *Client {
 	client := Client{
-		from: "support@lenslockedbr.com",
+		from:        "support@lenslockedbr.com",
+		baseURL:     defaultBaseURL,
+		sender:      NewLogSender(),
+		templateDir: defaultTemplateDir,
 	}
 
 	for _, opt := range opts {
 		opt(&client)
 	}
 
+	templates, err := parseTemplates(client.templateDir)
+	if err != nil {
+		panic(err)
+	}
+	client.templates = templates
+
 	return &client
 }
 
+// Via returns a copy of the client that sends the emails through
+// sender instead, eg: to queue them as part of a transaction.
+func (c *Client) Via(sender Sender) *Client {
+	via := *c
+	via.sender = sender
+	return &via
+}
+
 func WithMailgun(domain, apiKey, publicKey string) ClientConfig {
+	return WithTransport(NewMailgunSender(domain, apiKey, publicKey))
+}
+
+// WithTransport sets how the emails are sent, eg: with
+// NewSMTPSender. Without one, emails are only logged.
+func WithTransport(sender Sender) ClientConfig {
 	return func(c *Client) {
-		mg := mailgun.NewMailgun(domain, apiKey, publicKey)
-		c.mg = mg
+		c.sender = sender
 	}
 }
 
@@ -135,12 +364,159 @@ func WithSender(name, email string) ClientConfig {
 	}
 }
 
+// WithBaseURL sets the scheme and host used to build the links in our
+// emails, eg: https://www.lenslockedbr.com
+func WithBaseURL(baseURL string) ClientConfig {
+	return func(c *Client) {
+		if baseURL != "" {
+			c.baseURL = strings.TrimSuffix(baseURL, "/")
+		}
+	}
+}
+
+// WithTemplates sets the directory the emails are read from. It must
+// have a layout and a directory of templates for each of the Locales.
+func WithTemplates(dir string) ClientConfig {
+	return func(c *Client) {
+		c.templateDir = dir
+	}
+}
+
+// WithLocale sets how the locale of a recipient is looked up by their
+// email address. Emails are written in DefaultLocale without it, or
+// when the locale it returns isn't one of the Locales.
+func WithLocale(fn func(email string) string) ClientConfig {
+	return func(c *Client) {
+		c.localeFn = fn
+	}
+}
+
+// WithSuppression sets how we find out that an address bounced or
+// complained about our emails. Only critical emails, like password
+// resets, are sent to the addresses it returns true for.
+func WithSuppression(fn func(email string) bool) ClientConfig {
+	return func(c *Client) {
+		c.suppressFn = fn
+	}
+}
+
 /////////////////////////////////////////////////////////////////////
 //
 // Helper Methods
 //
 /////////////////////////////////////////////////////////////////////
 
+// send renders the email in the locale of the recipient and sends it.
+func (c *Client) send(name, to string, data map[string]interface{}) error {
+	return c.sendList(name, to, "", data)
+}
+
+// sendList works like send, for the emails the recipient can
+// unsubscribe from at unsubscribeURL. See Message.ListUnsubscribe.
+func (c *Client) sendList(name, to, unsubscribeURL string,
+	data map[string]interface{}) error {
+
+	if !critical[name] && c.suppressed(to) {
+		log.Printf("email: not sending %s to suppressed %s\n", name, to)
+		return nil
+	}
+
+	message, err := c.render(name, c.locale(to), to, data)
+	if err != nil {
+		return err
+	}
+	message.ListUnsubscribe = unsubscribeURL
+
+	return c.sender.Send(message)
+}
+
+// render renders the email into a message from us to the recipient.
+// The layout of every email also gets the BaseURL.
+func (c *Client) render(name, locale, to string,
+	data map[string]interface{}) (*Message, error) {
+
+	vars := map[string]interface{}{"BaseURL": c.baseURL}
+	for k, v := range data {
+		vars[k] = v
+	}
+
+	subject, text, html, err := c.templates.render(name, locale, vars)
+	if err != nil {
+		return nil, err
+	}
+
+	message := &Message{
+		From:    c.from,
+		To:      to,
+		Subject: subject,
+		Text:    text,
+	}
+	message.SetHTML(html)
+
+	return message, nil
+}
+
+// locale returns the locale of the recipient.
+func (c *Client) locale(to string) string {
+
+	if c.localeFn == nil {
+		return DefaultLocale
+	}
+
+	return c.localeFn(address(to))
+}
+
+// address returns the address of a recipient who may be written as
+// "Name <name@example.com>".
+func address(to string) string {
+
+	if addr, err := mail.ParseAddress(to); err == nil {
+		return addr.Address
+	}
+
+	return to
+}
+
+// suppressed returns true if non-critical emails shouldn't be sent to
+// the recipient.
+func (c *Client) suppressed(to string) bool {
+
+	if c.suppressFn == nil {
+		return false
+	}
+
+	return c.suppressFn(address(to))
+}
+
+// absNotice makes the URL of the notice absolute, so it can be
+// followed from an email.
+func (c *Client) absNotice(notice Notice) Notice {
+	notice.URL = c.url(notice.URL)
+	return notice
+}
+
+func (c *Client) unsubscribeURL(userID uint, kind, token string) string {
+
+	v := url.Values{}
+	v.Set("user", strconv.FormatUint(uint64(userID), 10))
+	v.Set("kind", kind)
+	v.Set("token", token)
+
+	return c.url(unsubscribePath) + "?" + v.Encode()
+}
+
+func (c *Client) tokenURL(path, token string) string {
+
+	v := url.Values{}
+	v.Set("token", token)
+
+	return c.url(path) + "?" + v.Encode()
+}
+
+func (c *Client) url(path string) string {
+	return c.baseURL + path
+}
+
 func buildEmail(name, email string) string {
 	if name == "" {
 		return email
@@ -0,0 +1,143 @@
+package email
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"lenslockedbr.com/rand"
+)
+
+// Sender sends emails, eg: through Mailgun or an SMTP server. In
+// development they can be written to files or logged instead.
+type Sender interface {
+	Send(m *Message) error
+}
+
+// Message is an email with a plain text body and, optionally, an HTML
+// one. From and To are addresses like "Name <name@example.com>" or
+// just "name@example.com". ReplyTo is optional.
+//
+// ListUnsubscribe is the optional URL that unsubscribes the recipient
+// from emails like this one. It is sent in the List-Unsubscribe header
+// along with List-Unsubscribe-Post, so mail clients can unsubscribe
+// with a single POST to it, as RFC 8058 describes.
+type Message struct {
+	From            string
+	To              string
+	ReplyTo         string
+	Subject         string
+	Text            string
+	HTML            string
+	ListUnsubscribe string
+}
+
+// listUnsubscribePost is the List-Unsubscribe-Post header of the
+// messages with a ListUnsubscribe URL.
+const listUnsubscribePost = "List-Unsubscribe=One-Click"
+
+func (m *Message) SetHTML(html string) {
+	m.HTML = html
+}
+
+// Bytes formats the message as it is sent over SMTP and stored in .eml
+// files, with the text and HTML bodies as alternatives.
+func (m *Message) Bytes() ([]byte, error) {
+
+	from, err := mail.ParseAddress(m.From)
+	if err != nil {
+		return nil, err
+	}
+
+	to, err := mail.ParseAddress(m.To)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := rand.String(16)
+	if err != nil {
+		return nil, err
+	}
+
+	domain := from.Address[strings.LastIndex(from.Address, "@")+1:]
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", to)
+	if m.ReplyTo != "" {
+		replyTo, err := mail.ParseAddress(m.ReplyTo)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&buf, "Reply-To: %s\r\n", replyTo)
+	}
+	if m.ListUnsubscribe != "" {
+		fmt.Fprintf(&buf, "List-Unsubscribe: <%s>\r\n",
+			m.ListUnsubscribe)
+		fmt.Fprintf(&buf, "List-Unsubscribe-Post: %s\r\n",
+			listUnsubscribePost)
+	}
+	fmt.Fprintf(&buf, "Subject: %s\r\n",
+		mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: <%s@%s>\r\n",
+		strings.TrimRight(id, "="), domain)
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+
+	if m.HTML == "" {
+		fmt.Fprintf(&buf, "Content-Type: text/plain; charset=utf-8\r\n")
+		fmt.Fprintf(&buf, "Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+		if err := writeQuotedPrintable(&buf, m.Text); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	mw := multipart.NewWriter(&buf)
+	fmt.Fprintf(&buf, "Content-Type: multipart/alternative; "+
+		"boundary=%s\r\n\r\n", mw.Boundary())
+
+	parts := []struct {
+		contentType string
+		body        string
+	}{
+		{"text/plain; charset=utf-8", m.Text},
+		{"text/html; charset=utf-8", m.HTML},
+	}
+	for _, part := range parts {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", part.contentType)
+		header.Set("Content-Transfer-Encoding", "quoted-printable")
+
+		pw, err := mw.CreatePart(header)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeQuotedPrintable(pw, part.body); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func writeQuotedPrintable(w io.Writer, s string) error {
+
+	qw := quotedprintable.NewWriter(w)
+	if _, err := qw.Write([]byte(s)); err != nil {
+		return err
+	}
+
+	return qw.Close()
+}
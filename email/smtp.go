@@ -0,0 +1,93 @@
+package email
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+)
+
+// SMTPSender sends emails through an SMTP server. The connection is
+// upgraded with STARTTLS whenever the server supports it, and it must
+// be when a username is provided, so the password is never sent in
+// the clear.
+type SMTPSender struct {
+	host     string
+	port     int
+	username string
+	password string
+}
+
+func NewSMTPSender(host string, port int, username,
+	password string) *SMTPSender {
+	return &SMTPSender{
+		host:     host,
+		port:     port,
+		username: username,
+		password: password,
+	}
+}
+
+func (s *SMTPSender) Send(m *Message) error {
+
+	from, err := mail.ParseAddress(m.From)
+	if err != nil {
+		return err
+	}
+
+	to, err := mail.ParseAddress(m.To)
+	if err != nil {
+		return err
+	}
+
+	msg, err := m.Bytes()
+	if err != nil {
+		return err
+	}
+
+	addr := net.JoinHostPort(s.host, strconv.Itoa(s.port))
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		err := c.StartTLS(&tls.Config{ServerName: s.host})
+		if err != nil {
+			return err
+		}
+	} else if s.username != "" {
+		return errors.New("email: the SMTP server doesn't " +
+			"support STARTTLS")
+	}
+
+	if s.username != "" {
+		auth := smtp.PlainAuth("", s.username, s.password, s.host)
+		if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Mail(from.Address); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to.Address); err != nil {
+		return err
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
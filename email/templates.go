@@ -0,0 +1,196 @@
+package email
+
+import (
+	"bytes"
+	htmltemplate "html/template"
+	"path/filepath"
+	"sort"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+const (
+	// DefaultLocale is used for recipients whose locale we don't know
+	// or don't have emails written in.
+	DefaultLocale = "en"
+
+	// defaultTemplateDir is where the emails are read from when no
+	// directory is provided with WithTemplates.
+	defaultTemplateDir = "views/email"
+
+	templateExt = ".gohtml"
+)
+
+// Locales lists the languages our emails are written in. Each one is a
+// directory of templates under the template directory.
+var Locales = []string{"en", "pt-BR"}
+
+// LocaleNames are the names of the Locales, in their own language.
+var LocaleNames = map[string]string{
+	"en":    "English",
+	"pt-BR": "Português (Brasil)",
+}
+
+// dateLayouts is how each locale writes the dates in our emails.
+var dateLayouts = map[string]string{
+	"en":    "Jan 2, 2006 at 15:04 MST",
+	"pt-BR": "02/01/2006 às 15:04 MST",
+}
+
+// MatchLocale returns the locale that best matches an Accept-Language
+// header, eg: "pt-BR,pt;q=0.9,en;q=0.8". DefaultLocale is returned if
+// none of the languages match. Preferences are taken in the order they
+// are listed.
+func MatchLocale(acceptLanguage string) string {
+
+	for _, tag := range strings.Split(acceptLanguage, ",") {
+		tag = strings.TrimSpace(strings.SplitN(tag, ";", 2)[0])
+		if tag == "" || tag == "*" {
+			continue
+		}
+
+		for _, locale := range Locales {
+			if strings.EqualFold(tag, locale) {
+				return locale
+			}
+		}
+
+		// "pt" or "pt-PT" are better served by "pt-BR" than by the
+		// default locale
+		lang := strings.SplitN(tag, "-", 2)[0]
+		for _, locale := range Locales {
+			if strings.EqualFold(lang, strings.SplitN(locale, "-", 2)[0]) {
+				return locale
+			}
+		}
+	}
+
+	return DefaultLocale
+}
+
+// templates are the text and HTML versions of every email, in every
+// locale, keyed by locale and then by the name of the email.
+type templates struct {
+	text map[string]map[string]*texttemplate.Template
+	html map[string]map[string]*htmltemplate.Template
+}
+
+// parseTemplates parses every email in every locale. Each email is a
+// file defining its "subject", "text" and "html", which are wrapped by
+// the layout and can use the templates in the common file of its
+// locale.
+func parseTemplates(dir string) (*templates, error) {
+
+	t := templates{
+		text: make(map[string]map[string]*texttemplate.Template),
+		html: make(map[string]map[string]*htmltemplate.Template),
+	}
+
+	layout := filepath.Join(dir, "layout"+templateExt)
+
+	for _, locale := range Locales {
+
+		common := filepath.Join(dir, locale, "common"+templateExt)
+
+		files, err := filepath.Glob(filepath.Join(dir, locale,
+			"*"+templateExt))
+		if err != nil {
+			return nil, err
+		}
+
+		t.text[locale] = make(map[string]*texttemplate.Template)
+		t.html[locale] = make(map[string]*htmltemplate.Template)
+
+		for _, file := range files {
+			if file == common {
+				continue
+			}
+
+			name := strings.TrimSuffix(filepath.Base(file), templateExt)
+			funcs := templateFuncs(locale)
+
+			text, err := texttemplate.New(name).
+				Funcs(texttemplate.FuncMap(funcs)).
+				Option("missingkey=error").
+				ParseFiles(layout, common, file)
+			if err != nil {
+				return nil, err
+			}
+
+			html, err := htmltemplate.New(name).
+				Funcs(htmltemplate.FuncMap(funcs)).
+				Option("missingkey=error").
+				ParseFiles(layout, common, file)
+			if err != nil {
+				return nil, err
+			}
+
+			t.text[locale][name] = text
+			t.html[locale][name] = html
+		}
+	}
+
+	return &t, nil
+}
+
+// names returns the names of the emails, sorted.
+func (t *templates) names() []string {
+
+	names := make([]string, 0, len(t.text[DefaultLocale]))
+	for name := range t.text[DefaultLocale] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// render renders the subject and both bodies of the email in the
+// locale, falling back to DefaultLocale if it wasn't translated.
+func (t *templates) render(name, locale string,
+	data interface{}) (subject, text, html string, err error) {
+
+	textTmpl, ok := t.text[locale][name]
+	if !ok {
+		locale = DefaultLocale
+		textTmpl = t.text[locale][name]
+	}
+	htmlTmpl := t.html[locale][name]
+	if textTmpl == nil || htmlTmpl == nil {
+		return "", "", "", ErrTemplateNotFound
+	}
+
+	var buf bytes.Buffer
+
+	if err := textTmpl.ExecuteTemplate(&buf, "subject", data); err != nil {
+		return "", "", "", err
+	}
+	subject = strings.TrimSpace(buf.String())
+
+	buf.Reset()
+	if err := textTmpl.ExecuteTemplate(&buf, "text_layout", data); err != nil {
+		return "", "", "", err
+	}
+	text = buf.String()
+
+	buf.Reset()
+	if err := htmlTmpl.ExecuteTemplate(&buf, "html_layout", data); err != nil {
+		return "", "", "", err
+	}
+	html = buf.String()
+
+	return subject, text, html, nil
+}
+
+// templateFuncs are the functions the emails of the locale can use.
+func templateFuncs(locale string) map[string]interface{} {
+	return map[string]interface{}{
+		"datetime": func(t time.Time) string {
+			return t.Format(dateLayouts[locale])
+		},
+		"locale": func() string {
+			return locale
+		},
+	}
+}
@@ -4,30 +4,87 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
-	"hash"
+	"strings"
 )
 
+// keySep separates the key ID from the hash. It is not part of the
+// base64 URL alphabet, so it can't show up in a hash generated before
+// keys had IDs.
+const keySep = ":"
+
 // HMAC is a wrapper around the crypto/hmac package making it a little
-// easier to use in our code.
+// easier to use in our code. It supports key rotation: new values are
+// hashed with the current key of its keyring, while values hashed with
+// a previous key can still be looked up through HashAll.
 type HMAC struct {
-	hmac hash.Hash
+	keys Keyring
 }
 
-// NewHMAC creates and returns a new HMAC object
+// NewHMAC creates and returns a new HMAC object using a single key
 func NewHMAC(key string) HMAC {
-	h := hmac.New(sha256.New, []byte(key))
+	return NewHMACKeyring(NewKeyring(Key{Secret: key}))
+}
 
+// NewHMACKeyring creates and returns a new HMAC object using the keys
+// in the provided keyring.
+func NewHMACKeyring(keys Keyring) HMAC {
 	return HMAC{
-		hmac: h,
+		keys: keys,
 	}
 }
 
-// Hash will hash the provided input string using HMAC with the secret
-// key provided when the HMAC object was created
+// Hash will hash the provided input string using HMAC with the current
+// key. Unless the key has no ID, the hash is prefixed with it.
 func (h HMAC) Hash(input string) string {
-	h.hmac.Reset()
-	h.hmac.Write([]byte(input))
-	b := h.hmac.Sum(nil)
+	return hashWithKey(h.keys.Current(), input)
+}
+
+// HashAll will hash the provided input string with every key, starting
+// with the current one. It is used to look up values that may have
+// been hashed before the current key was rotated in.
+func (h HMAC) HashAll(input string) []string {
+	keys := h.keys.All()
+
+	ret := make([]string, len(keys))
+	for i, k := range keys {
+		ret[i] = hashWithKey(k, input)
+	}
+
+	return ret
+}
+
+// IsCurrent returns whether the hashed value was generated with the
+// current key.
+func (h HMAC) IsCurrent(hashed string) bool {
+	return KeyID(hashed) == h.keys.Current().ID
+}
+
+// CurrentKeyID returns the ID of the key used for new hashes.
+func (h HMAC) CurrentKeyID() string {
+	return h.keys.Current().ID
+}
+
+// KeyID returns the ID of the key used to generate a hash, or an empty
+// string if the hash was generated by a key without an ID.
+func KeyID(hashed string) string {
+	i := strings.Index(hashed, keySep)
+	if i < 0 {
+		return ""
+	}
+
+	return hashed[:i]
+}
+
+func hashWithKey(k Key, input string) string {
+	// A new hash.Hash is created on every call, since sharing one
+	// between goroutines isn't safe.
+	mac := hmac.New(sha256.New, []byte(k.Secret))
+	mac.Write([]byte(input))
+	b := base64.URLEncoding.EncodeToString(mac.Sum(nil))
+
+	if k.ID == "" {
+		return b
+	}
 
-	return base64.URLEncoding.EncodeToString(b)
+	return k.ID + keySep + b
 }
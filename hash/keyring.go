@@ -0,0 +1,47 @@
+package hash
+
+// Key is a secret along with the ID used to tell which key was used to
+// generate a value. The ID of a key must never be reused for another
+// secret.
+type Key struct {
+	ID     string `json:"id"`
+	Secret string `json:"secret"`
+}
+
+// Keyring holds the current key, which is used for every new value,
+// and the previous keys, which are only used to verify values that
+// were generated before the current key was rotated in.
+type Keyring struct {
+	current  Key
+	previous []Key
+}
+
+// NewKeyring creates and returns a new Keyring.
+func NewKeyring(current Key, previous ...Key) Keyring {
+	return Keyring{
+		current:  current,
+		previous: previous,
+	}
+}
+
+// Current returns the key that should be used for new values.
+func (kr Keyring) Current() Key {
+	return kr.current
+}
+
+// ByID returns the key with the provided ID, looking at the current
+// key first and then at the previous ones.
+func (kr Keyring) ByID(id string) (Key, bool) {
+	for _, k := range kr.All() {
+		if k.ID == id {
+			return k, true
+		}
+	}
+
+	return Key{}, false
+}
+
+// All returns every key in the keyring, starting with the current one.
+func (kr Keyring) All() []Key {
+	return append([]Key{kr.current}, kr.previous...)
+}
@@ -0,0 +1,177 @@
+package hash
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+
+	"lenslockedbr.com/rand"
+)
+
+var (
+	// ErrPasswordMismatch is returned by Compare when the password
+	// doesn't match the encoded hash.
+	ErrPasswordMismatch = errors.New("hash: password does not match")
+
+	// ErrHashFormat is returned by Compare when the encoded hash
+	// is neither an argon2id nor a bcrypt hash.
+	ErrHashFormat = errors.New("hash: unknown password hash format")
+)
+
+// Argon2Params are the cost parameters used by argon2id. They are
+// encoded in every hash so they can be changed without invalidating
+// the hashes generated with the previous ones.
+type Argon2Params struct {
+	Time    uint32 `json:"time"`
+	Memory  uint32 `json:"memory"` // in KiB
+	Threads uint8  `json:"threads"`
+	KeyLen  uint32 `json:"key_len"`
+	SaltLen int    `json:"salt_len"`
+}
+
+// DefaultArgon2Params follows the recommendations of RFC 9106 for
+// systems with a limited amount of memory.
+func DefaultArgon2Params() Argon2Params {
+	return Argon2Params{
+		Time:    3,
+		Memory:  64 * 1024,
+		Threads: 2,
+		KeyLen:  32,
+		SaltLen: 16,
+	}
+}
+
+// PasswordHasher hashes passwords with argon2id, and is able to
+// verify both argon2id and legacy bcrypt hashes.
+type PasswordHasher struct {
+	params Argon2Params
+}
+
+// NewPasswordHasher creates and returns a new PasswordHasher using the
+// provided params for every new hash.
+func NewPasswordHasher(params Argon2Params) PasswordHasher {
+	return PasswordHasher{
+		params: params,
+	}
+}
+
+// Hash will hash the provided password with argon2id and a random salt,
+// returning it in the PHC string format:
+//
+//	$argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>
+func (ph PasswordHasher) Hash(password string) (string, error) {
+	p := ph.params
+
+	salt, err := rand.Bytes(p.SaltLen)
+	if err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, p.Time, p.Memory,
+		p.Threads, p.KeyLen)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, p.Memory, p.Time, p.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// Compare checks the password against an encoded hash generated either
+// by Hash or by bcrypt. It returns ErrPasswordMismatch if they don't
+// match.
+func (ph PasswordHasher) Compare(encoded, password string) error {
+
+	if isBcrypt(encoded) {
+		err := bcrypt.CompareHashAndPassword([]byte(encoded),
+			[]byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return ErrPasswordMismatch
+		}
+		return err
+	}
+
+	p, salt, key, err := decodeArgon2(encoded)
+	if err != nil {
+		return err
+	}
+
+	other := argon2.IDKey([]byte(password), salt, p.Time, p.Memory,
+		p.Threads, uint32(len(key)))
+	if subtle.ConstantTimeCompare(key, other) != 1 {
+		return ErrPasswordMismatch
+	}
+
+	return nil
+}
+
+// NeedsRehash returns true when the encoded hash was not generated by
+// argon2id with the current params, eg: a legacy bcrypt hash or an
+// argon2id hash with a lower cost.
+func (ph PasswordHasher) NeedsRehash(encoded string) bool {
+
+	p, salt, key, err := decodeArgon2(encoded)
+	if err != nil {
+		return true
+	}
+
+	return p.Time != ph.params.Time ||
+		p.Memory != ph.params.Memory ||
+		p.Threads != ph.params.Threads ||
+		uint32(len(key)) != ph.params.KeyLen ||
+		len(salt) != ph.params.SaltLen
+}
+
+/////////////////////////////////////////////////////////////////////
+//
+// Helper Functions
+//
+/////////////////////////////////////////////////////////////////////
+
+func isBcrypt(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") ||
+		strings.HasPrefix(encoded, "$2b$") ||
+		strings.HasPrefix(encoded, "$2y$")
+}
+
+func decodeArgon2(encoded string) (Argon2Params, []byte, []byte, error) {
+
+	var p Argon2Params
+	var version int
+
+	// "", "argon2id", "v=19", "m=...,t=...,p=...", salt, key
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return p, nil, nil, ErrHashFormat
+	}
+
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return p, nil, nil, ErrHashFormat
+	}
+
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time,
+		&p.Threads)
+	if err != nil {
+		return p, nil, nil, ErrHashFormat
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return p, nil, nil, ErrHashFormat
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return p, nil, nil, ErrHashFormat
+	}
+
+	p.KeyLen = uint32(len(key))
+	p.SaltLen = len(salt)
+
+	return p, salt, key, nil
+}
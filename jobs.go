@@ -0,0 +1,182 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"lenslockedbr.com/email"
+	"lenslockedbr.com/models"
+	"lenslockedbr.com/ratelimit"
+)
+
+// purgeAccounts permanently deletes, every interval, the accounts
+// whose deletion grace period is over. It is meant to be run in its
+// own goroutine and never returns.
+func purgeAccounts(services *models.Services, emailer *email.Client,
+	interval time.Duration) {
+
+	for {
+		users, err := services.User.PurgeDue(time.Now())
+		if err != nil {
+			log.Println("purge accounts:", err)
+		}
+
+		for _, user := range users {
+			user := user
+			err := services.PurgeUser(&user, func(_ string,
+				sender email.Sender) error {
+				return emailer.Via(sender).AccountDeleted(user.Email)
+			})
+			if err != nil {
+				log.Printf("purge account %d: %v\n", user.ID, err)
+			}
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+// buildExports builds, every interval, the data exports users asked
+// for and emails them a download link, or tells them it failed. Each
+// export is claimed first, so when more than one instance is running
+// it is only built and emailed once. Expired exports, ready or failed,
+// are removed along with their files. It is meant to be run in its
+// own goroutine and never returns.
+func buildExports(services *models.Services, emailer *email.Client,
+	interval time.Duration) {
+
+	for {
+		exports, err := services.Export.Claim(time.Now())
+		if err != nil {
+			log.Println("build exports:", err)
+		}
+
+		for _, e := range exports {
+			e := e
+			buildExport(services, emailer, &e)
+		}
+
+		expired, err := services.Export.Expired(time.Now())
+		if err != nil {
+			log.Println("build exports:", err)
+		}
+
+		for _, e := range expired {
+			e := e
+			if err := services.RemoveExport(&e); err != nil {
+				log.Printf("remove export %d: %v\n", e.ID, err)
+			}
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+func buildExport(services *models.Services, emailer *email.Client,
+	e *models.Export) {
+
+	user, err := services.User.ByID(e.UserID)
+	if err != nil {
+		log.Printf("build export %d: %v\n", e.ID, err)
+		return
+	}
+
+	if err := services.BuildExport(e); err != nil {
+		log.Printf("build export %d: %v\n", e.ID, err)
+
+		err := services.Export.Failed(e, func(_ string,
+			sender email.Sender) error {
+			return emailer.Via(sender).ExportFailed(user.Email)
+		})
+		if err != nil {
+			log.Printf("build export %d: %v\n", e.ID, err)
+		}
+		return
+	}
+
+	err = services.Export.Ready(e, func(token string,
+		sender email.Sender) error {
+		return emailer.Via(sender).ExportReady(user.Email, token,
+			*e.ExpiresAt)
+	})
+	if err != nil {
+		log.Printf("build export %d: %v\n", e.ID, err)
+	}
+}
+
+// sendDigests emails, every interval, a digest of their notifications
+// to the users who asked for daily digests and have had one waiting
+// for at least a day. It is meant to be run in its own goroutine and
+// never returns.
+func sendDigests(services *models.Services, emailer *email.Client,
+	interval time.Duration) {
+
+	for {
+		userIDs, err := services.Notification.PendingDigests(
+			time.Now().Add(-24 * time.Hour))
+		if err != nil {
+			log.Println("send digests:", err)
+		}
+
+		for _, userID := range userIDs {
+			sendDigest(services, emailer, userID)
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+func sendDigest(services *models.Services, emailer *email.Client,
+	userID uint) {
+
+	user, err := services.User.ByID(userID)
+	if err != nil {
+		log.Printf("send digest %d: %v\n", userID, err)
+		return
+	}
+
+	err = services.Notification.SendDigest(user.ID,
+		func(notifications []models.Notification, token string,
+			sender email.Sender) error {
+
+			notices := make([]email.Notice, 0, len(notifications))
+			for _, n := range notifications {
+				notices = append(notices, email.Notice{
+					Kind:    n.Kind,
+					Actor:   n.Actor,
+					Subject: n.Subject,
+					URL:     n.URL,
+				})
+			}
+
+			return emailer.Via(sender).Digest(user.Email, notices,
+				user.ID, token)
+		})
+	if err != nil {
+		log.Printf("send digest %d: %v\n", userID, err)
+	}
+}
+
+// deleteIdleRateLimits deletes, every interval, the buckets of the rate
+// limits that have been idle for longer than the slowest of the limits
+// takes to refill, since they are full by then. It is meant to be run
+// in its own goroutine and never returns.
+func deleteIdleRateLimits(services *models.Services,
+	interval time.Duration, limits ...ratelimit.Limit) {
+
+	var idle time.Duration
+	for _, l := range limits {
+		if l.Per > idle {
+			idle = l.Per
+		}
+	}
+
+	for {
+		err := services.RateLimit.DeleteIdle(time.Now().Add(-idle))
+		if err != nil {
+			log.Println("delete idle rate limits:", err)
+		}
+
+		time.Sleep(interval)
+	}
+}
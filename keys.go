@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"lenslockedbr.com/models"
+)
+
+// reportKeyUsage prints how many records still use a previous pepper
+// or HMAC key, which tells us when a previous key can be dropped from
+// the config.
+func reportKeyUsage(services *models.Services) {
+
+	ku, err := services.KeyUsage()
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Printf("Current pepper ID:   %q\n", ku.CurrentPepperID)
+	fmt.Printf("Current HMAC key ID: %q\n\n", ku.CurrentHMACKeyID)
+
+	names := make([]string, 0, len(ku.Stale))
+	for name := range ku.Stale {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "RECORDS\tUSING A PREVIOUS KEY")
+	for _, name := range names {
+		fmt.Fprintf(tw, "%s\t%d\n", name, ku.Stale[name])
+	}
+	tw.Flush()
+
+	if ku.Total() == 0 {
+		fmt.Println("\nNo record uses a previous key anymore, " +
+			"they can be removed from the config.")
+	}
+}
@@ -5,12 +5,16 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"time"
 
 	"lenslockedbr.com/controllers"
 	"lenslockedbr.com/email"
 	"lenslockedbr.com/middleware"
 	"lenslockedbr.com/models"
+	"lenslockedbr.com/oidc"
 	"lenslockedbr.com/rand"
+	"lenslockedbr.com/ratelimit"
+	"lenslockedbr.com/realip"
 
 	"github.com/gorilla/csrf"
 	"github.com/gorilla/mux"
@@ -22,17 +26,41 @@ func main() {
 		"production. This ensures that a "+
 		".config file is provided before the "+
 		"application starts.")
+	keysPtr := flag.Bool("keys", false, "Report how many records "+
+		"still use a previous pepper or HMAC key and exit.")
+	adminPtr := flag.String("admin", "", "Grant the admin role to the "+
+		"user with this email address and exit.")
 	flag.Parse()
 
 	cfg := LoadConfig(*boolPtr)
+	if err := realip.TrustProxies(cfg.Proxies()...); err != nil {
+		panic(err)
+	}
 	dbCfg := cfg.Database
 
 	services, err := models.NewServices(
 		models.WithGorm(dbCfg.Dialect(), dbCfg.ConnectionInfo()),
 		models.WithLogMode(!cfg.IsProd()),
-		models.WithUser(cfg.Pepper, cfg.HMACKey),
+		models.WithKeys(cfg.PepperKeyring(), cfg.HMACKeyring()),
+		models.WithUser(cfg.UserConfig()),
+		models.WithIdentity(),
+		models.WithStudio(),
+		models.WithCollaborator(),
 		models.WithGallery(),
-		models.WithImage())
+		models.WithImage(),
+		models.WithAvatar(),
+		models.WithLoginAttempt(),
+		models.WithRateLimit(),
+		models.WithImpersonation(),
+		models.WithAudit(),
+		models.WithOutbox(),
+		models.WithSuppression(),
+		models.WithNotification(),
+		models.WithContact(),
+		models.WithComment(),
+		models.WithFollow(),
+		models.WithActivity(),
+		models.WithExport())
 	if err != nil {
 		panic(err)
 	}
@@ -40,38 +68,187 @@ func main() {
 	defer services.Close()
 	services.AutoMigrate()
 
-	mgCfg := cfg.Mailgun
-	emailer := email.NewClient(email.WithMailgun(mgCfg.Domain,
-		mgCfg.APIKey,
-		mgCfg.PublicAPIKey),
-		email.WithSender("LensLockedBR Team",
-			"we@"+mgCfg.Domain))
+	if *keysPtr {
+		reportKeyUsage(services)
+		return
+	}
+
+	if *adminPtr != "" {
+		grantAdmin(services, *adminPtr)
+		return
+	}
+
+	sender, err := cfg.EmailSender()
+	if err != nil {
+		panic(err)
+	}
+
+	// Emails are queued in the outbox by the requests and the jobs,
+	// and delivered with the sender in the background
+	go deliverEmails(services, sender, 10*time.Second)
+
+	emailer := email.NewClient(
+		email.WithTransport(services.Outbox.Sender(nil)),
+		email.WithSender("LensLockedBR Team", cfg.EmailFrom()),
+		email.WithBaseURL(cfg.BaseURL),
+		email.WithLocale(func(addr string) string {
+			user, err := services.User.ByEmail(addr)
+			if err != nil {
+				return email.DefaultLocale
+			}
+			return user.Locale
+		}),
+		email.WithSuppression(func(addr string) bool {
+			suppressed, err := services.Suppression.Suppressed(addr)
+			if err != nil {
+				log.Println(err)
+			}
+			return suppressed
+		}))
+
+	go purgeAccounts(services, emailer, time.Hour)
+	go buildExports(services, emailer, time.Minute)
+	go sendDigests(services, emailer, time.Hour)
 
 	r := mux.NewRouter()
 
 	staticC := controllers.NewStatic()
-	usersC := controllers.NewUsers(services.User, emailer)
+	usersC := controllers.NewUsers(services.User, services.Avatar,
+		services.Studio, services.LoginAttempt, services.Audit,
+		services.Impersonation, services.Suppression, emailer)
+	exportsC := controllers.NewExports(services.Export)
+	contactC := controllers.NewContact(services.Contact, emailer,
+		cfg.SupportAddress())
+
+	var oidcC *controllers.OIDC
+	if cfg.OIDC.Enabled() {
+		// The provider only redirects back to the URL registered
+		// with it, which a relative one never is
+		if cfg.BaseURL == "" {
+			panic("base_url must be set to sign in with OpenID Connect")
+		}
+
+		provider := oidc.NewProvider(oidc.Config{
+			Issuer:       cfg.OIDC.Issuer,
+			ClientID:     cfg.OIDC.ClientID,
+			ClientSecret: cfg.OIDC.ClientSecret,
+			RedirectURL:  cfg.BaseURL + "/auth/oidc/callback",
+		}, nil)
+		oidcC = controllers.NewOIDC(provider, services.Identity, usersC)
+
+		usersC.LoginProvider = cfg.OIDC.Name
+		if usersC.LoginProvider == "" {
+			usersC.LoginProvider = "OpenID Connect"
+		}
+	}
 	galleriesC := controllers.NewGalleries(services.Gallery,
-		services.Image, r)
+		services.Image, services.Studio, services.Collaborator,
+		services.Comment, services.User, services.Audit,
+		services.Activity, r)
+	notificationsC := controllers.NewNotifications(services.Notification,
+		services.User, emailer)
+	collaboratorsC := controllers.NewCollaborators(services.Collaborator,
+		galleriesC, notificationsC, emailer)
+	commentsC := controllers.NewComments(services.Comment, galleriesC,
+		notificationsC)
+	studiosC := controllers.NewStudios(services.Studio, services.User,
+		services.Gallery, notificationsC)
+	profilesC := controllers.NewProfiles(services.User, services.Gallery,
+		services.Image, services.Follow)
+	feedC := controllers.NewFeed(services.Activity, services.User,
+		services.Gallery)
+	adminC := controllers.NewAdmin(services.User, services.Gallery,
+		services.Image, services.Impersonation, services.Audit,
+		services.Outbox, emailer)
 
 	//
 	// Middleware setup
 	//
 	userMw := middleware.User{
-		UserService: services.User,
+		UserService:   services.User,
+		Impersonation: services.Impersonation,
+	}
+	notificationsMw := middleware.Notifications{
+		NotificationService: services.Notification,
 	}
 	requireUserMw := middleware.RequireUser{}
+	requireAdminMw := middleware.RequireAdmin{}
+	notImpersonatingMw := middleware.NotImpersonating{}
+
+	var rlStore ratelimit.Store = ratelimit.NewMemoryStore()
+	if cfg.RateLimit.UsePostgres() {
+		rlStore = services.RateLimit
+	}
+
+	// The limits on sending emails to an address are only by IP
+	// address: limiting by the email address too would let anyone
+	// use up the bucket of someone else's address and keep them from
+	// signing in or resetting their password.
+	emailLimitKeys := []middleware.KeyFunc{middleware.ByIP}
+
+	signupLimitMw := middleware.RateLimit{
+		Store: rlStore,
+		Name:  "signup",
+		Limit: ratelimit.Limit{Burst: 5, Per: time.Hour},
+	}
+	loginLimitMw := middleware.RateLimit{
+		Store: rlStore,
+		Name:  "login",
+		Limit: ratelimit.Limit{Burst: 20, Per: time.Minute},
+	}
+	loginLinkLimitMw := middleware.RateLimit{
+		Store: rlStore,
+		Name:  "login_link",
+		Limit: ratelimit.Limit{Burst: 3, Per: time.Hour},
+		Keys:  emailLimitKeys,
+	}
+	exportLimitMw := middleware.RateLimit{
+		Store: rlStore,
+		Name:  "export",
+		Limit: ratelimit.Limit{Burst: 2, Per: 24 * time.Hour},
+		Keys:  []middleware.KeyFunc{middleware.ByUser},
+	}
+	forgotLimitMw := middleware.RateLimit{
+		Store: rlStore,
+		Name:  "forgot",
+		Limit: ratelimit.Limit{Burst: 3, Per: time.Hour},
+		Keys:  emailLimitKeys,
+	}
+	contactLimitMw := middleware.RateLimit{
+		Store: rlStore,
+		Name:  "contact",
+		Limit: ratelimit.Limit{Burst: 5, Per: time.Hour},
+		Keys: []middleware.KeyFunc{
+			middleware.ByIP,
+			middleware.ByFormValue("email"),
+		},
+	}
+
+	if cfg.RateLimit.UsePostgres() {
+		go deleteIdleRateLimits(services, time.Hour,
+			signupLimitMw.Limit, loginLimitMw.Limit,
+			loginLinkLimitMw.Limit, exportLimitMw.Limit,
+			forgotLimitMw.Limit, contactLimitMw.Limit)
+	}
 
 	b, err := rand.Bytes(32)
 	if err != nil {
 		panic(err)
 	}
 	csrfMw := csrf.Protect(b, csrf.Secure(cfg.IsProd()))
+	skipCSRFMw := middleware.SkipCSRF{Prefixes: []string{
+		"/webhooks/",
+		// Mail clients unsubscribe in one click without a token,
+		// the one of the unsubscribe link is checked instead
+		"/notifications/unsubscribe",
+	}}
 
 	r.NotFoundHandler = http.HandlerFunc(staticC.PageNotFound.ServeHTTP)
 
 	r.Handle("/", staticC.Home).Methods("GET")
-	r.Handle("/contact", staticC.Contact).Methods("GET")
+	r.HandleFunc("/contact", contactC.New).Methods("GET")
+	r.HandleFunc("/contact",
+		contactLimitMw.ApplyFn(contactC.Create)).Methods("POST")
 	r.Handle("/faq", staticC.Faq).Methods("GET")
 
 	//
@@ -79,18 +256,128 @@ func main() {
 	//
 
 	r.HandleFunc("/signup", usersC.New).Methods("GET")
-	r.HandleFunc("/signup", usersC.Create).Methods("POST")
-	r.Handle("/login", usersC.LoginView).Methods("GET")
-	r.HandleFunc("/login", usersC.Login).Methods("POST")
+	r.HandleFunc("/signup",
+		signupLimitMw.ApplyFn(usersC.Create)).Methods("POST")
+	r.HandleFunc("/login", usersC.LoginPage).Methods("GET")
+	r.HandleFunc("/login",
+		loginLimitMw.ApplyFn(usersC.Login)).Methods("POST")
+	r.HandleFunc("/login/link",
+		loginLinkLimitMw.ApplyFn(usersC.RequestLoginLink)).Methods("POST")
+	r.HandleFunc("/login/link/verify", usersC.LoginLink).Methods("GET")
+	r.HandleFunc("/login/link/verify",
+		loginLimitMw.ApplyFn(usersC.CompleteLoginLink)).Methods("POST")
 	r.Handle("/logout",
 		requireUserMw.ApplyFn(usersC.Logout)).Methods("POST")
 
+	if oidcC != nil {
+		r.HandleFunc("/auth/oidc",
+			loginLimitMw.ApplyFn(oidcC.Login)).Methods("GET")
+		r.HandleFunc("/auth/oidc/callback",
+			loginLimitMw.ApplyFn(oidcC.Callback)).Methods("GET")
+	}
+
 	r.Handle("/forgot", usersC.ForgotPwView).Methods("GET")
-	r.HandleFunc("/forgot", usersC.InitiateReset).Methods("POST")
+	r.HandleFunc("/forgot",
+		forgotLimitMw.ApplyFn(usersC.InitiateReset)).Methods("POST")
 	r.HandleFunc("/reset", usersC.ResetPw).Methods("GET")
 	r.HandleFunc("/reset", usersC.CompleteReset).Methods("POST")
 
+	r.HandleFunc("/account",
+		requireUserMw.ApplyFn(usersC.Account)).Methods("GET")
+	r.HandleFunc("/account/name",
+		requireUserMw.ApplyFn(usersC.UpdateName)).Methods("POST")
+	r.HandleFunc("/account/profile",
+		requireUserMw.ApplyFn(usersC.UpdateProfile)).Methods("POST")
+	r.HandleFunc("/account/avatar",
+		requireUserMw.ApplyFn(usersC.UploadAvatar)).Methods("POST")
+	r.HandleFunc("/account/avatar/delete",
+		requireUserMw.ApplyFn(usersC.DeleteAvatar)).Methods("POST")
+	r.HandleFunc("/account/locale",
+		requireUserMw.ApplyFn(usersC.UpdateLocale)).Methods("POST")
+	r.HandleFunc("/account/email",
+		requireUserMw.Apply(notImpersonatingMw.ApplyFn(
+			usersC.ChangeEmail))).Methods("POST")
+	r.HandleFunc("/account/email/verify",
+		usersC.VerifyEmail).Methods("GET")
+	r.HandleFunc("/account/email/reverify",
+		requireUserMw.ApplyFn(usersC.ReverifyEmail)).Methods("POST")
+	r.HandleFunc("/account/notifications",
+		requireUserMw.ApplyFn(notificationsC.Prefs)).Methods("GET")
+	r.HandleFunc("/account/notifications",
+		requireUserMw.ApplyFn(notificationsC.UpdatePrefs)).Methods("POST")
+	r.HandleFunc("/account/password",
+		requireUserMw.Apply(notImpersonatingMw.ApplyFn(
+			usersC.ChangePassword))).Methods("POST")
+
+	r.HandleFunc("/account/delete",
+		requireUserMw.Apply(notImpersonatingMw.ApplyFn(
+			usersC.DeleteAccount))).Methods("POST")
+	r.HandleFunc("/account/delete/cancel",
+		requireUserMw.Apply(notImpersonatingMw.ApplyFn(
+			usersC.CancelDeletion))).Methods("POST")
+
+	r.HandleFunc("/account/export",
+		exportLimitMw.Apply(requireUserMw.Apply(
+			notImpersonatingMw.ApplyFn(exportsC.Create)))).
+		Methods("POST")
+	r.HandleFunc("/account/export/download",
+		requireUserMw.Apply(notImpersonatingMw.ApplyFn(
+			exportsC.Download))).Methods("GET")
+
+	//
+	// Admin routes
+	//
+
+	r.Handle("/admin", http.RedirectHandler("/admin/users",
+		http.StatusFound)).Methods("GET")
+	r.HandleFunc("/admin/users",
+		requireAdminMw.ApplyFn(adminC.Users)).Methods("GET")
+	r.HandleFunc("/admin/users/{id:[0-9]+}",
+		requireAdminMw.ApplyFn(adminC.User)).Methods("GET")
+	r.HandleFunc("/admin/users/{id:[0-9]+}/disable",
+		requireAdminMw.ApplyFn(adminC.Disable)).Methods("POST")
+	r.HandleFunc("/admin/users/{id:[0-9]+}/enable",
+		requireAdminMw.ApplyFn(adminC.Enable)).Methods("POST")
+	r.HandleFunc("/admin/users/{id:[0-9]+}/reset",
+		requireAdminMw.ApplyFn(adminC.ResetPassword)).Methods("POST")
+	r.HandleFunc("/admin/users/{id:[0-9]+}/impersonate",
+		requireAdminMw.ApplyFn(adminC.Impersonate)).Methods("POST")
+	r.HandleFunc("/admin/audit",
+		requireAdminMw.ApplyFn(adminC.AuditLog)).Methods("GET")
+	r.HandleFunc("/admin/emails",
+		requireAdminMw.ApplyFn(adminC.Emails)).Methods("GET")
+	r.HandleFunc("/admin/emails/{id:[0-9]+}/retry",
+		requireAdminMw.ApplyFn(adminC.RetryEmail)).Methods("POST")
+	r.HandleFunc("/admin/emails/{id:[0-9]+}/discard",
+		requireAdminMw.ApplyFn(adminC.DiscardEmail)).Methods("POST")
+
+	// While impersonating, the current user is the one being
+	// impersonated, so this can't require an admin.
+	r.HandleFunc("/admin/impersonation/stop",
+		requireUserMw.ApplyFn(adminC.StopImpersonating)).
+		Methods("POST")
+
 	r.HandleFunc("/cookietest", usersC.CookieTest).Methods("GET")
+
+	//
+	// Webhook routes
+	//
+
+	if cfg.Mailgun.WebhookSigningKey != "" {
+		webhooksC := controllers.NewWebhooks(services.User,
+			services.Suppression, services.Audit,
+			cfg.Mailgun.WebhookSigningKey)
+		r.HandleFunc("/webhooks/mailgun",
+			webhooksC.Mailgun).Methods("POST")
+	}
+
+	// Emails can only be previewed in development
+	if !cfg.IsProd() {
+		emailsC := controllers.NewEmails(emailer)
+		r.HandleFunc("/dev/emails", emailsC.Index).Methods("GET")
+		r.HandleFunc("/dev/emails/{name}",
+			emailsC.Preview).Methods("GET")
+	}
 	//
 	// Gallery routes
 	//
@@ -100,7 +387,15 @@ func main() {
 		Name(controllers.IndexGallery)
 
 	r.Handle("/galleries/new",
-		requireUserMw.Apply(galleriesC.NewView)).Methods("GET")
+		requireUserMw.ApplyFn(galleriesC.New)).Methods("GET")
+
+	r.HandleFunc("/u/{username}", profilesC.Show).Methods("GET")
+	r.HandleFunc("/u/{username}/follow",
+		requireUserMw.ApplyFn(profilesC.Follow)).Methods("POST")
+	r.HandleFunc("/u/{username}/unfollow",
+		requireUserMw.ApplyFn(profilesC.Unfollow)).Methods("POST")
+	r.HandleFunc("/feed",
+		requireUserMw.ApplyFn(feedC.Index)).Methods("GET")
 
 	r.HandleFunc("/galleries/{id:[0-9]+}",
 		galleriesC.Show).Methods("GET").
@@ -123,12 +418,81 @@ func main() {
 		requireUserMw.ApplyFn(galleriesC.ImageUpload)).
 		Methods("POST")
 
+	r.HandleFunc("/galleries/{id:[0-9]+}/collaborators",
+		requireUserMw.ApplyFn(collaboratorsC.Invite)).Methods("POST")
+
+	r.HandleFunc("/galleries/{id:[0-9]+}/collaborators/"+
+		"{collaborator_id:[0-9]+}/revoke",
+		requireUserMw.ApplyFn(collaboratorsC.Revoke)).Methods("POST")
+
+	r.HandleFunc("/galleries/{id:[0-9]+}/images/{filename}",
+		galleriesC.Image).Methods("GET")
+
+	r.HandleFunc("/galleries/{id:[0-9]+}/comments",
+		requireUserMw.ApplyFn(commentsC.Create)).Methods("POST")
+
+	r.HandleFunc("/galleries/{id:[0-9]+}/comments/settings",
+		requireUserMw.ApplyFn(commentsC.Settings)).Methods("POST")
+
+	r.HandleFunc("/galleries/{id:[0-9]+}/comments/"+
+		"{comment_id:[0-9]+}/delete",
+		requireUserMw.ApplyFn(commentsC.Delete)).Methods("POST")
+
+	r.HandleFunc("/galleries/{id:[0-9]+}/comments/"+
+		"{comment_id:[0-9]+}/hide",
+		requireUserMw.ApplyFn(commentsC.Hide)).Methods("POST")
+
+	r.HandleFunc("/galleries/{id:[0-9]+}/comments/"+
+		"{comment_id:[0-9]+}/unhide",
+		requireUserMw.ApplyFn(commentsC.Unhide)).Methods("POST")
+
+	r.HandleFunc("/invites/accept",
+		collaboratorsC.Accept).Methods("GET")
+
+	r.HandleFunc("/invites/accept",
+		requireUserMw.ApplyFn(collaboratorsC.CompleteAccept)).
+		Methods("POST")
+
+	//
+	// Studio routes
+	//
+
+	r.HandleFunc("/studios",
+		requireUserMw.ApplyFn(studiosC.Index)).Methods("GET")
+	r.HandleFunc("/studios",
+		requireUserMw.ApplyFn(studiosC.Create)).Methods("POST")
+	r.HandleFunc("/studios/{id:[0-9]+}",
+		requireUserMw.ApplyFn(studiosC.Show)).Methods("GET")
+	r.HandleFunc("/studios/{id:[0-9]+}/members",
+		requireUserMw.ApplyFn(studiosC.AddMember)).Methods("POST")
+	r.HandleFunc("/studios/{id:[0-9]+}/members/{user_id:[0-9]+}/role",
+		requireUserMw.ApplyFn(studiosC.SetRole)).Methods("POST")
+	r.HandleFunc("/studios/{id:[0-9]+}/members/{user_id:[0-9]+}/remove",
+		requireUserMw.ApplyFn(studiosC.RemoveMember)).Methods("POST")
+
+	//
+	// Notification routes
+	//
+	r.HandleFunc("/notifications",
+		requireUserMw.ApplyFn(notificationsC.Index)).Methods("GET")
+	r.HandleFunc("/notifications/unsubscribe",
+		notificationsC.Unsubscribe).Methods("GET")
+	r.HandleFunc("/notifications/unsubscribe",
+		notificationsC.CompleteUnsubscribe).Methods("POST")
+
 	//
 	// Image routes
 	//
-	imageHandler := http.FileServer(http.Dir("./images/"))
-	imageHandler = http.StripPrefix("/images/", imageHandler)
-	r.PathPrefix("/images/").Handler(imageHandler)
+	// Avatars are public, the images of galleries are only served to
+	// those who can see the gallery. Only the files of avatars are
+	// routed to the file server, so it never lists their directories.
+	avatarHandler := http.FileServer(http.Dir("./images/avatars/"))
+	avatarHandler = http.StripPrefix("/images/avatars/", avatarHandler)
+	r.Handle("/images/avatars/{id:[0-9]+}/{size:[0-9]+}.jpg",
+		avatarHandler).Methods("GET")
+
+	r.HandleFunc("/images/galleries/{id:[0-9]+}/{filename}",
+		galleriesC.ImageFile).Methods("GET")
 
 	r.HandleFunc("/galleries/{id:[0-9]+}/images/{filename}/delete",
 		requireUserMw.ApplyFn(galleriesC.ImageDelete)).
@@ -144,5 +508,5 @@ func main() {
 	log.Printf("Starting the server on :%d...\n", cfg.Port)
 
 	http.ListenAndServe(fmt.Sprintf(":%d", cfg.Port),
-		csrfMw(userMw.Apply(r)))
+		skipCSRFMw.Apply(csrfMw(userMw.Apply(notificationsMw.Apply(r)))))
 }
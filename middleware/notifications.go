@@ -0,0 +1,52 @@
+package middleware
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"lenslockedbr.com/context"
+	"lenslockedbr.com/models"
+)
+
+// navbarNotifications is how many unread notifications are listed in
+// the navbar.
+const navbarNotifications = 9
+
+// Notifications looks up the unread notifications of the current
+// user, so the navbar can list them. It must be applied after User.
+type Notifications struct {
+	models.NotificationService
+}
+
+func (mw *Notifications) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		path := r.URL.Path
+		if strings.HasPrefix(path, "/assets/") ||
+			strings.HasPrefix(path, "/images/") {
+			next(w, r)
+			return
+		}
+
+		user := context.User(r.Context())
+		if user == nil {
+			next(w, r)
+			return
+		}
+
+		notifications, err := mw.Unread(user.ID, navbarNotifications)
+		if err != nil {
+			log.Println(err)
+			next(w, r)
+			return
+		}
+
+		ctx := context.WithNotifications(r.Context(), notifications)
+		next(w, r.WithContext(ctx))
+	})
+}
+
+func (mw *Notifications) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
@@ -0,0 +1,112 @@
+package middleware
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+
+	"lenslockedbr.com/context"
+	"lenslockedbr.com/ratelimit"
+	"lenslockedbr.com/realip"
+)
+
+// KeyFunc returns the key used to identify who is making a request.
+// An empty key means the request isn't limited by that KeyFunc.
+type KeyFunc func(r *http.Request) string
+
+// RateLimit middleware limits how often a route can be hit using a
+// token bucket per key. Every KeyFunc in Keys gets its own bucket and
+// the request is only let through if none of them is empty, in which
+// case a token is taken from each. Rejected requests take none, so
+// they don't drain the buckets of the other keys. When no Keys are
+// provided, requests are limited by IP address.
+//
+// When the limit is exceeded the client receives a 429 Too Many
+// Requests with a Retry-After header.
+type RateLimit struct {
+	Store ratelimit.Store
+	Limit ratelimit.Limit
+
+	// Name is used to prefix the keys so that routes using the
+	// same Store don't share their buckets.
+	Name string
+	Keys []KeyFunc
+}
+
+func (mw *RateLimit) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+
+		keys := mw.Keys
+		if len(keys) == 0 {
+			keys = []KeyFunc{ByIP}
+		}
+
+		names := make([]string, 0, len(keys))
+		for _, keyFn := range keys {
+			if key := keyFn(r); key != "" {
+				names = append(names, mw.Name+":"+key)
+			}
+		}
+
+		if len(names) == 0 {
+			next(w, r)
+			return
+		}
+
+		wait, err := mw.Store.Take(names, mw.Limit)
+		if err != nil {
+			// We'd rather let the request through than take
+			// the route down with the store.
+			log.Println(err)
+			next(w, r)
+			return
+		}
+
+		if wait > 0 {
+			secs := int(math.Ceil(wait.Seconds()))
+			w.Header().Set("Retry-After", fmt.Sprintf("%d", secs))
+			http.Error(w, "Too many requests. Please try again "+
+				"later.", http.StatusTooManyRequests)
+			return
+		}
+
+		next(w, r)
+	})
+}
+
+func (mw *RateLimit) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+// ByIP identifies requests by the IP address of the client.
+func ByIP(r *http.Request) string {
+	return "ip:" + realip.FromRequest(r)
+}
+
+// ByUser identifies requests by the signed in user. Requests without a
+// user are not limited by this KeyFunc, so it is usually combined with
+// ByIP.
+func ByUser(r *http.Request) string {
+	user := context.User(r.Context())
+	if user == nil {
+		return ""
+	}
+
+	return fmt.Sprintf("user:%d", user.ID)
+}
+
+// ByFormValue identifies requests by the value of a form field, eg:
+// the email address a password reset is requested for.
+func ByFormValue(field string) KeyFunc {
+	return func(r *http.Request) string {
+		v := strings.ToLower(strings.TrimSpace(r.FormValue(field)))
+		if v == "" {
+			return ""
+		}
+
+		return field + ":" + v
+	}
+}
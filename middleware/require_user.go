@@ -28,20 +28,82 @@ func (mw *RequireUser) Apply(next http.Handler) http.HandlerFunc {
 	return mw.ApplyFn(next.ServeHTTP)
 }
 
+// ImpersonationCookie holds the token of the impersonation an admin
+// started, see models.ImpersonationService.
+const ImpersonationCookie = "impersonation_token"
+
+// RequireAdmin will only let admins through. Everyone else gets a
+// 404, so the admin console doesn't advertise itself.
+type RequireAdmin struct{}
+
+func (mw *RequireAdmin) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+
+		user := context.User(r.Context())
+		if user == nil {
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+
+		if !user.IsAdmin() {
+			http.NotFound(w, r)
+			return
+		}
+
+		next(w, r)
+	})
+}
+
+func (mw *RequireAdmin) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+// NotImpersonating keeps admins who are impersonating a user away
+// from things only the user themselves should do, like changing their
+// password.
+type NotImpersonating struct{}
+
+func (mw *NotImpersonating) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+
+		if context.Impersonator(r.Context()) != nil {
+			http.Error(w, "This is not allowed while "+
+				"impersonating a user.", http.StatusForbidden)
+			return
+		}
+
+		next(w, r)
+	})
+}
+
+func (mw *NotImpersonating) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
 // User middleware will lookup the current user via their remember_token
 // cookie using the UserService. If the user is found, they will be set
 // on the request context.
+// When the user is an admin impersonating someone, that someone is set
+// as the user instead, and the admin as the impersonator.
 // Regardless, the next handler is always called.
 type User struct {
 	models.UserService
+
+	// Impersonation is optional, without it admins can't
+	// impersonate users.
+	Impersonation models.ImpersonationService
 }
 
 func (mw *User) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter,
 		r *http.Request) {
+		// The images of galleries need the user, to check they
+		// can see the gallery
 		path := r.URL.Path
 		if strings.HasPrefix(path, "/assets/") ||
-			strings.HasPrefix(path, "/images/") {
+			strings.HasPrefix(path, "/images/avatars/") {
 			next(w, r)
 			return
 		}
@@ -53,12 +115,16 @@ func (mw *User) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
 		}
 
 		user, err := mw.UserService.ByRemember(cookie.Value)
-		if err != nil {
+		if err != nil || user.Disabled() {
 			next(w, r)
 			return
 		}
 
 		ctx := r.Context()
+		if target := mw.impersonated(r, user); target != nil {
+			ctx = context.WithImpersonator(ctx, user)
+			user = target
+		}
 		ctx = context.WithUser(ctx, user)
 		r = r.WithContext(ctx)
 		next(w, r)
@@ -68,3 +134,28 @@ func (mw *User) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
 func (mw *User) Apply(next http.Handler) http.HandlerFunc {
 	return mw.ApplyFn(next.ServeHTTP)
 }
+
+// impersonated returns the user the admin is impersonating, if any.
+func (mw *User) impersonated(r *http.Request, admin *models.User) *models.User {
+
+	if mw.Impersonation == nil || !admin.IsAdmin() {
+		return nil
+	}
+
+	cookie, err := r.Cookie(ImpersonationCookie)
+	if err != nil {
+		return nil
+	}
+
+	i, err := mw.Impersonation.Active(cookie.Value)
+	if err != nil || i.AdminID != admin.ID {
+		return nil
+	}
+
+	target, err := mw.UserService.ByID(i.UserID)
+	if err != nil {
+		return nil
+	}
+
+	return target
+}
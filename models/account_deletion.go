@@ -0,0 +1,227 @@
+package models
+
+import (
+	"os"
+
+	"github.com/jinzhu/gorm"
+)
+
+// PurgeUser permanently deletes the user along with everything we hold
+// on them, and mails them that it is done. All the database rows are
+// removed in a single transaction, and the image and export files are
+// only removed from disk once it has been committed, so a failure
+// never leaves galleries without their images. It requires the outbox
+// service.
+func (s *Services) PurgeUser(user *User, mail Mail) error {
+
+	var galleries []Gallery
+	var exports []Export
+
+	tx := s.db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	// Galleries that belong to a studio stay with the studio
+	err := tx.Unscoped().Where("user_id = ? AND studio_id = 0",
+		user.ID).Find(&galleries).Error
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = tx.Where("user_id = ?", user.ID).Find(&exports).Error
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	orphaned, err := handOverStudios(tx, user)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = tx.Unscoped().Where("user_id = ? AND studio_id = 0", user.ID).
+		Delete(&Gallery{}).Error
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	galleries = append(galleries, orphaned...)
+
+	for _, gallery := range galleries {
+		err := tx.Unscoped().Where("gallery_id = ?", gallery.ID).
+			Delete(&Collaborator{}).Error
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		err = tx.Unscoped().Where("gallery_id = ?", gallery.ID).
+			Delete(&Comment{}).Error
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	// The replies to their comments would be left without a thread
+	err = tx.Unscoped().Where("parent_id IN (?)",
+		tx.Unscoped().Model(&Comment{}).Select("id").
+			Where("user_id = ?", user.ID).QueryExpr()).
+		Delete(&Comment{}).Error
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = tx.Unscoped().Where("follower_id = ? OR followee_id = ?",
+		user.ID, user.ID).Delete(&Follow{}).Error
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	// Every other table that references a user through user_id
+	owned := []interface{}{
+		&pwReset{},
+		&emailChange{},
+		&Export{},
+		&Identity{},
+		&loginLink{},
+		&Impersonation{},
+		&Membership{},
+		&Collaborator{},
+		&Notification{},
+		&NotificationPref{},
+		&ContactMessage{},
+		&Comment{},
+		&Activity{},
+	}
+	for _, model := range owned {
+		err := tx.Unscoped().Where("user_id = ?", user.ID).
+			Delete(model).Error
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	err = tx.Unscoped().Where("key = ?", "email:"+user.Email).
+		Delete(&loginAttempt{}).Error
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = tx.Unscoped().Where("id = ?", user.ID).Delete(&User{}).Error
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := mail("", s.Outbox.Sender(tx)); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+
+	// The rows are gone, so from here on we keep going and only
+	// report the first error we ran into.
+	var cleanupErr error
+	for _, gallery := range galleries {
+		err := s.Image.DeleteAll(gallery.ID)
+		if err != nil && cleanupErr == nil {
+			cleanupErr = err
+		}
+	}
+	if err := s.Avatar.Delete(user.ID); err != nil && cleanupErr == nil {
+		cleanupErr = err
+	}
+	for _, e := range exports {
+		if e.Filename == "" {
+			continue
+		}
+		err := os.Remove(e.Path())
+		if err != nil && !os.IsNotExist(err) && cleanupErr == nil {
+			cleanupErr = err
+		}
+	}
+
+	return cleanupErr
+}
+
+// handOverStudios makes sure no studio is left without an owner once
+// the user is gone. Deleting the account of the only owner of a studio
+// is refused, but they may have become it during the grace period, in
+// which case the oldest other member is made an owner. Studios with no
+// other members are deleted along with their galleries, which are
+// returned so their files can be removed too.
+func handOverStudios(tx *gorm.DB, user *User) ([]Gallery, error) {
+
+	var owned []Membership
+	var orphaned []Gallery
+
+	err := tx.Where("user_id = ? AND role = ?", user.ID, StudioOwner).
+		Find(&owned).Error
+	if err != nil {
+		return nil, err
+	}
+
+	for _, m := range owned {
+		var others []Membership
+
+		err := tx.Where("studio_id = ? AND user_id <> ?", m.StudioID,
+			user.ID).Order("created_at").Find(&others).Error
+		if err != nil {
+			return nil, err
+		}
+
+		hasOwner := false
+		for _, other := range others {
+			if other.Role == StudioOwner {
+				hasOwner = true
+			}
+		}
+
+		switch {
+		case hasOwner:
+			continue
+		case len(others) > 0:
+			err := tx.Model(&others[0]).
+				Update("role", StudioOwner).Error
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		var galleries []Gallery
+		err = tx.Unscoped().Where("studio_id = ?", m.StudioID).
+			Find(&galleries).Error
+		if err != nil {
+			return nil, err
+		}
+
+		err = tx.Unscoped().Where("studio_id = ?", m.StudioID).
+			Delete(&Gallery{}).Error
+		if err != nil {
+			return nil, err
+		}
+
+		err = tx.Unscoped().Where("id = ?", m.StudioID).
+			Delete(&Studio{}).Error
+		if err != nil {
+			return nil, err
+		}
+
+		orphaned = append(orphaned, galleries...)
+	}
+
+	return orphaned, nil
+}
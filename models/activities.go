@@ -0,0 +1,170 @@
+package models
+
+import (
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// ActivityGalleryPublished is recorded when a user makes one of
+	// their galleries public.
+	ActivityGalleryPublished = "gallery.published"
+
+	// ActivityImageAdded is recorded when an image is uploaded to a
+	// public gallery.
+	ActivityImageAdded = "image.added"
+
+	// FeedPageSize is how many activities are shown on each page of
+	// the feed.
+	FeedPageSize = 20
+
+	ErrActivityKindInvalid modelError = "models: unknown kind of activity"
+)
+
+var _ ActivityDB = &activityGorm{}
+
+// Activity is something a user published on their public portfolio,
+// shown on the feed of those who follow them. Image is the filename
+// of the image added, and empty for ActivityGalleryPublished.
+type Activity struct {
+	gorm.Model
+	UserID    uint   `gorm:"not null;index"`
+	Kind      string `gorm:"not null"`
+	GalleryID uint   `gorm:"not null;index"`
+	Image     string `gorm:"not null;default:''"`
+}
+
+// ActivityDB is used to interact with the activities database.
+type ActivityDB interface {
+	// Feed returns up to limit activities of the users the
+	// follower follows, the newest first. Only those older than the
+	// activity with the ID before are returned, unless it is zero,
+	// so the feed can be paged through. Activities on galleries
+	// that are no longer public are left out.
+	Feed(followerID, before uint, limit int) ([]Activity, error)
+
+	Create(a *Activity) error
+
+	// DeleteByImage deletes the activities on an image of the
+	// gallery.
+	DeleteByImage(galleryID uint, image string) error
+	DeleteByGalleryID(galleryID uint) error
+}
+
+type ActivityService interface {
+	ActivityDB
+}
+
+func NewActivityService(db *gorm.DB) ActivityService {
+	return &activityService{
+		ActivityDB: &activityValidator{
+			ActivityDB: &activityGorm{db},
+		},
+	}
+}
+
+//
+// Service
+//
+
+type activityService struct {
+	ActivityDB
+}
+
+//
+// Gorm
+//
+
+type activityGorm struct {
+	db *gorm.DB
+}
+
+func (ag *activityGorm) Feed(followerID, before uint,
+	limit int) ([]Activity, error) {
+
+	activities := make([]Activity, 0)
+
+	followees := ag.db.Model(&Follow{}).Select("followee_id").
+		Where("follower_id = ?", followerID).QueryExpr()
+	public := ag.db.Model(&Gallery{}).Select("id").
+		Where("public AND studio_id = 0").QueryExpr()
+
+	db := ag.db.Where("user_id IN (?) AND gallery_id IN (?)", followees,
+		public)
+	if before > 0 {
+		db = db.Where("id < ?", before)
+	}
+	db = db.Order("id DESC").Limit(limit)
+
+	if err := all(db, &activities); err != nil {
+		return nil, err
+	}
+
+	return activities, nil
+}
+
+func (ag *activityGorm) Create(a *Activity) error {
+	return ag.db.Create(a).Error
+}
+
+func (ag *activityGorm) DeleteByImage(galleryID uint, image string) error {
+	return ag.db.Unscoped().
+		Where("gallery_id = ? AND image = ?", galleryID, image).
+		Delete(&Activity{}).Error
+}
+
+func (ag *activityGorm) DeleteByGalleryID(galleryID uint) error {
+	return ag.db.Unscoped().Where("gallery_id = ?", galleryID).
+		Delete(&Activity{}).Error
+}
+
+//
+// Validators
+//
+
+type activityValidator struct {
+	ActivityDB
+}
+
+type activityValFn func(*Activity) error
+
+func runActivityValFns(a *Activity, fns ...activityValFn) error {
+	for _, fn := range fns {
+		if err := fn(a); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (av *activityValidator) idsRequired(a *Activity) error {
+	if a.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+
+	if a.GalleryID <= 0 {
+		return ErrIDInvalid
+	}
+
+	return nil
+}
+
+func (av *activityValidator) kindValid(a *Activity) error {
+	switch a.Kind {
+	case ActivityGalleryPublished, ActivityImageAdded:
+		return nil
+	default:
+		return ErrActivityKindInvalid
+	}
+}
+
+func (av *activityValidator) Create(a *Activity) error {
+
+	err := runActivityValFns(a, av.idsRequired,
+		av.kindValid)
+	if err != nil {
+		return err
+	}
+
+	return av.ActivityDB.Create(a)
+}
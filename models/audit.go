@@ -0,0 +1,317 @@
+package models
+
+import (
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	ErrActionRequired modelError = "models: action is required"
+
+	AuditLogin              = "login"
+	AuditLoginFailed        = "login.failed"
+	AuditLogout             = "logout"
+	AuditPasswordChanged    = "password.changed"
+	AuditPasswordReset      = "password.reset"
+	AuditResetRequested     = "password.reset_requested"
+	AuditEmailChangeStarted = "email.change_requested"
+	AuditEmailChanged       = "email.changed"
+	AuditIdentityLinked     = "identity.linked"
+	AuditEmailBounced       = "email.bounced"
+	AuditEmailComplained    = "email.complained"
+	AuditDeletionScheduled  = "account.deletion_scheduled"
+	AuditDeletionCancelled  = "account.deletion_cancelled"
+
+	AuditGalleryCreated = "gallery.created"
+	AuditGalleryUpdated = "gallery.updated"
+	AuditGalleryDeleted = "gallery.deleted"
+	AuditImageUploaded  = "image.uploaded"
+	AuditImageDeleted   = "image.deleted"
+
+	AuditCollaboratorInvited = "collaborator.invited"
+	AuditCollaboratorRevoked = "collaborator.revoked"
+
+	AuditAdminDisabled      = "admin.disabled"
+	AuditAdminEnabled       = "admin.enabled"
+	AuditAdminResetPassword = "admin.reset_password"
+	AuditImpersonateStarted = "admin.impersonation_started"
+	AuditImpersonateStopped = "admin.impersonation_stopped"
+	AuditEmailRetried       = "admin.email_retried"
+	AuditEmailDiscarded     = "admin.email_discarded"
+
+	// AuditLogLimit is the maximum number of events returned by a
+	// single query.
+	AuditLogLimit = 100
+
+	// maxUserAgent is the size of the user_agent column
+	maxUserAgent = 255
+)
+
+var _ AuditDB = &auditGorm{}
+
+// auditDescriptions are how the actions are described to people.
+var auditDescriptions = map[string]string{
+	AuditLogin:               "Signed in",
+	AuditLoginFailed:         "Failed sign in attempt",
+	AuditLogout:              "Signed out",
+	AuditPasswordChanged:     "Password changed",
+	AuditPasswordReset:       "Password reset",
+	AuditResetRequested:      "Password reset requested",
+	AuditEmailChangeStarted:  "Email address change requested",
+	AuditEmailChanged:        "Email address changed",
+	AuditIdentityLinked:      "External account linked",
+	AuditEmailBounced:        "Our emails to you bounced",
+	AuditEmailComplained:     "Our emails to you were reported as spam",
+	AuditDeletionScheduled:   "Account deletion scheduled",
+	AuditDeletionCancelled:   "Account deletion cancelled",
+	AuditGalleryCreated:      "Gallery created",
+	AuditGalleryUpdated:      "Gallery updated",
+	AuditGalleryDeleted:      "Gallery deleted",
+	AuditImageUploaded:       "Image uploaded",
+	AuditImageDeleted:        "Image deleted",
+	AuditCollaboratorInvited: "Collaborator invited",
+	AuditCollaboratorRevoked: "Collaborator removed",
+	AuditAdminDisabled:       "Account disabled by support",
+	AuditAdminEnabled:        "Account enabled by support",
+	AuditAdminResetPassword:  "Password reset sent by support",
+	AuditImpersonateStarted:  "Support signed in as you",
+	AuditImpersonateStopped:  "Support signed out",
+	AuditEmailRetried:        "Undelivered email retried by support",
+	AuditEmailDiscarded:      "Undelivered email discarded by support",
+}
+
+// AuditActions lists every action, eg: to filter the audit log by.
+var AuditActions = []string{
+	AuditLogin, AuditLoginFailed, AuditLogout,
+	AuditPasswordChanged, AuditPasswordReset, AuditResetRequested,
+	AuditEmailChangeStarted, AuditEmailChanged, AuditIdentityLinked,
+	AuditEmailBounced, AuditEmailComplained,
+	AuditDeletionScheduled, AuditDeletionCancelled,
+	AuditGalleryCreated, AuditGalleryUpdated, AuditGalleryDeleted,
+	AuditImageUploaded, AuditImageDeleted,
+	AuditCollaboratorInvited, AuditCollaboratorRevoked,
+	AuditAdminDisabled, AuditAdminEnabled, AuditAdminResetPassword,
+	AuditImpersonateStarted, AuditImpersonateStopped,
+	AuditEmailRetried, AuditEmailDiscarded,
+}
+
+// SecurityActions are the actions users are shown on their account
+// page, the ones that help them notice someone else in their account.
+var SecurityActions = []string{
+	AuditLogin, AuditLoginFailed, AuditLogout,
+	AuditPasswordChanged, AuditPasswordReset, AuditResetRequested,
+	AuditEmailChangeStarted, AuditEmailChanged, AuditIdentityLinked,
+	AuditEmailBounced, AuditEmailComplained,
+	AuditDeletionScheduled, AuditDeletionCancelled,
+	AuditAdminDisabled, AuditAdminEnabled, AuditAdminResetPassword,
+	AuditImpersonateStarted, AuditImpersonateStopped,
+}
+
+// AuditEvent is something that happened to an account. Events are
+// only ever added, never changed or removed.
+//
+// ActorID is the user who did it, which is 0 when nobody was signed in,
+// eg: a failed login. When an admin was impersonating the actor,
+// ImpersonatorID is the admin, so what they did is never mistaken for
+// something the user did. UserID is the account the event is about,
+// and the one it is shown to.
+type AuditEvent struct {
+	ID             uint      `gorm:"primary_key"`
+	CreatedAt      time.Time `gorm:"index"`
+	Action         string    `gorm:"not null;index"`
+	ActorID        uint      `gorm:"not null;default:0;index"`
+	ImpersonatorID uint      `gorm:"not null;default:0"`
+	UserID         uint      `gorm:"not null;default:0;index"`
+	TargetType     string    `gorm:"not null;default:''"`
+	TargetID       uint      `gorm:"not null;default:0"`
+	Detail         string    `gorm:"not null;default:''"`
+	IP             string    `gorm:"not null;default:''"`
+	UserAgent      string    `gorm:"type:varchar(255);not null;default:''"`
+}
+
+// Description describes the action for people, eg: "Signed in".
+func (e *AuditEvent) Description() string {
+	if d, ok := auditDescriptions[e.Action]; ok {
+		return d
+	}
+
+	return e.Action
+}
+
+// Impersonated returns true if an admin did it while impersonating
+// the actor.
+func (e *AuditEvent) Impersonated() bool {
+	return e.ImpersonatorID != 0
+}
+
+// AuditFilter narrows down the events returned by Search. Zero values
+// don't filter anything.
+type AuditFilter struct {
+	Action  string
+	UserID  uint
+	ActorID uint
+	IP      string
+	Since   time.Time
+	Until   time.Time
+}
+
+// AuditDB is used to interact with the audit log. There is no way to
+// update or delete events on purpose.
+type AuditDB interface {
+
+	// ByUserID returns the newest events about the user, with one
+	// of the actions when any are provided.
+	ByUserID(userID uint, actions ...string) ([]AuditEvent, error)
+
+	// Search returns the newest events matching the filter.
+	Search(f AuditFilter) ([]AuditEvent, error)
+
+	Create(e *AuditEvent) error
+}
+
+type AuditService interface {
+	AuditDB
+}
+
+func NewAuditService(db *gorm.DB) AuditService {
+	return &auditService{
+		AuditDB: &auditValidator{
+			AuditDB: &auditGorm{db},
+		},
+	}
+}
+
+//
+// Service
+//
+
+type auditService struct {
+	AuditDB
+}
+
+//
+// Gorm
+//
+
+type auditGorm struct {
+	db *gorm.DB
+}
+
+func (ag *auditGorm) ByUserID(userID uint, actions ...string) ([]AuditEvent, error) {
+
+	events := make([]AuditEvent, 0)
+
+	db := ag.db.Where("user_id = ?", userID)
+	if len(actions) > 0 {
+		db = db.Where("action IN (?)", actions)
+	}
+
+	db = db.Order("created_at DESC").Limit(AuditLogLimit)
+	if err := all(db, &events); err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+func (ag *auditGorm) Search(f AuditFilter) ([]AuditEvent, error) {
+
+	events := make([]AuditEvent, 0)
+
+	db := ag.db
+	if f.Action != "" {
+		db = db.Where("action = ?", f.Action)
+	}
+	if f.UserID != 0 {
+		db = db.Where("user_id = ?", f.UserID)
+	}
+	if f.ActorID != 0 {
+		db = db.Where("actor_id = ? OR impersonator_id = ?", f.ActorID,
+			f.ActorID)
+	}
+	if f.IP != "" {
+		db = db.Where("ip = ?", f.IP)
+	}
+	if !f.Since.IsZero() {
+		db = db.Where("created_at >= ?", f.Since)
+	}
+	if !f.Until.IsZero() {
+		db = db.Where("created_at < ?", f.Until)
+	}
+
+	db = db.Order("created_at DESC").Limit(AuditLogLimit)
+	if err := all(db, &events); err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+func (ag *auditGorm) Create(e *AuditEvent) error {
+	return ag.db.Create(e).Error
+}
+
+//
+// Validators
+//
+
+type auditValidator struct {
+	AuditDB
+}
+
+type auditValFn func(*AuditEvent) error
+
+func runAuditValFns(e *AuditEvent, fns ...auditValFn) error {
+	for _, fn := range fns {
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (av *auditValidator) actionRequired(e *AuditEvent) error {
+	if e.Action == "" {
+		return ErrActionRequired
+	}
+
+	return nil
+}
+
+// userDefaultsToActor makes events without a user about the actor,
+// eg: a user changing their own password.
+func (av *auditValidator) userDefaultsToActor(e *AuditEvent) error {
+	if e.UserID == 0 {
+		e.UserID = e.ActorID
+	}
+
+	return nil
+}
+
+func (av *auditValidator) truncateUserAgent(e *AuditEvent) error {
+	if len(e.UserAgent) > maxUserAgent {
+		// Cutting it may split a multi-byte character
+		e.UserAgent = strings.ToValidUTF8(e.UserAgent[:maxUserAgent],
+			"")
+	}
+
+	return nil
+}
+
+func (av *auditValidator) Create(e *AuditEvent) error {
+
+	// Events are never updated, so the ID must come from the DB
+	e.ID = 0
+
+	err := runAuditValFns(e, av.actionRequired,
+		av.userDefaultsToActor,
+		av.truncateUserAgent)
+	if err != nil {
+		return err
+	}
+
+	return av.AuditDB.Create(e)
+}
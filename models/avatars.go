@@ -0,0 +1,207 @@
+package models
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"net/url"
+	"path"
+	"path/filepath"
+)
+
+const (
+	// Avatars are stored in these sizes, in pixels, so pages can
+	// pick the smallest one that looks good.
+	AvatarSmall  = 32
+	AvatarMedium = 64
+	AvatarLarge  = 256
+
+	// MaxAvatarBytes is the largest avatar that can be uploaded.
+	MaxAvatarBytes = 5 << 20 // 5 megabytes
+
+	// maxAvatarSide is the widest, or tallest, avatar we decode. It
+	// keeps small files that decode into huge images out.
+	maxAvatarSide = 5000
+
+	ErrAvatarInvalid modelError = "models: avatars must be JPEG, PNG " +
+		"or GIF images"
+
+	ErrAvatarTooLarge modelError = "models: avatars must be at most " +
+		"5 MB and 5000 pixels wide and tall"
+)
+
+// AvatarSizes are all the sizes avatars are stored in.
+var AvatarSizes = []int{AvatarSmall, AvatarMedium, AvatarLarge}
+
+// Avatar is the profile picture of a user in one of AvatarSizes. Like
+// Image, it is NOT stored in the database, and instead references data
+// stored on disk next to the gallery images.
+type Avatar struct {
+	UserID uint
+	Size   int
+}
+
+// Path is used to build the absolute path used to reference this
+// avatar via web request.
+func (a *Avatar) Path() string {
+	temp := url.URL{
+		Path: "/" + a.RelativePath(),
+	}
+	return temp.String()
+}
+
+// RelativePath is used to build the path to this avatar on our local
+// disk, relative to where our Go application is run from.
+func (a *Avatar) RelativePath() string {
+	return filepath.ToSlash(filepath.Join(imagesDir, avatarDir(a.UserID),
+		a.filename()))
+}
+
+func (a *Avatar) filename() string {
+	return fmt.Sprintf("%d.jpg", a.Size)
+}
+
+type AvatarService interface {
+	// Create crops the image read from r into a square, centered,
+	// and stores it in every one of AvatarSizes, replacing the
+	// avatar the user had. Either every size is replaced or none
+	// is. ErrAvatarInvalid is returned if it isn't an image we can
+	// decode, and ErrAvatarTooLarge if it is bigger than
+	// MaxAvatarBytes or maxAvatarSide.
+	Create(userID uint, r io.Reader) error
+
+	// Delete removes every size of the avatar of the user.
+	Delete(userID uint) error
+}
+
+// NewAvatarService creates an AvatarService that keeps the avatars in
+// files, the same FileStore the images of galleries are kept in.
+func NewAvatarService(files FileStore) AvatarService {
+	return &avatarService{files: files}
+}
+
+type avatarService struct {
+	files FileStore
+}
+
+func (as *avatarService) Create(userID uint, r io.Reader) error {
+
+	// Read one byte more than we accept to tell if it is too large
+	data, err := io.ReadAll(io.LimitReader(r, MaxAvatarBytes+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > MaxAvatarBytes {
+		return ErrAvatarTooLarge
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return ErrAvatarInvalid
+	}
+	if cfg.Width > maxAvatarSide || cfg.Height > maxAvatarSide {
+		return ErrAvatarTooLarge
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return ErrAvatarInvalid
+	}
+
+	square := cropSquare(src)
+
+	files := make(map[string][]byte, len(AvatarSizes))
+	for _, size := range AvatarSizes {
+		var buf bytes.Buffer
+		err := jpeg.Encode(&buf, resizeSquare(square, size),
+			&jpeg.Options{Quality: 90})
+		if err != nil {
+			return err
+		}
+
+		a := Avatar{UserID: userID, Size: size}
+		files[a.filename()] = buf.Bytes()
+	}
+
+	return as.files.WriteDir(avatarDir(userID), files)
+}
+
+func (as *avatarService) Delete(userID uint) error {
+	return as.files.RemoveAll(avatarDir(userID))
+}
+
+// avatarDir is the directory of the FileStore with every size of the
+// avatar of the user.
+func avatarDir(userID uint) string {
+	return path.Join("avatars", fmt.Sprintf("%v", userID))
+}
+
+// cropSquare returns the largest square in the center of img, drawn
+// over a white background so transparent images still look right as
+// JPEGs.
+func cropSquare(img image.Image) *image.RGBA {
+
+	b := img.Bounds()
+
+	side := b.Dx()
+	if b.Dy() < side {
+		side = b.Dy()
+	}
+
+	origin := image.Pt(b.Min.X+(b.Dx()-side)/2, b.Min.Y+(b.Dy()-side)/2)
+
+	square := image.NewRGBA(image.Rect(0, 0, side, side))
+	draw.Draw(square, square.Bounds(), image.White, image.ZP, draw.Src)
+	draw.Draw(square, square.Bounds(), img, origin, draw.Over)
+
+	return square
+}
+
+// resizeSquare scales the square image to size by size pixels. Each
+// pixel is the average of the pixels it covers in src, which is enough
+// to shrink photos without them looking jagged.
+func resizeSquare(src *image.RGBA, size int) *image.RGBA {
+
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	side := src.Bounds().Dx()
+
+	for y := 0; y < size; y++ {
+		y0 := y * side / size
+		y1 := (y + 1) * side / size
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+
+		for x := 0; x < size; x++ {
+			x0 := x * side / size
+			x1 := (x + 1) * side / size
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				i := src.PixOffset(x0, sy)
+				for sx := x0; sx < x1; sx++ {
+					for c := 0; c < 4; c++ {
+						sum[c] += int(src.Pix[i+c])
+					}
+					i += 4
+				}
+			}
+
+			n := (y1 - y0) * (x1 - x0)
+			i := dst.PixOffset(x, y)
+			for c := 0; c < 4; c++ {
+				dst.Pix[i+c] = uint8(sum[c] / n)
+			}
+		}
+	}
+
+	return dst
+}
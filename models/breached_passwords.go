@@ -0,0 +1,139 @@
+package models
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"os"
+	"strings"
+)
+
+// breachLineMax is the longest line we expect to find in a corpus
+// file: 40 hex characters, a colon and a count.
+const breachLineMax = 64
+
+// BreachCorpus checks passwords against an offline copy of a breached
+// password corpus, like the one published by Have I Been Pwned, in the
+// "ordered by hash" format: one upper case SHA-1 hash per line,
+// followed by a colon and the number of times it was seen.
+//
+//	000000005AD76BD555C1D6D771DE417A4B87E4B4:10
+//
+// Only the SHA-1 hash of the password is ever computed, and the file
+// is searched in place, so the corpus (tens of gigabytes) doesn't need
+// to fit in memory.
+type BreachCorpus struct {
+	f    *os.File
+	size int64
+}
+
+// OpenBreachCorpus opens the corpus file at path.
+func OpenBreachCorpus(path string) (*BreachCorpus, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &BreachCorpus{
+		f:    f,
+		size: fi.Size(),
+	}, nil
+}
+
+// Close closes the corpus file.
+func (bc *BreachCorpus) Close() error {
+	return bc.f.Close()
+}
+
+// Contains returns whether the password appears in the corpus. It runs
+// a binary search on the file, which must be sorted by hash.
+func (bc *BreachCorpus) Contains(password string) (bool, error) {
+
+	sum := sha1.Sum([]byte(password))
+	target := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	// lo and hi are byte offsets; every line that starts before lo
+	// is smaller than target and every line starting at or after hi
+	// is greater.
+	lo, hi := int64(0), bc.size
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+
+		start, line, err := bc.lineAt(mid)
+		if err != nil {
+			return false, err
+		}
+
+		if start >= hi {
+			// The line containing mid began before it, but
+			// there is no complete line in [mid, hi), so
+			// look at the lower half.
+			hi = mid
+			continue
+		}
+
+		switch cmp := strings.Compare(breachHash(line), target); {
+		case cmp == 0:
+			return true, nil
+		case cmp < 0:
+			lo = start + int64(len(line)) + 1
+		default:
+			hi = start
+		}
+	}
+
+	return false, nil
+}
+
+// lineAt returns the first complete line starting at or after offset,
+// along with the offset it starts at.
+func (bc *BreachCorpus) lineAt(offset int64) (int64, string, error) {
+
+	start := offset
+	if offset > 0 {
+		// Skip the rest of the line offset falls in
+		buf := make([]byte, breachLineMax)
+		n, err := bc.f.ReadAt(buf, offset-1)
+		if err != nil && err != io.EOF {
+			return 0, "", err
+		}
+
+		i := bytes.IndexByte(buf[:n], '\n')
+		if i < 0 {
+			return bc.size, "", nil
+		}
+		start = offset + int64(i)
+	}
+
+	if start >= bc.size {
+		return bc.size, "", nil
+	}
+
+	buf := make([]byte, breachLineMax)
+	n, err := bc.f.ReadAt(buf, start)
+	if err != nil && err != io.EOF {
+		return 0, "", err
+	}
+
+	line := buf[:n]
+	if i := bytes.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+
+	return start, strings.TrimRight(string(line), "\r"), nil
+}
+
+func breachHash(line string) string {
+	if i := strings.IndexByte(line, ':'); i >= 0 {
+		return line[:i]
+	}
+
+	return line
+}
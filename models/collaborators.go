@@ -0,0 +1,427 @@
+package models
+
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"lenslockedbr.com/hash"
+	"lenslockedbr.com/rand"
+)
+
+const (
+	// CollaboratorUploader can only add images to the gallery.
+	CollaboratorUploader = "uploader"
+
+	// CollaboratorEditor can also change the title of the gallery
+	// and delete its images.
+	CollaboratorEditor = "editor"
+
+	// InviteTTL is how long an invitation to a gallery can be
+	// accepted for.
+	InviteTTL = 7 * 24 * time.Hour
+
+	ErrCollaboratorRoleInvalid modelError = "models: collaborators " +
+		"must be uploaders or editors"
+
+	// ErrInviteInvalid is returned when accepting an invitation
+	// that doesn't exist, has expired, was revoked or was already
+	// accepted.
+	ErrInviteInvalid modelError = "models: this invitation is no " +
+		"longer valid"
+
+	// ErrAlreadyInvited is returned when inviting someone who was
+	// already invited to the gallery.
+	ErrAlreadyInvited modelError = "models: that person has already " +
+		"been invited to the gallery"
+)
+
+// collaboratorPermissions is the most each collaborator role is
+// allowed to do.
+var collaboratorPermissions = map[string]Permission{
+	CollaboratorUploader: PermUpload,
+	CollaboratorEditor:   PermEdit,
+}
+
+// CollaboratorRoles lists the roles a collaborator can be invited
+// with.
+var CollaboratorRoles = []string{CollaboratorUploader, CollaboratorEditor}
+
+var _ CollaboratorDB = &collaboratorGorm{}
+
+// Collaborator is someone invited by email to contribute to a single
+// gallery. The invitation is pending until it is accepted, which sets
+// UserID to the user who accepted it.
+type Collaborator struct {
+	gorm.Model
+	GalleryID   uint   `gorm:"not null;index"`
+	InvitedByID uint   `gorm:"not null"`
+	Email       string `gorm:"not null"`
+	UserID      uint   `gorm:"not null;default:0;index"`
+	Role        string `gorm:"not null"`
+	Token       string `gorm:"-"`
+	TokenHash   string `gorm:"not null;unique_index"`
+	ExpiresAt   time.Time
+	AcceptedAt  *time.Time
+}
+
+// Pending returns true if the invitation hasn't been accepted yet.
+func (c *Collaborator) Pending() bool {
+	return c.AcceptedAt == nil
+}
+
+// CollaboratorDB is used to interact with the collaborators database.
+//
+// For single collaborator queries, if the collaborator is not found
+// ErrNotFound is returned.
+type CollaboratorDB interface {
+	ByID(id uint) (*Collaborator, error)
+	ByToken(token string) (*Collaborator, error)
+	ByGalleryID(galleryID uint) ([]Collaborator, error)
+
+	// ByUserID returns the galleries the user accepted invitations
+	// to, as collaborators.
+	ByUserID(userID uint) ([]Collaborator, error)
+
+	// Accepted returns the collaborator the user became by
+	// accepting an invitation to the gallery.
+	Accepted(galleryID, userID uint) (*Collaborator, error)
+
+	Create(c *Collaborator) error
+	Update(c *Collaborator) error
+	Delete(id uint) error
+	DeleteByGalleryID(galleryID uint) error
+}
+
+type CollaboratorService interface {
+	CollaboratorDB
+
+	// Invite invites the email address to contribute to the
+	// gallery with the role, and mails the token that accepts the
+	// invitation.
+	Invite(gallery *Gallery, inviter *User, email,
+		role string, mail Mail) (*Collaborator, error)
+
+	// Accept makes the user the collaborator the token invited.
+	// ErrInviteInvalid is returned if the invitation can't be
+	// accepted anymore.
+	Accept(token string, user *User) (*Collaborator, error)
+
+	// Revoke revokes the invitation, or removes the collaborator
+	// from the gallery if it was already accepted.
+	Revoke(c *Collaborator) error
+}
+
+func NewCollaboratorService(db *gorm.DB, hmac hash.HMAC) CollaboratorService {
+
+	cv := &collaboratorValidator{
+		CollaboratorDB: &collaboratorGorm{db},
+		hmac:           hmac,
+		emailRegex: regexp.MustCompile(
+			`^[a-z0-9._%+\-]+@[a-z0-9.\-]+\.[a-z]{2,16}$`),
+	}
+
+	return &collaboratorService{
+		CollaboratorDB: cv,
+		cv:             cv,
+		db:             db,
+		outbox:         NewOutboxService(db),
+	}
+}
+
+//
+// Service
+//
+
+type collaboratorService struct {
+	CollaboratorDB
+	cv     *collaboratorValidator
+	db     *gorm.DB
+	outbox OutboxService
+}
+
+func (cs *collaboratorService) Invite(gallery *Gallery, inviter *User,
+	email, role string, mail Mail) (*Collaborator, error) {
+
+	email = strings.ToLower(strings.TrimSpace(email))
+
+	invited, err := cs.ByGalleryID(gallery.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range invited {
+		if c.Email == email {
+			return nil, ErrAlreadyInvited
+		}
+	}
+
+	token, err := rand.RememberToken()
+	if err != nil {
+		return nil, err
+	}
+
+	c := Collaborator{
+		GalleryID:   gallery.ID,
+		InvitedByID: inviter.ID,
+		Email:       email,
+		Role:        role,
+		Token:       token,
+		ExpiresAt:   time.Now().Add(InviteTTL),
+	}
+
+	err = transaction(cs.db, func(tx *gorm.DB) error {
+		cv := *cs.cv
+		cv.CollaboratorDB = &collaboratorGorm{tx}
+
+		if err := cv.Create(&c); err != nil {
+			return err
+		}
+
+		return mail(token, cs.outbox.Sender(tx))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+func (cs *collaboratorService) Accept(token string, user *User) (*Collaborator, error) {
+
+	c, err := cs.ByToken(token)
+	switch err {
+	case nil:
+	case ErrNotFound:
+		return nil, ErrInviteInvalid
+	default:
+		return nil, err
+	}
+
+	if !c.Pending() || time.Now().After(c.ExpiresAt) {
+		return nil, ErrInviteInvalid
+	}
+
+	now := time.Now()
+	c.UserID = user.ID
+	c.AcceptedAt = &now
+
+	if err := cs.Update(c); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (cs *collaboratorService) Revoke(c *Collaborator) error {
+	return cs.Delete(c.ID)
+}
+
+//
+// Gorm
+//
+
+type collaboratorGorm struct {
+	db *gorm.DB
+}
+
+func (cg *collaboratorGorm) ByID(id uint) (*Collaborator, error) {
+
+	var c Collaborator
+
+	if err := first(cg.db.Where("id = ?", id), &c); err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+func (cg *collaboratorGorm) ByToken(tokenHash string) (*Collaborator, error) {
+
+	var c Collaborator
+
+	err := first(cg.db.Where("token_hash = ?", tokenHash), &c)
+	if err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+func (cg *collaboratorGorm) ByGalleryID(galleryID uint) ([]Collaborator, error) {
+
+	collaborators := make([]Collaborator, 0)
+
+	db := cg.db.Where("gallery_id = ?", galleryID).Order("created_at")
+	if err := all(db, &collaborators); err != nil {
+		return nil, err
+	}
+
+	return collaborators, nil
+}
+
+func (cg *collaboratorGorm) ByUserID(userID uint) ([]Collaborator, error) {
+
+	collaborators := make([]Collaborator, 0)
+
+	db := cg.db.Where("user_id = ? AND accepted_at IS NOT NULL", userID).
+		Order("accepted_at DESC")
+	if err := all(db, &collaborators); err != nil {
+		return nil, err
+	}
+
+	return collaborators, nil
+}
+
+func (cg *collaboratorGorm) Accepted(galleryID, userID uint) (*Collaborator, error) {
+
+	var c Collaborator
+
+	db := cg.db.Where("gallery_id = ? AND user_id = ? AND "+
+		"accepted_at IS NOT NULL", galleryID, userID)
+	if err := first(db, &c); err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+func (cg *collaboratorGorm) Create(c *Collaborator) error {
+	return cg.db.Create(c).Error
+}
+
+func (cg *collaboratorGorm) Update(c *Collaborator) error {
+	return cg.db.Save(c).Error
+}
+
+// Delete deletes the collaborator for good, so the same email address
+// can be invited again.
+func (cg *collaboratorGorm) Delete(id uint) error {
+	c := Collaborator{Model: gorm.Model{ID: id}}
+	return cg.db.Unscoped().Delete(&c).Error
+}
+
+func (cg *collaboratorGorm) DeleteByGalleryID(galleryID uint) error {
+	return cg.db.Unscoped().Where("gallery_id = ?", galleryID).
+		Delete(&Collaborator{}).Error
+}
+
+//
+// Validators
+//
+
+type collaboratorValidator struct {
+	CollaboratorDB
+	hmac       hash.HMAC
+	emailRegex *regexp.Regexp
+}
+
+type collaboratorValFn func(*Collaborator) error
+
+func runCollaboratorValFns(c *Collaborator, fns ...collaboratorValFn) error {
+	for _, fn := range fns {
+		if err := fn(c); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (cv *collaboratorValidator) galleryIDRequired(c *Collaborator) error {
+	if c.GalleryID <= 0 || c.InvitedByID <= 0 {
+		return ErrIDInvalid
+	}
+
+	return nil
+}
+
+func (cv *collaboratorValidator) emailFormat(c *Collaborator) error {
+	if c.Email == "" {
+		return ErrEmailRequired
+	}
+
+	if !cv.emailRegex.MatchString(c.Email) {
+		return ErrEmailInvalid
+	}
+
+	return nil
+}
+
+func (cv *collaboratorValidator) roleValid(c *Collaborator) error {
+	if _, ok := collaboratorPermissions[c.Role]; !ok {
+		return ErrCollaboratorRoleInvalid
+	}
+
+	return nil
+}
+
+func (cv *collaboratorValidator) hmacToken(c *Collaborator) error {
+	if c.Token == "" {
+		return nil
+	}
+
+	c.TokenHash = cv.hmac.Hash(c.Token)
+
+	return nil
+}
+
+func (cv *collaboratorValidator) tokenHashRequired(c *Collaborator) error {
+	if c.TokenHash == "" {
+		return ErrTokenInvalid
+	}
+
+	return nil
+}
+
+func (cv *collaboratorValidator) ByToken(token string) (*Collaborator, error) {
+
+	// The token may have been hashed with a previous HMAC key
+	for _, hashed := range cv.hmac.HashAll(token) {
+		found, err := cv.CollaboratorDB.ByToken(hashed)
+		if err == ErrNotFound {
+			continue
+		}
+
+		return found, err
+	}
+
+	return nil, ErrNotFound
+}
+
+func (cv *collaboratorValidator) Create(c *Collaborator) error {
+
+	err := runCollaboratorValFns(c, cv.galleryIDRequired,
+		cv.emailFormat,
+		cv.roleValid,
+		cv.hmacToken,
+		cv.tokenHashRequired)
+	if err != nil {
+		return err
+	}
+
+	return cv.CollaboratorDB.Create(c)
+}
+
+func (cv *collaboratorValidator) Update(c *Collaborator) error {
+
+	err := runCollaboratorValFns(c, cv.galleryIDRequired,
+		cv.emailFormat,
+		cv.roleValid,
+		cv.hmacToken,
+		cv.tokenHashRequired)
+	if err != nil {
+		return err
+	}
+
+	return cv.CollaboratorDB.Update(c)
+}
+
+func (cv *collaboratorValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+
+	return cv.CollaboratorDB.Delete(id)
+}
@@ -0,0 +1,328 @@
+package models
+
+import (
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// maxCommentBody is the longest comment we accept
+	maxCommentBody = 2000
+
+	ErrCommentRequired modelError = "models: comment can't be empty"
+
+	ErrCommentTooLong modelError = "models: comments must be at most " +
+		"2000 characters long"
+
+	// ErrCommentsDisabled is returned when commenting on a gallery
+	// whose comments were disabled.
+	ErrCommentsDisabled modelError = "models: comments are disabled " +
+		"on this gallery"
+
+	// ErrCommentReplyInvalid is returned when replying to a comment
+	// that is a reply itself, or is on another gallery.
+	ErrCommentReplyInvalid modelError = "models: you can only reply " +
+		"to comments on this gallery that aren't replies themselves"
+)
+
+var _ CommentDB = &commentGorm{}
+
+// Comment is left on a gallery, or on one of its images when Image is
+// the filename of one. Comments are threaded one level deep: ParentID
+// is the comment it replies to, and zero for the ones that start a
+// thread. Hidden comments are only shown to those who moderate the
+// gallery.
+type Comment struct {
+	gorm.Model
+	GalleryID uint   `gorm:"not null;index"`
+	Image     string `gorm:"not null;default:''"`
+	ParentID  uint   `gorm:"not null;default:0;index"`
+	UserID    uint   `gorm:"not null;index"`
+	Body      string `gorm:"type:text;not null"`
+	Hidden    bool   `gorm:"not null;default:false"`
+}
+
+// Thread is a comment along with its replies, the oldest first.
+type Thread struct {
+	Comment
+	Replies []Comment
+}
+
+// CommentDB is used to interact with the comments database.
+//
+// For single comment queries, if the comment is not found ErrNotFound
+// is returned.
+type CommentDB interface {
+	ByID(id uint) (*Comment, error)
+
+	// ByGalleryID returns every comment on the gallery and its
+	// images, the oldest first.
+	ByGalleryID(galleryID uint) ([]Comment, error)
+
+	Create(c *Comment) error
+	Update(c *Comment) error
+
+	// Delete deletes the comment along with its replies.
+	Delete(id uint) error
+
+	// DeleteByImage deletes the comments on an image of the
+	// gallery.
+	DeleteByImage(galleryID uint, image string) error
+	DeleteByGalleryID(galleryID uint) error
+}
+
+type CommentService interface {
+	CommentDB
+
+	// Post adds the comment to the gallery, unless its comments
+	// were disabled, in which case ErrCommentsDisabled is returned.
+	Post(gallery *Gallery, c *Comment) error
+
+	// Threads returns the threads on the image of the gallery, or on
+	// the gallery itself when image is empty, the oldest first.
+	// Hidden comments, and the replies to them, are left out unless
+	// withHidden is true.
+	Threads(galleryID uint, image string, withHidden bool) ([]Thread, error)
+
+	// ImageCounts returns how many visible comments each image of
+	// the gallery has, keyed by filename.
+	ImageCounts(galleryID uint) (map[string]int, error)
+}
+
+func NewCommentService(db *gorm.DB) CommentService {
+	return &commentService{
+		CommentDB: &commentValidator{
+			CommentDB: &commentGorm{db},
+		},
+	}
+}
+
+//
+// Service
+//
+
+type commentService struct {
+	CommentDB
+}
+
+func (cs *commentService) Post(gallery *Gallery, c *Comment) error {
+
+	if gallery.CommentsDisabled {
+		return ErrCommentsDisabled
+	}
+
+	c.GalleryID = gallery.ID
+	return cs.Create(c)
+}
+
+func (cs *commentService) Threads(galleryID uint, image string,
+	withHidden bool) ([]Thread, error) {
+
+	comments, err := cs.ByGalleryID(galleryID)
+	if err != nil {
+		return nil, err
+	}
+
+	threads := make([]Thread, 0)
+	index := make(map[uint]int)
+
+	// Replies are always newer than the comment they reply to, so
+	// the threads are all started by the time we get to them.
+	for _, c := range comments {
+		if c.Image != image || (c.Hidden && !withHidden) {
+			continue
+		}
+
+		if c.ParentID == 0 {
+			index[c.ID] = len(threads)
+			threads = append(threads, Thread{Comment: c})
+			continue
+		}
+
+		if i, ok := index[c.ParentID]; ok {
+			threads[i].Replies = append(threads[i].Replies, c)
+		}
+	}
+
+	return threads, nil
+}
+
+func (cs *commentService) ImageCounts(galleryID uint) (map[string]int, error) {
+
+	comments, err := cs.ByGalleryID(galleryID)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int)
+	for _, c := range comments {
+		if c.Image != "" && !c.Hidden {
+			counts[c.Image]++
+		}
+	}
+
+	return counts, nil
+}
+
+//
+// Gorm
+//
+
+type commentGorm struct {
+	db *gorm.DB
+}
+
+func (cg *commentGorm) ByID(id uint) (*Comment, error) {
+
+	var c Comment
+
+	if err := first(cg.db.Where("id = ?", id), &c); err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+func (cg *commentGorm) ByGalleryID(galleryID uint) ([]Comment, error) {
+
+	comments := make([]Comment, 0)
+
+	db := cg.db.Where("gallery_id = ?", galleryID).Order("created_at, id")
+	if err := all(db, &comments); err != nil {
+		return nil, err
+	}
+
+	return comments, nil
+}
+
+func (cg *commentGorm) Create(c *Comment) error {
+	return cg.db.Create(c).Error
+}
+
+func (cg *commentGorm) Update(c *Comment) error {
+	return cg.db.Save(c).Error
+}
+
+func (cg *commentGorm) Delete(id uint) error {
+	return cg.db.Unscoped().Where("id = ? OR parent_id = ?", id, id).
+		Delete(&Comment{}).Error
+}
+
+func (cg *commentGorm) DeleteByImage(galleryID uint, image string) error {
+	return cg.db.Unscoped().
+		Where("gallery_id = ? AND image = ?", galleryID, image).
+		Delete(&Comment{}).Error
+}
+
+func (cg *commentGorm) DeleteByGalleryID(galleryID uint) error {
+	return cg.db.Unscoped().Where("gallery_id = ?", galleryID).
+		Delete(&Comment{}).Error
+}
+
+//
+// Validators
+//
+
+type commentValidator struct {
+	CommentDB
+}
+
+type commentValFn func(*Comment) error
+
+func runCommentValFns(c *Comment, fns ...commentValFn) error {
+	for _, fn := range fns {
+		if err := fn(c); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (cv *commentValidator) idsRequired(c *Comment) error {
+	if c.GalleryID <= 0 {
+		return ErrIDInvalid
+	}
+
+	if c.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+
+	return nil
+}
+
+func (cv *commentValidator) normalizeBody(c *Comment) error {
+	c.Body = strings.TrimSpace(c.Body)
+	return nil
+}
+
+func (cv *commentValidator) bodyRequired(c *Comment) error {
+	if c.Body == "" {
+		return ErrCommentRequired
+	}
+
+	if len(c.Body) > maxCommentBody {
+		return ErrCommentTooLong
+	}
+
+	return nil
+}
+
+// parentValid makes sure replies are to a comment that starts a thread
+// on the same gallery. Replies are on the same image as their parent.
+func (cv *commentValidator) parentValid(c *Comment) error {
+	if c.ParentID == 0 {
+		return nil
+	}
+
+	parent, err := cv.ByID(c.ParentID)
+	switch err {
+	case nil:
+	case ErrNotFound:
+		return ErrCommentReplyInvalid
+	default:
+		return err
+	}
+
+	if parent.GalleryID != c.GalleryID || parent.ParentID != 0 {
+		return ErrCommentReplyInvalid
+	}
+
+	c.Image = parent.Image
+
+	return nil
+}
+
+func (cv *commentValidator) Create(c *Comment) error {
+
+	err := runCommentValFns(c, cv.idsRequired,
+		cv.normalizeBody,
+		cv.bodyRequired,
+		cv.parentValid)
+	if err != nil {
+		return err
+	}
+
+	return cv.CommentDB.Create(c)
+}
+
+func (cv *commentValidator) Update(c *Comment) error {
+
+	err := runCommentValFns(c, cv.idsRequired,
+		cv.normalizeBody,
+		cv.bodyRequired)
+	if err != nil {
+		return err
+	}
+
+	return cv.CommentDB.Update(c)
+}
+
+func (cv *commentValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+
+	return cv.CommentDB.Delete(id)
+}
@@ -0,0 +1,177 @@
+package models
+
+import (
+	"strings"
+)
+
+// commonPasswords is a list of the most commonly used passwords that
+// are at least 8 characters long, taken from public password dumps.
+// Shorter passwords are already rejected by passwordMinLength.
+//
+// Every entry is lower case since passwords are compared ignoring
+// case.
+var commonPasswords = newPasswordSet(`
+password
+12345678
+123456789
+1234567890
+12345678910
+123123123
+1234512345
+0123456789
+987654321
+9876543210
+11111111
+111111111
+1111111111
+00000000
+000000000
+88888888
+99999999
+12341234
+11223344
+12121212
+123321123
+147258369
+123qweasd
+123qweasdzxc
+1q2w3e4r
+1q2w3e4r5t
+1q2w3e4r5t6y
+1qaz2wsx
+1qaz2wsx3edc
+zaq12wsx
+zaq1zaq1
+qwertyuiop
+qwerty123
+qwerty12
+qwertyui
+qwerty1234
+asdfghjkl
+asdfasdf
+zxcvbnm1
+zxcvbnm123
+abcd1234
+abc12345
+abcdefgh
+abcdefg1
+aa123456
+a1234567
+a1b2c3d4
+password1
+password12
+password123
+password1234
+passw0rd
+p@ssw0rd
+p@ssword
+pa$$word
+password!
+senha123
+senha1234
+mudar123
+mudar@123
+brasil123
+brasil2018
+flamengo
+flamengo1
+corinthians
+palmeiras
+saopaulo
+gremio123
+vasco123
+botafogo
+fluminense
+cruzeiro
+iloveyou
+iloveyou1
+iloveyou2
+teamo123
+princess
+princess1
+sunshine
+sunshine1
+football
+football1
+baseball
+basketball
+superman
+batman123
+spiderman
+starwars
+pokemon1
+whatever
+trustno1
+welcome1
+welcome123
+letmein1
+letmein123
+changeme
+changeme1
+computer
+internet
+michelle
+jennifer
+jessica1
+jordan23
+charlie1
+michael1
+danielle
+baseball1
+liverpool
+chelsea1
+arsenal1
+manchester
+barcelona
+12qwaszx
+q1w2e3r4
+q1w2e3r4t5
+qazwsxedc
+qweasdzxc
+1234qwer
+qwer1234
+asdf1234
+zxcv1234
+admin123
+administrator
+adminadmin
+master12
+masterkey
+dragon12
+monkey12
+shadow12
+freedom1
+whatever1
+blink182
+myspace1
+computer1
+123abc123
+lenslocked
+lenslockedbr
+lenslockedbr.com
+photography
+photographer
+fotografia
+fotografo
+canon123
+nikon123
+`)
+
+// passwordSet is a set of lower case passwords.
+type passwordSet map[string]struct{}
+
+func newPasswordSet(list string) passwordSet {
+	set := make(passwordSet)
+
+	for _, pw := range strings.Fields(list) {
+		set[pw] = struct{}{}
+	}
+
+	return set
+}
+
+// Contains returns whether the password is in the set, ignoring case.
+func (ps passwordSet) Contains(password string) bool {
+	_, ok := ps[strings.ToLower(password)]
+	return ok
+}
@@ -0,0 +1,270 @@
+package models
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"lenslockedbr.com/hash"
+)
+
+const (
+	// ContactMinDelay is how long it takes, at the very least, a
+	// person to fill in the contact form. Faster submissions are
+	// assumed to come from bots.
+	ContactMinDelay = 3 * time.Second
+
+	// ContactFormTTL is how long a contact form can be submitted
+	// after it was rendered.
+	ContactFormTTL = 24 * time.Hour
+
+	// maxContactName is the size of the name column
+	maxContactName = 255
+
+	// maxContactMessage is the longest message we accept
+	maxContactMessage = 5000
+
+	ErrContactNameRequired modelError = "models: name is required"
+
+	ErrContactMessageRequired modelError = "models: message is required"
+
+	ErrContactNameTooLong modelError = "models: name must be at most " +
+		"255 characters long"
+
+	ErrContactMessageTooLong modelError = "models: message must be at " +
+		"most 5000 characters long"
+
+	// ErrContactTooFast is returned when the contact form was
+	// submitted faster than ContactMinDelay after it was rendered.
+	ErrContactTooFast modelError = "models: that was quick! Please " +
+		"wait a few seconds and send your message again"
+
+	// ErrContactFormExpired is returned when the contact form was
+	// rendered more than ContactFormTTL ago, or its token wasn't
+	// made by us.
+	ErrContactFormExpired modelError = "models: the contact form " +
+		"expired, please send your message again"
+)
+
+var _ ContactDB = &contactGorm{}
+
+// ContactMessage is a message sent through the contact form. UserID is
+// zero when it was sent without signing in.
+type ContactMessage struct {
+	gorm.Model
+	UserID    uint   `gorm:"not null;default:0;index"`
+	Name      string `gorm:"not null"`
+	Email     string `gorm:"not null"`
+	Message   string `gorm:"type:text;not null"`
+	IP        string `gorm:"not null;default:''"`
+	UserAgent string `gorm:"not null;default:''"`
+}
+
+// ContactDB is used to interact with the contact messages database.
+//
+// For single message queries, if the message is not found ErrNotFound
+// is returned.
+type ContactDB interface {
+	ByID(id uint) (*ContactMessage, error)
+
+	Create(m *ContactMessage) error
+}
+
+type ContactService interface {
+	ContactDB
+
+	// FormToken returns the token the contact form rendered at the
+	// time is submitted with. It records, in a way that can't be
+	// tampered with, when the form was rendered.
+	FormToken(now time.Time) string
+
+	// CheckFormToken returns ErrContactTooFast if the form was
+	// rendered less than ContactMinDelay before now, and
+	// ErrContactFormExpired if it was rendered more than
+	// ContactFormTTL ago or the token isn't one of ours.
+	CheckFormToken(token string, now time.Time) error
+}
+
+func NewContactService(db *gorm.DB, hmac hash.HMAC) ContactService {
+	return &contactService{
+		ContactDB: &contactValidator{
+			ContactDB: &contactGorm{db},
+			emailRegex: regexp.MustCompile(
+				`^[a-z0-9._%+\-]+@[a-z0-9.\-]+\.[a-z]{2,16}$`),
+		},
+		hmac: hmac,
+	}
+}
+
+//
+// Service
+//
+
+type contactService struct {
+	ContactDB
+	hmac hash.HMAC
+}
+
+// FormToken is the time in seconds followed by its HMAC, eg:
+// 1760000000.<hmac>
+func (cs *contactService) FormToken(now time.Time) string {
+	ts := strconv.FormatInt(now.Unix(), 10)
+	return ts + "." + cs.hmac.Hash(contactFormMessage(ts))
+}
+
+func (cs *contactService) CheckFormToken(token string, now time.Time) error {
+
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return ErrContactFormExpired
+	}
+
+	ts, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return ErrContactFormExpired
+	}
+
+	valid := false
+
+	// The token may have been signed with a previous HMAC key
+	for _, expected := range cs.hmac.HashAll(contactFormMessage(parts[0])) {
+		if subtle.ConstantTimeCompare([]byte(expected),
+			[]byte(parts[1])) == 1 {
+			valid = true
+		}
+	}
+
+	if !valid {
+		return ErrContactFormExpired
+	}
+
+	age := now.Sub(time.Unix(ts, 0))
+	switch {
+	case age < ContactMinDelay:
+		return ErrContactTooFast
+	case age > ContactFormTTL:
+		return ErrContactFormExpired
+	}
+
+	return nil
+}
+
+// contactFormMessage is what the contact form tokens are the HMAC of.
+func contactFormMessage(ts string) string {
+	return fmt.Sprintf("contact:%s", ts)
+}
+
+//
+// Gorm
+//
+
+type contactGorm struct {
+	db *gorm.DB
+}
+
+func (cg *contactGorm) ByID(id uint) (*ContactMessage, error) {
+
+	var m ContactMessage
+
+	if err := first(cg.db.Where("id = ?", id), &m); err != nil {
+		return nil, err
+	}
+
+	return &m, nil
+}
+
+func (cg *contactGorm) Create(m *ContactMessage) error {
+	return cg.db.Create(m).Error
+}
+
+//
+// Validators
+//
+
+type contactValidator struct {
+	ContactDB
+	emailRegex *regexp.Regexp
+}
+
+type contactValFn func(*ContactMessage) error
+
+func runContactValFns(m *ContactMessage, fns ...contactValFn) error {
+	for _, fn := range fns {
+		if err := fn(m); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (cv *contactValidator) normalize(m *ContactMessage) error {
+	m.Name = strings.TrimSpace(m.Name)
+	m.Email = normalizeEmail(m.Email)
+	m.Message = strings.TrimSpace(m.Message)
+	return nil
+}
+
+func (cv *contactValidator) nameRequired(m *ContactMessage) error {
+	if m.Name == "" {
+		return ErrContactNameRequired
+	}
+
+	if len(m.Name) > maxContactName {
+		return ErrContactNameTooLong
+	}
+
+	return nil
+}
+
+func (cv *contactValidator) emailValid(m *ContactMessage) error {
+	if m.Email == "" {
+		return ErrEmailRequired
+	}
+
+	if !cv.emailRegex.MatchString(m.Email) {
+		return ErrEmailInvalid
+	}
+
+	return nil
+}
+
+func (cv *contactValidator) messageRequired(m *ContactMessage) error {
+	if m.Message == "" {
+		return ErrContactMessageRequired
+	}
+
+	if len(m.Message) > maxContactMessage {
+		return ErrContactMessageTooLong
+	}
+
+	return nil
+}
+
+func (cv *contactValidator) truncateUserAgent(m *ContactMessage) error {
+	if len(m.UserAgent) > maxUserAgent {
+		m.UserAgent = strings.ToValidUTF8(m.UserAgent[:maxUserAgent],
+			"")
+	}
+
+	return nil
+}
+
+func (cv *contactValidator) Create(m *ContactMessage) error {
+
+	err := runContactValFns(m, cv.normalize,
+		cv.nameRequired,
+		cv.emailValid,
+		cv.messageRequired,
+		cv.truncateUserAgent)
+	if err != nil {
+		return err
+	}
+
+	return cv.ContactDB.Create(m)
+}
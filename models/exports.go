@@ -0,0 +1,768 @@
+package models
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"lenslockedbr.com/hash"
+	"lenslockedbr.com/rand"
+)
+
+const (
+	ExportPending = "pending"
+	ExportReady   = "ready"
+	ExportFailed  = "failed"
+
+	// ExportTTL is how long a finished export can be downloaded
+	// before it is deleted. Failed ones are kept as long, so users
+	// can't ask for a new export right away again and again.
+	ExportTTL = 48 * time.Hour
+
+	// exportLease is how long a claimed export is left to the
+	// worker building it before another one may claim it, in case
+	// the first one died.
+	exportLease = time.Hour
+
+	// ErrExportPending is returned when a user requests an export
+	// while a previous one is still being built.
+	ErrExportPending modelError = "models: your previous export is " +
+		"still being prepared"
+
+	exportsDir = "exports"
+)
+
+var _ ExportDB = &exportGorm{}
+
+// Export is a ZIP file with everything we hold on a user, built in the
+// background and downloadable through a link that expires. Pending
+// exports are built once ClaimableAt has passed, which is pushed back
+// while a worker is building them.
+type Export struct {
+	gorm.Model
+	UserID      uint   `gorm:"not null;index"`
+	Status      string `gorm:"not null"`
+	Filename    string
+	Token       string `gorm:"-"`
+	TokenHash   string `gorm:"index"`
+	ExpiresAt   *time.Time
+	ClaimableAt *time.Time
+}
+
+// Path is where the ZIP file of the export lives on disk.
+func (e *Export) Path() string {
+	return filepath.Join(exportsDir, e.Filename)
+}
+
+// ExportDB is used to interact with the exports database.
+//
+// For single export queries, if the export is not found ErrNotFound
+// is returned.
+type ExportDB interface {
+	ByToken(token string) (*Export, error)
+
+	// Claim returns the pending exports no other worker is
+	// building, and keeps other workers from claiming them until
+	// exportLease has passed.
+	Claim(now time.Time) ([]Export, error)
+
+	// Expired returns the ready and failed exports whose
+	// ExpiresAt has passed.
+	Expired(now time.Time) ([]Export, error)
+	PendingByUserID(userID uint) (*Export, error)
+
+	Create(e *Export) error
+	Update(e *Export) error
+	Delete(id uint) error
+}
+
+type ExportService interface {
+	ExportDB
+
+	// Request creates a new pending export for the user, unless
+	// one is already pending in which case ErrExportPending is
+	// returned.
+	Request(userID uint) (*Export, error)
+
+	// Ready marks an export as ready to be downloaded, setting a
+	// new download token on it and when it expires, and mails the
+	// token to the user.
+	Ready(e *Export, mail Mail) error
+
+	// Failed marks an export as failed, and mails the user about
+	// it. It expires like ready ones do.
+	Failed(e *Export, mail Mail) error
+}
+
+func NewExportService(db *gorm.DB, hmac hash.HMAC) ExportService {
+	return &exportService{
+		ExportDB: &exportValidator{
+			ExportDB: &exportGorm{db},
+			hmac:     hmac,
+		},
+		db:     db,
+		hmac:   hmac,
+		outbox: NewOutboxService(db),
+	}
+}
+
+//
+// Service
+//
+
+type exportService struct {
+	ExportDB
+	db     *gorm.DB
+	hmac   hash.HMAC
+	outbox OutboxService
+}
+
+func (es *exportService) Request(userID uint) (*Export, error) {
+
+	_, err := es.PendingByUserID(userID)
+	switch err {
+	case nil:
+		return nil, ErrExportPending
+	case ErrNotFound:
+	default:
+		return nil, err
+	}
+
+	e := Export{
+		UserID: userID,
+		Status: ExportPending,
+	}
+	if err := es.Create(&e); err != nil {
+		return nil, err
+	}
+
+	return &e, nil
+}
+
+func (es *exportService) Ready(e *Export, mail Mail) error {
+
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+
+	expiresAt := time.Now().Add(ExportTTL)
+
+	e.Status = ExportReady
+	e.Token = token
+	e.ExpiresAt = &expiresAt
+
+	return es.update(e, mail)
+}
+
+func (es *exportService) Failed(e *Export, mail Mail) error {
+
+	expiresAt := time.Now().Add(ExportTTL)
+
+	e.Status = ExportFailed
+	e.ExpiresAt = &expiresAt
+
+	return es.update(e, mail)
+}
+
+// update saves the export and mails the user about it within the
+// same transaction.
+func (es *exportService) update(e *Export, mail Mail) error {
+	return transaction(es.db, func(tx *gorm.DB) error {
+		edb := &exportValidator{
+			ExportDB: &exportGorm{tx},
+			hmac:     es.hmac,
+		}
+		if err := edb.Update(e); err != nil {
+			return err
+		}
+
+		return mail(e.Token, es.outbox.Sender(tx))
+	})
+}
+
+//
+// Gorm
+//
+
+type exportGorm struct {
+	db *gorm.DB
+}
+
+func (eg *exportGorm) ByToken(tokenHash string) (*Export, error) {
+
+	var e Export
+
+	err := first(eg.db.Where("token_hash = ?", tokenHash), &e)
+	if err != nil {
+		return nil, err
+	}
+
+	return &e, nil
+}
+
+// Claim works like outboxGorm.Claim: the exports are locked for the
+// duration of a transaction, skipping those another worker already
+// locked, and their ClaimableAt is pushed past the lease.
+func (eg *exportGorm) Claim(now time.Time) ([]Export, error) {
+
+	tx := eg.db.Begin()
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+
+	exports := make([]Export, 0)
+
+	db := tx.Set("gorm:query_option", "FOR UPDATE SKIP LOCKED").
+		Where("status = ? AND "+
+			"(claimable_at IS NULL OR claimable_at <= ?)",
+			ExportPending, now).
+		Order("id")
+	if err := all(db, &exports); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if len(exports) == 0 {
+		return exports, tx.Commit().Error
+	}
+
+	ids := make([]uint, 0, len(exports))
+	for _, e := range exports {
+		ids = append(ids, e.ID)
+	}
+
+	claimableAt := now.Add(exportLease)
+
+	err := tx.Model(&Export{}).Where("id IN (?)", ids).
+		UpdateColumn("claimable_at", claimableAt).Error
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	for i := range exports {
+		exports[i].ClaimableAt = &claimableAt
+	}
+
+	return exports, tx.Commit().Error
+}
+
+func (eg *exportGorm) Expired(now time.Time) ([]Export, error) {
+
+	exports := make([]Export, 0)
+
+	db := eg.db.Where("expires_at IS NOT NULL AND expires_at <= ?", now)
+	if err := all(db, &exports); err != nil {
+		return nil, err
+	}
+
+	return exports, nil
+}
+
+func (eg *exportGorm) PendingByUserID(userID uint) (*Export, error) {
+
+	var e Export
+
+	db := eg.db.Where("user_id = ? AND status = ?", userID,
+		ExportPending)
+	if err := first(db, &e); err != nil {
+		return nil, err
+	}
+
+	return &e, nil
+}
+
+func (eg *exportGorm) Create(e *Export) error {
+	return eg.db.Create(e).Error
+}
+
+func (eg *exportGorm) Update(e *Export) error {
+	return eg.db.Save(e).Error
+}
+
+func (eg *exportGorm) Delete(id uint) error {
+	e := Export{Model: gorm.Model{ID: id}}
+	return eg.db.Unscoped().Delete(&e).Error
+}
+
+//
+// Validators
+//
+
+type exportValidator struct {
+	ExportDB
+	hmac hash.HMAC
+}
+
+type exportValFn func(*Export) error
+
+func runExportValFns(e *Export, fns ...exportValFn) error {
+	for _, fn := range fns {
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (ev *exportValidator) userIDRequired(e *Export) error {
+	if e.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+
+	return nil
+}
+
+func (ev *exportValidator) hmacToken(e *Export) error {
+	if e.Token == "" {
+		return nil
+	}
+
+	e.TokenHash = ev.hmac.Hash(e.Token)
+
+	return nil
+}
+
+func (ev *exportValidator) ByToken(token string) (*Export, error) {
+
+	// The token may have been hashed with a previous HMAC key
+	for _, hashed := range ev.hmac.HashAll(token) {
+		found, err := ev.ExportDB.ByToken(hashed)
+		if err == ErrNotFound {
+			continue
+		}
+
+		return found, err
+	}
+
+	return nil, ErrNotFound
+}
+
+func (ev *exportValidator) Create(e *Export) error {
+
+	err := runExportValFns(e, ev.userIDRequired, ev.hmacToken)
+	if err != nil {
+		return err
+	}
+
+	return ev.ExportDB.Create(e)
+}
+
+func (ev *exportValidator) Update(e *Export) error {
+
+	err := runExportValFns(e, ev.userIDRequired, ev.hmacToken)
+	if err != nil {
+		return err
+	}
+
+	return ev.ExportDB.Update(e)
+}
+
+func (ev *exportValidator) Delete(id uint) error {
+
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+
+	return ev.ExportDB.Delete(id)
+}
+
+/////////////////////////////////////////////////////////////////////
+//
+// Building exports
+//
+/////////////////////////////////////////////////////////////////////
+
+// exportProfile is what ends up in profile.json. Secrets like the
+// password and remember token hashes are left out on purpose.
+type exportProfile struct {
+	ID              uint      `json:"id"`
+	Name            string    `json:"name"`
+	Age             int       `json:"age"`
+	Email           string    `json:"email"`
+	Username        string    `json:"username"`
+	Bio             string    `json:"bio"`
+	Locale          string    `json:"locale"`
+	NotifyFrequency string    `json:"notify_frequency"`
+	Avatar          []string  `json:"avatar"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+type exportIdentity struct {
+	Issuer    string    `json:"issuer"`
+	Subject   string    `json:"subject"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type exportComment struct {
+	ID        uint      `json:"id"`
+	GalleryID uint      `json:"gallery_id"`
+	Image     string    `json:"image,omitempty"`
+	ParentID  uint      `json:"parent_id,omitempty"`
+	Body      string    `json:"body"`
+	Hidden    bool      `json:"hidden"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type exportNotification struct {
+	Message   string     `json:"message"`
+	URL       string     `json:"url"`
+	ReadAt    *time.Time `json:"read_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+type exportNotificationPref struct {
+	Kind  string `json:"kind"`
+	Email bool   `json:"email"`
+}
+
+type exportContactMessage struct {
+	Name      string    `json:"name"`
+	Email     string    `json:"email"`
+	Message   string    `json:"message"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// exportFollows are the IDs of the users someone follows and of those
+// who follow them.
+type exportFollows struct {
+	Following []uint `json:"following"`
+	Followers []uint `json:"followers"`
+}
+
+type exportAuditEvent struct {
+	Action       string    `json:"action"`
+	Description  string    `json:"description"`
+	Impersonated bool      `json:"impersonated"`
+	TargetType   string    `json:"target_type,omitempty"`
+	TargetID     uint      `json:"target_id,omitempty"`
+	Detail       string    `json:"detail,omitempty"`
+	IP           string    `json:"ip"`
+	UserAgent    string    `json:"user_agent"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+type exportGallery struct {
+	ID        uint      `json:"id"`
+	Title     string    `json:"title"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Images    []string  `json:"images"`
+}
+
+// BuildExport writes the ZIP file for a pending export to disk and
+// sets its Filename. The archive contains profile.json, along with the
+// avatar under avatar/, galleries.json and the original images under
+// images/<gallery id>/, and a JSON file for each of identities,
+// comments, notifications, notification preferences, contact
+// messages, follows and the audit log of the account.
+func (s *Services) BuildExport(e *Export) error {
+
+	user, err := s.User.ByID(e.UserID)
+	if err != nil {
+		return err
+	}
+
+	galleries, err := s.Gallery.ByUserID(user.ID)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(exportsDir, 0700); err != nil {
+		return err
+	}
+
+	// The name is random so it can't be guessed from the ID
+	suffix, err := rand.String(12)
+	if err != nil {
+		return err
+	}
+	e.Filename = fmt.Sprintf("%d-%s.zip", e.ID, suffix)
+
+	f, err := os.OpenFile(e.Path(), os.O_WRONLY|os.O_CREATE|os.O_TRUNC,
+		0600)
+	if err != nil {
+		return err
+	}
+
+	err = s.writeExport(f, user, galleries)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		// Don't leave a half written file behind
+		os.Remove(e.Path())
+		e.Filename = ""
+		return err
+	}
+
+	return nil
+}
+
+func (s *Services) writeExport(w io.Writer, user *User, galleries []Gallery) error {
+
+	zw := zip.NewWriter(w)
+
+	profile := exportProfile{
+		ID:              user.ID,
+		Name:            user.Name,
+		Age:             user.Age,
+		Email:           user.Email,
+		Username:        user.Username,
+		Bio:             user.Bio,
+		Locale:          user.Locale,
+		NotifyFrequency: user.NotifyFrequency,
+		Avatar:          make([]string, 0),
+		CreatedAt:       user.CreatedAt,
+		UpdatedAt:       user.UpdatedAt,
+	}
+
+	if user.AvatarVersion != 0 {
+		for _, size := range AvatarSizes {
+			a := Avatar{UserID: user.ID, Size: size}
+			name := fmt.Sprintf("avatar/%d.jpg", size)
+			err := writeExportFile(zw, name, a.RelativePath())
+			if err != nil {
+				return err
+			}
+			profile.Avatar = append(profile.Avatar, name)
+		}
+	}
+
+	if err := writeExportJSON(zw, "profile.json", profile); err != nil {
+		return err
+	}
+
+	exportGalleries := make([]exportGallery, len(galleries))
+	for i, gallery := range galleries {
+		images, err := s.Image.ByGalleryID(gallery.ID)
+		if err != nil {
+			return err
+		}
+
+		eg := exportGallery{
+			ID:        gallery.ID,
+			Title:     gallery.Title,
+			CreatedAt: gallery.CreatedAt,
+			UpdatedAt: gallery.UpdatedAt,
+			Images:    make([]string, len(images)),
+		}
+
+		for j, img := range images {
+			name := fmt.Sprintf("images/%d/%s", gallery.ID,
+				img.Filename)
+			if err := writeExportFile(zw, name,
+				img.RelativePath()); err != nil {
+				return err
+			}
+			eg.Images[j] = name
+		}
+
+		exportGalleries[i] = eg
+	}
+
+	err := writeExportJSON(zw, "galleries.json", exportGalleries)
+	if err != nil {
+		return err
+	}
+
+	if err := s.writeExportAccount(zw, user); err != nil {
+		return err
+	}
+
+	return zw.Close()
+}
+
+// writeExportAccount writes everything else we hold on the user that
+// isn't their profile or galleries.
+func (s *Services) writeExportAccount(zw *zip.Writer, user *User) error {
+
+	var identities []Identity
+	var comments []Comment
+	var notifications []Notification
+	var prefs []NotificationPref
+	var messages []ContactMessage
+	var following, followers []Follow
+	var events []AuditEvent
+
+	byUser := s.db.Where("user_id = ?", user.ID).Order("id")
+
+	queries := []struct {
+		db  *gorm.DB
+		dst interface{}
+	}{
+		{byUser, &identities},
+		{byUser, &comments},
+		{byUser, &notifications},
+		{byUser, &prefs},
+		{byUser, &messages},
+		{s.db.Where("follower_id = ?", user.ID).Order("id"), &following},
+		{s.db.Where("followee_id = ?", user.ID).Order("id"), &followers},
+		{s.db.Where("user_id = ? OR actor_id = ?", user.ID, user.ID).
+			Order("id"), &events},
+	}
+	for _, q := range queries {
+		if err := q.db.Find(q.dst).Error; err != nil {
+			return err
+		}
+	}
+
+	files := make(map[string]interface{})
+
+	exportIdentities := make([]exportIdentity, len(identities))
+	for i, id := range identities {
+		exportIdentities[i] = exportIdentity{
+			Issuer:    id.Issuer,
+			Subject:   id.Subject,
+			Email:     id.Email,
+			CreatedAt: id.CreatedAt,
+		}
+	}
+	files["identities.json"] = exportIdentities
+
+	exportComments := make([]exportComment, len(comments))
+	for i, c := range comments {
+		exportComments[i] = exportComment{
+			ID:        c.ID,
+			GalleryID: c.GalleryID,
+			Image:     c.Image,
+			ParentID:  c.ParentID,
+			Body:      c.Body,
+			Hidden:    c.Hidden,
+			CreatedAt: c.CreatedAt,
+		}
+	}
+	files["comments.json"] = exportComments
+
+	exportNotifications := make([]exportNotification, len(notifications))
+	for i, n := range notifications {
+		exportNotifications[i] = exportNotification{
+			Message:   n.Message(),
+			URL:       n.URL,
+			ReadAt:    n.ReadAt,
+			CreatedAt: n.CreatedAt,
+		}
+	}
+	files["notifications.json"] = exportNotifications
+
+	exportPrefs := make([]exportNotificationPref, len(prefs))
+	for i, p := range prefs {
+		exportPrefs[i] = exportNotificationPref{
+			Kind:  p.Kind,
+			Email: p.Email,
+		}
+	}
+	files["notification_preferences.json"] = exportPrefs
+
+	exportMessages := make([]exportContactMessage, len(messages))
+	for i, m := range messages {
+		exportMessages[i] = exportContactMessage{
+			Name:      m.Name,
+			Email:     m.Email,
+			Message:   m.Message,
+			IP:        m.IP,
+			UserAgent: m.UserAgent,
+			CreatedAt: m.CreatedAt,
+		}
+	}
+	files["contact_messages.json"] = exportMessages
+
+	follows := exportFollows{
+		Following: make([]uint, len(following)),
+		Followers: make([]uint, len(followers)),
+	}
+	for i, f := range following {
+		follows.Following[i] = f.FolloweeID
+	}
+	for i, f := range followers {
+		follows.Followers[i] = f.FollowerID
+	}
+	files["follows.json"] = follows
+
+	exportEvents := make([]exportAuditEvent, len(events))
+	for i, e := range events {
+		exportEvents[i] = exportAuditEvent{
+			Action:       e.Action,
+			Description:  e.Description(),
+			Impersonated: e.Impersonated(),
+			TargetType:   e.TargetType,
+			TargetID:     e.TargetID,
+			Detail:       e.Detail,
+			IP:           e.IP,
+			UserAgent:    e.UserAgent,
+			CreatedAt:    e.CreatedAt,
+		}
+	}
+	files["audit_log.json"] = exportEvents
+
+	// Sorted, so every export lists its files in the same order
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := writeExportJSON(zw, name, files[name]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RemoveExport deletes the export along with its file on disk.
+func (s *Services) RemoveExport(e *Export) error {
+
+	if e.Filename != "" {
+		err := os.Remove(e.Path())
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return s.Export.Delete(e.ID)
+}
+
+func writeExportJSON(zw *zip.Writer, name string, v interface{}) error {
+
+	w, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(v)
+}
+
+func writeExportFile(zw *zip.Writer, name, path string) error {
+
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	w, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(w, src)
+	return err
+}
@@ -0,0 +1,157 @@
+package models
+
+import (
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// ErrFollowSelf is returned when a user tries to follow
+	// themselves.
+	ErrFollowSelf modelError = "models: you can't follow yourself"
+)
+
+var _ FollowDB = &followGorm{}
+
+// Follow is a user, the follower, following the public portfolio of
+// another, the followee. What the followee publishes shows up on the
+// feed of the follower.
+type Follow struct {
+	gorm.Model
+	FollowerID uint `gorm:"not null;unique_index:idx_follows_follower_followee"`
+	FolloweeID uint `gorm:"not null;unique_index:idx_follows_follower_followee;index"`
+}
+
+// FollowDB is used to interact with the follows database.
+type FollowDB interface {
+	// Exists returns true if the follower follows the followee.
+	Exists(followerID, followeeID uint) (bool, error)
+
+	// CountFollowers returns how many users follow the followee.
+	CountFollowers(followeeID uint) (int, error)
+
+	// Create makes the follower follow the followee. Following
+	// someone twice does nothing.
+	Create(f *Follow) error
+
+	// Delete stops the follower from following the followee.
+	Delete(followerID, followeeID uint) error
+}
+
+type FollowService interface {
+	FollowDB
+}
+
+func NewFollowService(db *gorm.DB) FollowService {
+	return &followService{
+		FollowDB: &followValidator{
+			FollowDB: &followGorm{db},
+		},
+	}
+}
+
+//
+// Service
+//
+
+type followService struct {
+	FollowDB
+}
+
+//
+// Gorm
+//
+
+type followGorm struct {
+	db *gorm.DB
+}
+
+func (fg *followGorm) Exists(followerID, followeeID uint) (bool, error) {
+
+	var count int
+
+	err := fg.db.Model(&Follow{}).
+		Where("follower_id = ? AND followee_id = ?", followerID,
+			followeeID).
+		Count(&count).Error
+	if err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+func (fg *followGorm) CountFollowers(followeeID uint) (int, error) {
+
+	var count int
+
+	err := fg.db.Model(&Follow{}).Where("followee_id = ?", followeeID).
+		Count(&count).Error
+
+	return count, err
+}
+
+func (fg *followGorm) Create(f *Follow) error {
+	return fg.db.Create(f).Error
+}
+
+func (fg *followGorm) Delete(followerID, followeeID uint) error {
+	return fg.db.Unscoped().
+		Where("follower_id = ? AND followee_id = ?", followerID,
+			followeeID).
+		Delete(&Follow{}).Error
+}
+
+//
+// Validators
+//
+
+type followValidator struct {
+	FollowDB
+}
+
+type followValFn func(*Follow) error
+
+func runFollowValFns(f *Follow, fns ...followValFn) error {
+	for _, fn := range fns {
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (fv *followValidator) idsRequired(f *Follow) error {
+	if f.FollowerID <= 0 || f.FolloweeID <= 0 {
+		return ErrUserIDRequired
+	}
+
+	return nil
+}
+
+func (fv *followValidator) notSelf(f *Follow) error {
+	if f.FollowerID == f.FolloweeID {
+		return ErrFollowSelf
+	}
+
+	return nil
+}
+
+func (fv *followValidator) Create(f *Follow) error {
+
+	err := runFollowValFns(f, fv.idsRequired,
+		fv.notSelf)
+	if err != nil {
+		return err
+	}
+
+	exists, err := fv.Exists(f.FollowerID, f.FolloweeID)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	return fv.FollowDB.Create(f)
+}
@@ -11,12 +11,19 @@ const (
 
 var _ GalleryDB = &galleryGorm{}
 
+// Gallery belongs to the user who created it, unless it has a
+// StudioID, in which case it belongs to the studio and UserID is only
+// the member who created it. Public galleries of users are listed on
+// their profile.
 type Gallery struct {
 	gorm.Model
 
-	UserID uint    `gorm:not_null;index`
-	Title  string  `gorm:not_null`
-	Images []Image `gorm:"-"`
+	UserID           uint    `gorm:not_null;index`
+	StudioID         uint    `gorm:"not null;default:0;index"`
+	Title            string  `gorm:not_null`
+	CommentsDisabled bool    `gorm:"not null;default:false"`
+	Public           bool    `gorm:"not null;default:false"`
+	Images           []Image `gorm:"-"`
 }
 
 func (g *Gallery) ImagesSplitN(n int) [][]Image {
@@ -54,25 +61,107 @@ type GalleryDB interface {
 	Delete(id uint) error
 
 	ByID(id uint) (*Gallery, error)
+
+	// ByUserID returns the user's own galleries, the ones that don't
+	// belong to a studio.
 	ByUserID(userID uint) ([]Gallery, error)
+	ByStudioID(studioID uint) ([]Gallery, error)
+
+	// PublicByUserID returns the user's own galleries that are
+	// public, the newest first.
+	PublicByUserID(userID uint) ([]Gallery, error)
 }
 
 type GalleryService interface {
 	GalleryDB
+
+	// Authorize returns ErrForbidden unless the user is allowed to
+	// do perm to the gallery.
+	Authorize(user *User, gallery *Gallery, perm Permission) error
+
+	// Allowed returns the most the user is allowed to do to the
+	// gallery. Users can do anything to their own galleries, what
+	// members can do to the galleries of a studio depends on their
+	// role, and so does what collaborators invited to the gallery
+	// can do. ErrForbidden is returned if they can't do anything.
+	Allowed(user *User, gallery *Gallery) (Permission, error)
 }
 
 type galleryService struct {
 	GalleryDB
+	studios       StudioDB
+	collaborators CollaboratorDB
 }
 
-func NewGalleryService(db *gorm.DB) GalleryService {
+func NewGalleryService(db *gorm.DB, studios StudioDB,
+	collaborators CollaboratorDB) GalleryService {
 	return &galleryService{
 		GalleryDB: &galleryValidator{
 			GalleryDB: &galleryGorm{
 				db: db,
 			},
 		},
+		studios:       studios,
+		collaborators: collaborators,
+	}
+}
+
+func (gs *galleryService) Authorize(user *User, gallery *Gallery, perm Permission) error {
+
+	allowed, err := gs.Allowed(user, gallery)
+	if err != nil {
+		return err
+	}
+
+	if perm > allowed {
+		return ErrForbidden
+	}
+
+	return nil
+}
+
+func (gs *galleryService) Allowed(user *User, gallery *Gallery) (Permission, error) {
+
+	if user == nil {
+		return permNone, ErrForbidden
+	}
+
+	allowed := permNone
+
+	if gallery.StudioID == 0 && gallery.UserID == user.ID {
+		return PermManage, nil
+	}
+
+	if gallery.StudioID != 0 {
+		m, err := gs.studios.Membership(gallery.StudioID, user.ID)
+		switch err {
+		case nil:
+			allowed = rolePermissions[m.Role]
+		case ErrNotFound:
+		default:
+			return permNone, err
+		}
+	}
+
+	// A new gallery has no collaborators yet
+	if gallery.ID != 0 {
+		c, err := gs.collaborators.Accepted(gallery.ID, user.ID)
+		switch err {
+		case nil:
+			if p := collaboratorPermissions[c.Role]; p > allowed {
+				allowed = p
+			}
+		case ErrNotFound:
+		default:
+			return permNone, err
+		}
+	}
+
+	if allowed == permNone {
+		return permNone, ErrForbidden
 	}
+
+	return allowed, nil
 }
 
 //
@@ -112,7 +201,34 @@ func (g *galleryGorm) ByUserID(userID uint) ([]Gallery, error) {
 
 	var galleries []Gallery
 
-	db := g.db.Where("user_id = ?", userID)
+	db := g.db.Where("user_id = ? AND studio_id = 0", userID)
+
+	if err := db.Find(&galleries).Error; err != nil {
+		return nil, err
+	}
+
+	return galleries, nil
+}
+
+func (g *galleryGorm) ByStudioID(studioID uint) ([]Gallery, error) {
+
+	var galleries []Gallery
+
+	db := g.db.Where("studio_id = ?", studioID)
+
+	if err := db.Find(&galleries).Error; err != nil {
+		return nil, err
+	}
+
+	return galleries, nil
+}
+
+func (g *galleryGorm) PublicByUserID(userID uint) ([]Gallery, error) {
+
+	var galleries []Gallery
+
+	db := g.db.Where("user_id = ? AND studio_id = 0 AND public", userID).
+		Order("created_at DESC")
 
 	if err := db.Find(&galleries).Error; err != nil {
 		return nil, err
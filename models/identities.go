@@ -0,0 +1,290 @@
+package models
+
+import (
+	"strings"
+
+	"github.com/jinzhu/gorm"
+
+	"lenslockedbr.com/rand"
+)
+
+const (
+	// ErrIdentityUnverified is returned when the provider doesn't
+	// vouch for the email address of an identity we have never seen
+	// before, so we can't tell which user it belongs to.
+	ErrIdentityUnverified modelError = "models: the email address of " +
+		"your account with the provider has not been verified"
+
+	// ErrIdentityTaken is returned when linking an identity that is
+	// already linked to a different user.
+	ErrIdentityTaken modelError = "models: that account is already " +
+		"linked to another user"
+
+	ErrIssuerRequired  modelError = "models: issuer is required"
+	ErrSubjectRequired modelError = "models: subject is required"
+)
+
+var _ IdentityDB = &identityGorm{}
+
+// Identity links a user to their account with an external OpenID
+// Connect provider. A user may have any number of identities on top
+// of their password.
+type Identity struct {
+	gorm.Model
+	UserID  uint   `gorm:"not null;index"`
+	Issuer  string `gorm:"not null;unique_index:idx_identities_issuer_subject"`
+	Subject string `gorm:"not null;unique_index:idx_identities_issuer_subject"`
+	Email   string
+}
+
+// ExternalIdentity is what an external provider tells us about the
+// user who signed in with it.
+type ExternalIdentity struct {
+	Issuer        string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+// IdentityDB is used to interact with the identities database.
+//
+// For single identity queries, if the identity is not found
+// ErrNotFound is returned.
+type IdentityDB interface {
+	BySubject(issuer, subject string) (*Identity, error)
+	ByUserID(userID uint) ([]Identity, error)
+
+	Create(identity *Identity) error
+	Delete(id uint) error
+}
+
+type IdentityService interface {
+	IdentityDB
+
+	// SignIn returns the user linked to the external identity.
+	// When the identity is new it is linked to the user with the
+	// same, verified, email address, and if there is none a new
+	// user is created for it.
+	SignIn(ext ExternalIdentity) (*User, error)
+
+	// Link links the external identity to the user, so they can
+	// use it to sign in. ErrIdentityTaken is returned if it is
+	// already linked to someone else.
+	Link(user *User, ext ExternalIdentity) error
+}
+
+func NewIdentityService(db *gorm.DB, us UserService) IdentityService {
+	return &identityService{
+		IdentityDB: &identityValidator{
+			IdentityDB: &identityGorm{db},
+		},
+		us: us,
+	}
+}
+
+//
+// Service
+//
+
+type identityService struct {
+	IdentityDB
+	us UserService
+}
+
+func (is *identityService) SignIn(ext ExternalIdentity) (*User, error) {
+
+	identity, err := is.BySubject(ext.Issuer, ext.Subject)
+	switch err {
+	case nil:
+		return is.us.ByID(identity.UserID)
+	case ErrNotFound:
+	default:
+		return nil, err
+	}
+
+	// Matching on an unverified address would let anyone with an
+	// account at the provider take over the user's account here.
+	if !ext.EmailVerified || ext.Email == "" {
+		return nil, ErrIdentityUnverified
+	}
+
+	user, err := is.us.ByEmail(ext.Email)
+	switch err {
+	case nil:
+	case ErrNotFound:
+		user, err = is.createUser(ext)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+
+	if err := is.Link(user, ext); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+func (is *identityService) Link(user *User, ext ExternalIdentity) error {
+
+	identity, err := is.BySubject(ext.Issuer, ext.Subject)
+	switch err {
+	case nil:
+		if identity.UserID != user.ID {
+			return ErrIdentityTaken
+		}
+		return nil
+	case ErrNotFound:
+	default:
+		return err
+	}
+
+	return is.Create(&Identity{
+		UserID:  user.ID,
+		Issuer:  ext.Issuer,
+		Subject: ext.Subject,
+		Email:   ext.Email,
+	})
+}
+
+// createUser creates the user for an identity we have never seen
+// before. They get a random password, which they can replace through
+// the password reset flow if they ever want to sign in with one.
+func (is *identityService) createUser(ext ExternalIdentity) (*User, error) {
+
+	password, err := rand.String(32)
+	if err != nil {
+		return nil, err
+	}
+
+	name := ext.Name
+	if name == "" {
+		name = strings.SplitN(ext.Email, "@", 2)[0]
+	}
+
+	user := User{
+		Name:     name,
+		Email:    ext.Email,
+		Password: password,
+	}
+	if err := is.us.Create(&user); err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+//
+// Gorm
+//
+
+type identityGorm struct {
+	db *gorm.DB
+}
+
+func (ig *identityGorm) BySubject(issuer, subject string) (*Identity, error) {
+
+	var identity Identity
+
+	db := ig.db.Where("issuer = ? AND subject = ?", issuer, subject)
+	if err := first(db, &identity); err != nil {
+		return nil, err
+	}
+
+	return &identity, nil
+}
+
+func (ig *identityGorm) ByUserID(userID uint) ([]Identity, error) {
+
+	identities := make([]Identity, 0)
+
+	err := all(ig.db.Where("user_id = ?", userID), &identities)
+	if err != nil {
+		return nil, err
+	}
+
+	return identities, nil
+}
+
+func (ig *identityGorm) Create(identity *Identity) error {
+	return ig.db.Create(identity).Error
+}
+
+func (ig *identityGorm) Delete(id uint) error {
+	identity := Identity{Model: gorm.Model{ID: id}}
+	return ig.db.Unscoped().Delete(&identity).Error
+}
+
+//
+// Validators
+//
+
+type identityValidator struct {
+	IdentityDB
+}
+
+type identityValFn func(*Identity) error
+
+func runIdentityValFns(identity *Identity, fns ...identityValFn) error {
+	for _, fn := range fns {
+		if err := fn(identity); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (iv *identityValidator) userIDRequired(identity *Identity) error {
+	if identity.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+
+	return nil
+}
+
+func (iv *identityValidator) issuerRequired(identity *Identity) error {
+	if identity.Issuer == "" {
+		return ErrIssuerRequired
+	}
+
+	return nil
+}
+
+func (iv *identityValidator) subjectRequired(identity *Identity) error {
+	if identity.Subject == "" {
+		return ErrSubjectRequired
+	}
+
+	return nil
+}
+
+func (iv *identityValidator) normalizeEmail(identity *Identity) error {
+	identity.Email = strings.ToLower(strings.TrimSpace(identity.Email))
+	return nil
+}
+
+func (iv *identityValidator) Create(identity *Identity) error {
+
+	err := runIdentityValFns(identity, iv.userIDRequired,
+		iv.issuerRequired,
+		iv.subjectRequired,
+		iv.normalizeEmail)
+	if err != nil {
+		return err
+	}
+
+	return iv.IdentityDB.Create(identity)
+}
+
+func (iv *identityValidator) Delete(id uint) error {
+
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+
+	return iv.IdentityDB.Delete(id)
+}
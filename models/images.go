@@ -5,6 +5,7 @@ import (
 	"io"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 )
 
@@ -28,86 +29,90 @@ func (i *Image) Path() string {
 // RelativePath is used to build the path to this image on our local
 // disk, relative to where our Go application is run from.
 func (i *Image) RelativePath() string {
-	// Convert the gallery ID to a string
-	galleryID := fmt.Sprintf("%v", i.GalleryID)
+	return filepath.ToSlash(filepath.Join(imagesDir, i.storePath()))
+}
 
-	return filepath.ToSlash(filepath.Join("images",
-		"galleries",
-		galleryID,
-		i.Filename))
+// storePath is the path of the image in the FileStore.
+func (i *Image) storePath() string {
+	return path.Join(galleryDir(i.GalleryID), i.Filename)
 }
 
 type ImageService interface {
 	Create(galleryID uint, r io.Reader, filename string) error
 	ByGalleryID(galleryID uint) ([]Image, error)
 	Delete(i *Image) error
+	DeleteAll(galleryID uint) error
+
+	// Usage returns how many bytes the images of a gallery take
+	// on disk.
+	Usage(galleryID uint) (int64, error)
 }
 
-func NewImageService() ImageService {
-	return &imageService{}
+func NewImageService(files FileStore) ImageService {
+	return &imageService{files: files}
 }
 
-type imageService struct{}
+type imageService struct {
+	files FileStore
+}
 
 func (is *imageService) Create(galleryID uint, r io.Reader, filename string) error {
+	i := Image{GalleryID: galleryID, Filename: filename}
+	return is.files.Write(i.storePath(), r)
+}
 
-	path, err := is.mkImagePath(galleryID)
-	if err != nil {
-		return err
-	}
+func (is *imageService) Delete(i *Image) error {
+	return is.files.Remove(i.storePath())
+}
 
-	// Create a destination file
-	dst, err := os.Create(filepath.Join(path, filename))
-	if err != nil {
-		return err
-	}
-	defer dst.Close()
+// DeleteAll removes every image of a gallery from disk.
+func (is *imageService) DeleteAll(galleryID uint) error {
+	return is.files.RemoveAll(galleryDir(galleryID))
+}
 
-	// Copy uploaded file data to the destination file
-	_, err = io.Copy(dst, r)
+func (is *imageService) Usage(galleryID uint) (int64, error) {
+
+	images, err := is.ByGalleryID(galleryID)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	return nil
-}
+	var total int64
+	for _, img := range images {
+		size, err := is.files.Size(img.storePath())
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return 0, err
+		}
+		total += size
+	}
 
-func (is *imageService) Delete(i *Image) error {
-	return os.Remove(i.RelativePath())
+	return total, nil
 }
 
 func (is *imageService) ByGalleryID(galleryID uint) ([]Image, error) {
 
-	path := is.imagePath(galleryID)
-	strings, err := filepath.Glob(filepath.Join(path, "*"))
+	names, err := is.files.List(galleryDir(galleryID))
 	if err != nil {
 		return nil, err
 	}
 
 	// Setup the Image slice we are returning
-	ret := make([]Image, len(strings))
-	for i, imgStr := range strings {
+	ret := make([]Image, len(names))
+	for i, name := range names {
 		ret[i] = Image{
 			GalleryID: galleryID,
-			Filename:  filepath.Base(imgStr),
+			Filename:  name,
 		}
 	}
 
 	return ret, nil
 }
 
-func (is *imageService) mkImagePath(galleryID uint) (string, error) {
-
-	galleryPath := is.imagePath(galleryID)
-	err := os.MkdirAll(galleryPath, 0755)
-	if err != nil {
-		return "", err
-	}
-
-	return galleryPath, nil
-}
-
-func (is *imageService) imagePath(galleryID uint) string {
-	return filepath.Join("images", "galleries",
-		fmt.Sprintf("%v", galleryID))
+// galleryDir is the directory of the FileStore with the images of the
+// gallery.
+func galleryDir(galleryID uint) string {
+	return path.Join("galleries", fmt.Sprintf("%v", galleryID))
 }
@@ -0,0 +1,260 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"lenslockedbr.com/hash"
+	"lenslockedbr.com/rand"
+)
+
+const (
+	// ImpersonationTTL is how long an admin can act as a user
+	// before they have to start impersonating them again.
+	ImpersonationTTL = time.Hour
+
+	// ErrNotAdmin is returned when someone who isn't an admin
+	// tries to do something only admins are allowed to.
+	ErrNotAdmin modelError = "models: you must be an admin to do that"
+
+	// ErrImpersonateAdmin is returned when an admin tries to
+	// impersonate another admin, or themselves.
+	ErrImpersonateAdmin modelError = "models: admins can't be " +
+		"impersonated"
+)
+
+var _ ImpersonationDB = &impersonationGorm{}
+
+// Impersonation is an admin acting as a user, eg: to see what they see
+// when helping them. Every impersonation is kept, as the trail of who
+// acted as whom and when.
+type Impersonation struct {
+	gorm.Model
+	AdminID   uint   `gorm:"not null;index"`
+	UserID    uint   `gorm:"not null;index"`
+	IP        string `gorm:"not null;default:''"`
+	Token     string `gorm:"-"`
+	TokenHash string `gorm:"not null;unique_index"`
+	ExpiresAt time.Time
+	EndedAt   *time.Time
+}
+
+// Active returns true if the impersonation has neither been stopped
+// nor expired.
+func (i *Impersonation) Active(now time.Time) bool {
+	return i.EndedAt == nil && now.Before(i.ExpiresAt)
+}
+
+// ImpersonationDB is used to interact with the impersonations database.
+//
+// For single impersonation queries, if the impersonation is not found
+// ErrNotFound is returned.
+type ImpersonationDB interface {
+	ByToken(token string) (*Impersonation, error)
+	ByUserID(userID uint) ([]Impersonation, error)
+
+	Create(i *Impersonation) error
+	Update(i *Impersonation) error
+}
+
+type ImpersonationService interface {
+	ImpersonationDB
+
+	// Start lets the admin act as the user. The token of the
+	// returned impersonation identifies it in the admin's session.
+	Start(admin, user *User, ip string) (*Impersonation, error)
+
+	// Active returns the impersonation that the token matches, or
+	// ErrNotFound if it was stopped or has expired.
+	Active(token string) (*Impersonation, error)
+
+	// Stop ends the impersonation.
+	Stop(i *Impersonation) error
+}
+
+func NewImpersonationService(db *gorm.DB, hmac hash.HMAC) ImpersonationService {
+	return &impersonationService{
+		ImpersonationDB: &impersonationValidator{
+			ImpersonationDB: &impersonationGorm{db},
+			hmac:            hmac,
+		},
+	}
+}
+
+//
+// Service
+//
+
+type impersonationService struct {
+	ImpersonationDB
+}
+
+func (is *impersonationService) Start(admin, user *User, ip string) (*Impersonation, error) {
+
+	if !admin.IsAdmin() {
+		return nil, ErrNotAdmin
+	}
+
+	if user.IsAdmin() || user.ID == admin.ID {
+		return nil, ErrImpersonateAdmin
+	}
+
+	token, err := rand.RememberToken()
+	if err != nil {
+		return nil, err
+	}
+
+	i := Impersonation{
+		AdminID:   admin.ID,
+		UserID:    user.ID,
+		IP:        ip,
+		Token:     token,
+		ExpiresAt: time.Now().Add(ImpersonationTTL),
+	}
+	if err := is.Create(&i); err != nil {
+		return nil, err
+	}
+
+	return &i, nil
+}
+
+func (is *impersonationService) Active(token string) (*Impersonation, error) {
+
+	i, err := is.ByToken(token)
+	if err != nil {
+		return nil, err
+	}
+
+	if !i.Active(time.Now()) {
+		return nil, ErrNotFound
+	}
+
+	return i, nil
+}
+
+func (is *impersonationService) Stop(i *Impersonation) error {
+
+	if i.EndedAt != nil {
+		return nil
+	}
+
+	now := time.Now()
+	i.EndedAt = &now
+
+	return is.Update(i)
+}
+
+//
+// Gorm
+//
+
+type impersonationGorm struct {
+	db *gorm.DB
+}
+
+func (ig *impersonationGorm) ByToken(tokenHash string) (*Impersonation, error) {
+
+	var i Impersonation
+
+	err := first(ig.db.Where("token_hash = ?", tokenHash), &i)
+	if err != nil {
+		return nil, err
+	}
+
+	return &i, nil
+}
+
+func (ig *impersonationGorm) ByUserID(userID uint) ([]Impersonation, error) {
+
+	impersonations := make([]Impersonation, 0)
+
+	db := ig.db.Where("user_id = ?", userID).Order("created_at DESC")
+	if err := all(db, &impersonations); err != nil {
+		return nil, err
+	}
+
+	return impersonations, nil
+}
+
+func (ig *impersonationGorm) Create(i *Impersonation) error {
+	return ig.db.Create(i).Error
+}
+
+func (ig *impersonationGorm) Update(i *Impersonation) error {
+	return ig.db.Save(i).Error
+}
+
+//
+// Validators
+//
+
+type impersonationValidator struct {
+	ImpersonationDB
+	hmac hash.HMAC
+}
+
+type impersonationValFn func(*Impersonation) error
+
+func runImpersonationValFns(i *Impersonation, fns ...impersonationValFn) error {
+	for _, fn := range fns {
+		if err := fn(i); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (iv *impersonationValidator) idsRequired(i *Impersonation) error {
+	if i.AdminID <= 0 || i.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+
+	return nil
+}
+
+func (iv *impersonationValidator) hmacToken(i *Impersonation) error {
+	if i.Token == "" {
+		return nil
+	}
+
+	i.TokenHash = iv.hmac.Hash(i.Token)
+
+	return nil
+}
+
+func (iv *impersonationValidator) ByToken(token string) (*Impersonation, error) {
+
+	// The token may have been hashed with a previous HMAC key
+	for _, hashed := range iv.hmac.HashAll(token) {
+		found, err := iv.ImpersonationDB.ByToken(hashed)
+		if err == ErrNotFound {
+			continue
+		}
+
+		return found, err
+	}
+
+	return nil, ErrNotFound
+}
+
+func (iv *impersonationValidator) Create(i *Impersonation) error {
+
+	err := runImpersonationValFns(i, iv.idsRequired, iv.hmacToken)
+	if err != nil {
+		return err
+	}
+
+	return iv.ImpersonationDB.Create(i)
+}
+
+func (iv *impersonationValidator) Update(i *Impersonation) error {
+
+	err := runImpersonationValFns(i, iv.idsRequired, iv.hmacToken)
+	if err != nil {
+		return err
+	}
+
+	return iv.ImpersonationDB.Update(i)
+}
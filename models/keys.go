@@ -0,0 +1,82 @@
+package models
+
+// KeyUsage counts, for each table that stores values derived from the
+// pepper or the HMAC key, how many records still use a previous key.
+// Once every count is zero the previous keys can be dropped from the
+// config.
+type KeyUsage struct {
+	CurrentPepperID  string
+	CurrentHMACKeyID string
+
+	// Counts by description, eg: "users.password_hash"
+	Stale map[string]int
+}
+
+// Total returns the number of records that still use a previous key.
+func (ku *KeyUsage) Total() int {
+	var n int
+	for _, c := range ku.Stale {
+		n += c
+	}
+
+	return n
+}
+
+// KeyUsage reports how many records still use a previous pepper or
+// HMAC key. Passwords are only re-hashed when their owner signs in,
+// and remember tokens when they are used, so this tells us when it is
+// safe to drop a previous key.
+func (s *Services) KeyUsage() (*KeyUsage, error) {
+
+	ku := KeyUsage{
+		CurrentPepperID:  s.peppers.Current().ID,
+		CurrentHMACKeyID: s.hmac.CurrentKeyID(),
+		Stale:            make(map[string]int),
+	}
+
+	var n int
+	err := s.db.Model(&User{}).Where("pepper_id <> ?",
+		ku.CurrentPepperID).Count(&n).Error
+	if err != nil {
+		return nil, err
+	}
+	ku.Stale["users.password_hash"] = n
+
+	hmacTables := []struct {
+		name   string
+		model  interface{}
+		column string
+	}{
+		{"users", &User{}, "remember_hash"},
+		{"pw_resets", &pwReset{}, "token_hash"},
+		{"email_changes", &emailChange{}, "token_hash"},
+		{"exports", &Export{}, "token_hash"},
+		{"login_links", &loginLink{}, "token_hash"},
+		{"impersonations", &Impersonation{}, "token_hash"},
+		{"collaborators", &Collaborator{}, "token_hash"},
+	}
+
+	for _, t := range hmacTables {
+		var n int
+		query, arg := staleHMACWhere(t.column, ku.CurrentHMACKeyID)
+		err := s.db.Model(t.model).Where(query, arg).Count(&n).Error
+		if err != nil {
+			return nil, err
+		}
+		ku.Stale[t.name+"."+t.column] = n
+	}
+
+	return &ku, nil
+}
+
+// staleHMACWhere builds the condition matching the hashes that were not
+// generated by the current HMAC key, see hash.KeyID.
+func staleHMACWhere(column, currentID string) (string, interface{}) {
+	if currentID == "" {
+		// Hashes made with a key without ID have no prefix
+		return column + " LIKE ?", "%:%"
+	}
+
+	return "(" + column + " <> '' AND " + column + " NOT LIKE ?)",
+		currentID + ":%"
+}
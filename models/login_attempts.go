@@ -0,0 +1,275 @@
+package models
+
+import (
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// ErrLoginThrottled is returned when too many failed login
+	// attempts were made for an account or from an IP address and
+	// the caller has to wait before trying again.
+	ErrLoginThrottled modelError = "models: too many failed login " +
+		"attempts, please try again later"
+
+	// loginFreeAttempts is the number of failed attempts allowed
+	// before we start to back off.
+	loginFreeAttempts = 3
+
+	// loginLockoutAttempts is the number of failed attempts after
+	// which the account (or IP address) is temporarily locked.
+	loginLockoutAttempts = 10
+
+	// loginMaxBackoff caps the exponential backoff applied between
+	// loginFreeAttempts and loginLockoutAttempts.
+	loginMaxBackoff = 5 * time.Minute
+
+	// LoginLockoutDuration is how long a lockout lasts.
+	LoginLockoutDuration = 30 * time.Minute
+
+	// loginAttemptWindow is how long failed attempts are remembered
+	// after the last one happened.
+	loginAttemptWindow = 24 * time.Hour
+)
+
+/////////////////////////////////////////////////////////////////////
+//
+// Model loginAttempt structures and methods
+//
+/////////////////////////////////////////////////////////////////////
+
+// loginAttempt keeps track of the failed login attempts for a single
+// key, which is either an email address or an IP address.
+type loginAttempt struct {
+	gorm.Model
+	Key         string `gorm:"not null;unique_index"`
+	Failures    int    `gorm:"not null"`
+	LockedUntil time.Time
+}
+
+// LoginAttemptService is used to throttle login attempts per account
+// and per IP address.
+type LoginAttemptService interface {
+
+	// Allow will return ErrLoginThrottled if either the email
+	// address or the IP address provided is currently backing off
+	// or locked out. Otherwise it returns nil.
+	Allow(email, ip string) error
+
+	// Failed records a failed login attempt for both the email
+	// address and the IP address. The returned bool is true only
+	// when this attempt caused the account to become locked, so
+	// that the account owner can be notified once.
+	Failed(email, ip string) (bool, error)
+
+	// Succeeded forgets the failed attempts for the email address
+	// provided. Those for the IP address are left to expire after
+	// loginAttemptWindow, otherwise signing in to an account of
+	// their own would let attackers reset the backoff of their IP
+	// address between guesses at other accounts.
+	Succeeded(email string) error
+}
+
+type loginAttemptDB interface {
+	ByKey(key string) (*loginAttempt, error)
+	Create(la *loginAttempt) error
+	Update(la *loginAttempt) error
+	Delete(id uint) error
+}
+
+func NewLoginAttemptService(db *gorm.DB) LoginAttemptService {
+	return &loginAttemptService{
+		loginAttemptDB: &loginAttemptValidator{
+			loginAttemptDB: &loginAttemptGorm{db},
+		},
+	}
+}
+
+//
+// Service
+//
+
+type loginAttemptService struct {
+	loginAttemptDB
+}
+
+func (las *loginAttemptService) Allow(email, ip string) error {
+
+	for _, key := range loginAttemptKeys(email, ip) {
+		la, err := las.ByKey(key)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if time.Now().Before(la.LockedUntil) {
+			return ErrLoginThrottled
+		}
+	}
+
+	return nil
+}
+
+func (las *loginAttemptService) Failed(email, ip string) (bool, error) {
+
+	var locked bool
+
+	for _, key := range loginAttemptKeys(email, ip) {
+		la, err := las.ByKey(key)
+		switch err {
+		case nil:
+		case ErrNotFound:
+			la = &loginAttempt{Key: key}
+		default:
+			return false, err
+		}
+
+		if time.Since(la.UpdatedAt) > loginAttemptWindow {
+			la.Failures = 0
+		}
+
+		la.Failures++
+		la.LockedUntil = time.Now().Add(loginBackoff(la.Failures))
+
+		if la.ID == 0 {
+			err = las.Create(la)
+		} else {
+			err = las.Update(la)
+		}
+		if err != nil {
+			return false, err
+		}
+
+		if strings.HasPrefix(key, "email:") &&
+			la.Failures == loginLockoutAttempts {
+			locked = true
+		}
+	}
+
+	return locked, nil
+}
+
+func (las *loginAttemptService) Succeeded(email string) error {
+
+	for _, key := range loginAttemptKeys(email, "") {
+		la, err := las.ByKey(key)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := las.Delete(la.ID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//
+// Gorm
+//
+
+type loginAttemptGorm struct {
+	db *gorm.DB
+}
+
+func (lag *loginAttemptGorm) ByKey(key string) (*loginAttempt, error) {
+
+	var la loginAttempt
+
+	err := first(lag.db.Where("key = ?", key), &la)
+	if err != nil {
+		return nil, err
+	}
+
+	return &la, nil
+}
+
+func (lag *loginAttemptGorm) Create(la *loginAttempt) error {
+	return lag.db.Create(la).Error
+}
+
+func (lag *loginAttemptGorm) Update(la *loginAttempt) error {
+	return lag.db.Save(la).Error
+}
+
+// Delete removes the record for good, otherwise the unique index on
+// key would prevent us from tracking the same key again later.
+func (lag *loginAttemptGorm) Delete(id uint) error {
+
+	la := loginAttempt{
+		Model: gorm.Model{ID: id},
+	}
+
+	return lag.db.Unscoped().Delete(&la).Error
+}
+
+//
+// Validators
+//
+
+type loginAttemptValidator struct {
+	loginAttemptDB
+}
+
+func (lav *loginAttemptValidator) Delete(id uint) error {
+
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+
+	return lav.loginAttemptDB.Delete(id)
+}
+
+/////////////////////////////////////////////////////////////////////
+//
+// Helper Functions
+//
+/////////////////////////////////////////////////////////////////////
+
+// loginAttemptKeys builds the keys used to track an email address and
+// an IP address. Emails are normalized the same way userValidator
+// does so that "Foo@Bar.com" and "foo@bar.com" share a counter.
+func loginAttemptKeys(email, ip string) []string {
+
+	keys := make([]string, 0, 2)
+
+	email = strings.TrimSpace(strings.ToLower(email))
+	if email != "" {
+		keys = append(keys, "email:"+email)
+	}
+
+	if ip != "" {
+		keys = append(keys, "ip:"+ip)
+	}
+
+	return keys
+}
+
+// loginBackoff returns how long we should wait before accepting
+// another attempt after n failures. The first few failures are free,
+// then the wait doubles with each failure until the lockout kicks in.
+func loginBackoff(n int) time.Duration {
+
+	if n >= loginLockoutAttempts {
+		return LoginLockoutDuration
+	}
+
+	if n <= loginFreeAttempts {
+		return 0
+	}
+
+	d := time.Second << uint(n-loginFreeAttempts)
+	if d > loginMaxBackoff {
+		return loginMaxBackoff
+	}
+
+	return d
+}
@@ -0,0 +1,529 @@
+package models
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"lenslockedbr.com/email"
+
+	"lenslockedbr.com/hash"
+)
+
+const (
+	// NotifyInviteAccepted is sent to the owner of a gallery when
+	// someone accepts their invitation to it.
+	NotifyInviteAccepted = "invite.accepted"
+
+	// NotifyStudioAdded is sent to a user who was added to a studio.
+	NotifyStudioAdded = "studio.added"
+
+	// NotifyComment is sent to the owner of a gallery when someone
+	// comments on it.
+	NotifyComment = "comment.created"
+
+	// NotifyAll stands for every kind of notification, eg: to
+	// unsubscribe from all of them at once.
+	NotifyAll = "all"
+
+	// NotifyInstant users are emailed each notification as it
+	// happens.
+	NotifyInstant = "instant"
+
+	// NotifyDaily users are emailed a digest of their notifications
+	// at most once a day.
+	NotifyDaily = "daily"
+
+	// NotificationLimit is the maximum number of notifications
+	// returned by a single query.
+	NotificationLimit = 50
+
+	ErrNotificationKindInvalid modelError = "models: unknown kind " +
+		"of notification"
+
+	ErrNotifyFrequencyInvalid modelError = "models: notifications " +
+		"must be emailed instantly or daily"
+)
+
+// notificationDescriptions are how the kinds of notifications are
+// described to people, eg: on their preferences.
+var notificationDescriptions = map[string]string{
+	NotifyInviteAccepted: "Someone accepts your invitation to a gallery",
+	NotifyStudioAdded:    "You are added to a studio",
+	NotifyComment:        "Someone comments on one of your galleries",
+}
+
+// NotificationKinds lists every kind of notification.
+var NotificationKinds = []string{
+	NotifyInviteAccepted, NotifyStudioAdded, NotifyComment,
+}
+
+// NotifyFrequencies lists how often notifications can be emailed.
+var NotifyFrequencies = []string{NotifyInstant, NotifyDaily}
+
+// NotificationDescription describes the kind of notification.
+func NotificationDescription(kind string) string {
+	if desc, ok := notificationDescriptions[kind]; ok {
+		return desc
+	}
+
+	return kind
+}
+
+var _ NotificationDB = &notificationGorm{}
+
+// Notification tells a user that something happened that concerns
+// them. Actor is who did it and Subject what it is about, eg: the
+// title of a gallery. They are kept apart so emails can phrase the
+// notification in the language of the user.
+//
+// EmailPending is true while the notification waits to be emailed in
+// the next digest of the user.
+type Notification struct {
+	gorm.Model
+	UserID       uint   `gorm:"not null;index"`
+	Kind         string `gorm:"not null"`
+	Actor        string `gorm:"not null;default:''"`
+	Subject      string `gorm:"not null;default:''"`
+	URL          string `gorm:"not null;default:''"`
+	ReadAt       *time.Time
+	EmailPending bool `gorm:"not null;default:false;index"`
+}
+
+// Message describes the notification to people.
+func (n *Notification) Message() string {
+	switch n.Kind {
+	case NotifyInviteAccepted:
+		return fmt.Sprintf("%s accepted your invitation to %s",
+			n.Actor, n.Subject)
+	case NotifyStudioAdded:
+		return fmt.Sprintf("%s added you to the studio %s",
+			n.Actor, n.Subject)
+	case NotifyComment:
+		return fmt.Sprintf("%s commented on %s", n.Actor, n.Subject)
+	default:
+		return n.Subject
+	}
+}
+
+// Unread returns true if the user hasn't seen the notification yet.
+func (n *Notification) Unread() bool {
+	return n.ReadAt == nil
+}
+
+// NotificationPref is whether a user wants to be emailed a kind of
+// notification. Users without one are emailed every kind.
+type NotificationPref struct {
+	gorm.Model
+	UserID uint   `gorm:"not null;unique_index:idx_notification_prefs_user_kind"`
+	Kind   string `gorm:"not null;unique_index:idx_notification_prefs_user_kind"`
+	Email  bool   `gorm:"not null"`
+}
+
+// NotificationDB is used to interact with the notifications and
+// notification preferences databases.
+//
+// For single notification queries, if the notification is not found
+// ErrNotFound is returned.
+type NotificationDB interface {
+	ByID(id uint) (*Notification, error)
+
+	// ByUserID returns the latest notifications of the user, the
+	// newest first.
+	ByUserID(userID uint) ([]Notification, error)
+
+	// Unread returns up to limit notifications the user hasn't
+	// read, the newest first.
+	Unread(userID uint, limit int) ([]Notification, error)
+
+	// MarkRead marks every notification of the user as read.
+	MarkRead(userID uint) error
+
+	// PendingDigests returns the ids of the users who have had a
+	// notification waiting to be emailed since before the time.
+	PendingDigests(before time.Time) ([]uint, error)
+
+	// ClaimDigest locks the notifications waiting to be emailed to
+	// the user, skipping those another worker already locked, and
+	// marks them as emailed. It is only meant to be run within the
+	// transaction the digest is queued in, see SendDigest.
+	ClaimDigest(userID uint) ([]Notification, error)
+
+	Create(n *Notification) error
+
+	Prefs(userID uint) ([]NotificationPref, error)
+	SavePref(p *NotificationPref) error
+}
+
+type NotificationService interface {
+	NotificationDB
+
+	// Notify creates a notification for the user. It returns true
+	// if it should be emailed right away, otherwise it is either
+	// left for the next digest or not emailed at all, according to
+	// the preferences of the user.
+	Notify(user *User, n *Notification) (bool, error)
+
+	// EmailPrefs returns, for every kind of notification, whether
+	// the user wants to be emailed it.
+	EmailPrefs(userID uint) (map[string]bool, error)
+
+	// SetEmailPref sets whether the user wants to be emailed the
+	// kind of notification, or every kind with NotifyAll.
+	SetEmailPref(userID uint, kind string, email bool) error
+
+	// UnsubscribeToken returns the token of the unsubscribe links
+	// in the emails of the kind of notification sent to the user.
+	UnsubscribeToken(userID uint, kind string) string
+
+	// Unsubscribe stops emailing the kind of notification to the
+	// user, if the token is the one of the link they followed.
+	// ErrTokenInvalid is returned if it isn't.
+	Unsubscribe(userID uint, kind, token string) error
+
+	// SendDigest claims the notifications waiting to be emailed to
+	// the user and queues their digest with mail, in the same
+	// transaction, so they are marked as emailed only if it is
+	// queued and no other worker sends them again. Nothing is
+	// mailed if there are none left to claim.
+	SendDigest(userID uint, mail DigestMail) error
+}
+
+// DigestMail queues the digest of the notifications, with the token of
+// its unsubscribe link, through the sender. See Mail.
+type DigestMail func(notifications []Notification, token string,
+	sender email.Sender) error
+
+func NewNotificationService(db *gorm.DB, hmac hash.HMAC) NotificationService {
+	return &notificationService{
+		NotificationDB: &notificationValidator{
+			NotificationDB: &notificationGorm{db},
+		},
+		db:     db,
+		hmac:   hmac,
+		outbox: NewOutboxService(db),
+	}
+}
+
+//
+// Service
+//
+
+type notificationService struct {
+	NotificationDB
+	db     *gorm.DB
+	hmac   hash.HMAC
+	outbox OutboxService
+}
+
+func (ns *notificationService) Notify(user *User, n *Notification) (bool, error) {
+
+	prefs, err := ns.EmailPrefs(user.ID)
+	if err != nil {
+		return false, err
+	}
+
+	email := prefs[n.Kind]
+	digest := user.NotifyFrequency == NotifyDaily
+
+	n.UserID = user.ID
+	n.EmailPending = email && digest
+
+	if err := ns.Create(n); err != nil {
+		return false, err
+	}
+
+	return email && !digest, nil
+}
+
+func (ns *notificationService) EmailPrefs(userID uint) (map[string]bool, error) {
+
+	prefs := make(map[string]bool, len(NotificationKinds))
+	for _, kind := range NotificationKinds {
+		prefs[kind] = true
+	}
+
+	saved, err := ns.Prefs(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range saved {
+		prefs[p.Kind] = p.Email
+	}
+
+	return prefs, nil
+}
+
+func (ns *notificationService) SetEmailPref(userID uint, kind string,
+	email bool) error {
+
+	kinds := []string{kind}
+	if kind == NotifyAll {
+		kinds = NotificationKinds
+	}
+
+	for _, kind := range kinds {
+		err := ns.SavePref(&NotificationPref{
+			UserID: userID,
+			Kind:   kind,
+			Email:  email,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (ns *notificationService) UnsubscribeToken(userID uint, kind string) string {
+	return ns.hmac.Hash(unsubscribeMessage(userID, kind))
+}
+
+func (ns *notificationService) Unsubscribe(userID uint, kind, token string) error {
+
+	valid := false
+
+	// The token may have been signed with a previous HMAC key
+	for _, expected := range ns.hmac.HashAll(unsubscribeMessage(userID,
+		kind)) {
+		if subtle.ConstantTimeCompare([]byte(expected),
+			[]byte(token)) == 1 {
+			valid = true
+		}
+	}
+
+	if !valid {
+		return ErrTokenInvalid
+	}
+
+	return ns.SetEmailPref(userID, kind, false)
+}
+
+func (ns *notificationService) SendDigest(userID uint, mail DigestMail) error {
+	return transaction(ns.db, func(tx *gorm.DB) error {
+		ndb := &notificationValidator{
+			NotificationDB: &notificationGorm{tx},
+		}
+
+		notifications, err := ndb.ClaimDigest(userID)
+		if err != nil {
+			return err
+		}
+		if len(notifications) == 0 {
+			return nil
+		}
+
+		token := ns.UnsubscribeToken(userID, NotifyAll)
+
+		return mail(notifications, token, ns.outbox.Sender(tx))
+	})
+}
+
+// unsubscribeMessage is what the unsubscribe tokens are the HMAC of.
+func unsubscribeMessage(userID uint, kind string) string {
+	return fmt.Sprintf("unsubscribe:%d:%s", userID, kind)
+}
+
+//
+// Gorm
+//
+
+type notificationGorm struct {
+	db *gorm.DB
+}
+
+func (ng *notificationGorm) ByID(id uint) (*Notification, error) {
+
+	var n Notification
+
+	if err := first(ng.db.Where("id = ?", id), &n); err != nil {
+		return nil, err
+	}
+
+	return &n, nil
+}
+
+func (ng *notificationGorm) ByUserID(userID uint) ([]Notification, error) {
+
+	notifications := make([]Notification, 0)
+
+	db := ng.db.Where("user_id = ?", userID).
+		Order("created_at DESC").
+		Limit(NotificationLimit)
+	if err := all(db, &notifications); err != nil {
+		return nil, err
+	}
+
+	return notifications, nil
+}
+
+func (ng *notificationGorm) Unread(userID uint, limit int) ([]Notification, error) {
+
+	notifications := make([]Notification, 0)
+
+	db := ng.db.Where("user_id = ? AND read_at IS NULL", userID).
+		Order("created_at DESC").
+		Limit(limit)
+	if err := all(db, &notifications); err != nil {
+		return nil, err
+	}
+
+	return notifications, nil
+}
+
+func (ng *notificationGorm) MarkRead(userID uint) error {
+	return ng.db.Model(&Notification{}).
+		Where("user_id = ? AND read_at IS NULL", userID).
+		UpdateColumn("read_at", time.Now()).Error
+}
+
+func (ng *notificationGorm) PendingDigests(before time.Time) ([]uint, error) {
+
+	userIDs := make([]uint, 0)
+
+	err := ng.db.Model(&Notification{}).
+		Where("email_pending AND created_at < ?", before).
+		Order("user_id").
+		Pluck("DISTINCT user_id", &userIDs).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return userIDs, nil
+}
+
+func (ng *notificationGorm) ClaimDigest(userID uint) ([]Notification, error) {
+
+	notifications := make([]Notification, 0)
+
+	db := ng.db.Set("gorm:query_option", "FOR UPDATE SKIP LOCKED").
+		Where("user_id = ? AND email_pending", userID).
+		Order("created_at")
+	if err := all(db, &notifications); err != nil {
+		return nil, err
+	}
+
+	if len(notifications) == 0 {
+		return notifications, nil
+	}
+
+	ids := make([]uint, 0, len(notifications))
+	for _, n := range notifications {
+		ids = append(ids, n.ID)
+	}
+
+	err := ng.db.Model(&Notification{}).Where("id IN (?)", ids).
+		UpdateColumn("email_pending", false).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return notifications, nil
+}
+
+func (ng *notificationGorm) Create(n *Notification) error {
+	return ng.db.Create(n).Error
+}
+
+func (ng *notificationGorm) Prefs(userID uint) ([]NotificationPref, error) {
+
+	prefs := make([]NotificationPref, 0)
+
+	if err := all(ng.db.Where("user_id = ?", userID), &prefs); err != nil {
+		return nil, err
+	}
+
+	return prefs, nil
+}
+
+// SavePref creates the preference of the user for the kind, or updates
+// it if there already is one.
+func (ng *notificationGorm) SavePref(p *NotificationPref) error {
+
+	var existing NotificationPref
+
+	err := first(ng.db.Where("user_id = ? AND kind = ?", p.UserID,
+		p.Kind), &existing)
+	switch err {
+	case nil:
+		p.ID = existing.ID
+		p.CreatedAt = existing.CreatedAt
+		return ng.db.Save(p).Error
+	case ErrNotFound:
+		return ng.db.Create(p).Error
+	default:
+		return err
+	}
+}
+
+//
+// Validators
+//
+
+type notificationValidator struct {
+	NotificationDB
+}
+
+type notificationValFn func(*Notification) error
+
+func runNotificationValFns(n *Notification, fns ...notificationValFn) error {
+	for _, fn := range fns {
+		if err := fn(n); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (nv *notificationValidator) userIDRequired(n *Notification) error {
+	if n.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+
+	return nil
+}
+
+func (nv *notificationValidator) kindValid(n *Notification) error {
+	if _, ok := notificationDescriptions[n.Kind]; !ok {
+		return ErrNotificationKindInvalid
+	}
+
+	return nil
+}
+
+func (nv *notificationValidator) Create(n *Notification) error {
+
+	err := runNotificationValFns(n, nv.userIDRequired, nv.kindValid)
+	if err != nil {
+		return err
+	}
+
+	return nv.NotificationDB.Create(n)
+}
+
+func (nv *notificationValidator) SavePref(p *NotificationPref) error {
+
+	if p.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+
+	if _, ok := notificationDescriptions[p.Kind]; !ok {
+		return ErrNotificationKindInvalid
+	}
+
+	return nv.NotificationDB.SavePref(p)
+}
+
+func (nv *notificationValidator) ClaimDigest(userID uint) ([]Notification, error) {
+
+	if userID <= 0 {
+		return nil, ErrUserIDRequired
+	}
+
+	return nv.NotificationDB.ClaimDigest(userID)
+}
@@ -0,0 +1,386 @@
+package models
+
+import (
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"lenslockedbr.com/email"
+)
+
+const (
+	OutboxPending = "pending"
+	OutboxSent    = "sent"
+
+	// OutboxDead messages failed OutboxMaxAttempts times and won't
+	// be tried again unless an admin retries them.
+	OutboxDead = "dead"
+
+	// OutboxMaxAttempts is how many times a message is tried before
+	// it is dead-lettered.
+	OutboxMaxAttempts = 8
+
+	// OutboxRetention is how long sent messages are kept for.
+	OutboxRetention = 7 * 24 * time.Hour
+
+	// outboxBackoff is how long to wait before the second attempt,
+	// it doubles with every attempt after that.
+	outboxBackoff = time.Minute
+
+	// outboxLease is how long a claimed message is hidden from other
+	// workers for. If the worker dies while sending it, the message
+	// is tried again once the lease is over.
+	outboxLease = 5 * time.Minute
+
+	// maxErrorLength is how much of the last error of a message is
+	// kept.
+	maxErrorLength = 1000
+
+	ErrRecipientRequired modelError = "models: recipient is required"
+)
+
+var _ OutboxDB = &outboxGorm{}
+
+// Mail sends the emails that go along with a change through sender,
+// given the token the change created, if any. The sender queues them
+// in the outbox within the transaction of the change, so they are only
+// sent once it is committed, and the change is rolled back if they
+// can't be queued.
+type Mail func(token string, sender email.Sender) error
+
+// OutboxMessage is an email waiting to be sent, or that was. Emails
+// are stored here first so that they survive restarts and failures of
+// the email provider, and are then sent in the background.
+type OutboxMessage struct {
+	gorm.Model
+	Sender          string    `gorm:"not null"`
+	Recipient       string    `gorm:"not null"`
+	ReplyTo         string    `gorm:"not null;default:''"`
+	ListUnsubscribe string    `gorm:"type:text;not null;default:''"`
+	Subject         string    `gorm:"not null"`
+	Text            string    `gorm:"type:text;not null"`
+	HTML            string    `gorm:"type:text;not null;default:''"`
+	Status          string    `gorm:"not null;index"`
+	Attempts        int       `gorm:"not null;default:0"`
+	NextAttemptAt   time.Time `gorm:"index"`
+	LastError       string    `gorm:"type:text;not null;default:''"`
+	SentAt          *time.Time
+}
+
+// OutboxDB is used to interact with the outbox database.
+//
+// For single message queries, if the message is not found ErrNotFound
+// is returned.
+type OutboxDB interface {
+	ByID(id uint) (*OutboxMessage, error)
+
+	// ByStatus returns the messages with the status, the most
+	// recent first.
+	ByStatus(status string) ([]OutboxMessage, error)
+
+	// Claim returns up to limit pending messages that are due,
+	// hiding them from other workers until the lease is over.
+	Claim(now time.Time, limit int) ([]OutboxMessage, error)
+
+	Create(m *OutboxMessage) error
+	Update(m *OutboxMessage) error
+	Delete(id uint) error
+
+	// DeleteSent deletes the messages sent before the time.
+	DeleteSent(before time.Time) error
+}
+
+type OutboxService interface {
+	OutboxDB
+
+	// Enqueue stores the message to be sent as soon as possible.
+	// When tx isn't nil the message is stored within it, so it is
+	// only sent if the transaction is committed.
+	Enqueue(tx *gorm.DB, m *OutboxMessage) error
+
+	// Sender returns an email.Sender that enqueues the messages
+	// instead of sending them, within tx when it isn't nil.
+	Sender(tx *gorm.DB) email.Sender
+
+	// Sent marks the message as sent.
+	Sent(m *OutboxMessage) error
+
+	// Failed records that sending the message failed, scheduling
+	// the next attempt with an exponential backoff, or marking it
+	// as dead after OutboxMaxAttempts.
+	Failed(m *OutboxMessage, sendErr error) error
+
+	// Retry schedules a dead message to be sent again, as if it
+	// had never been tried.
+	Retry(m *OutboxMessage) error
+}
+
+func NewOutboxService(db *gorm.DB) OutboxService {
+	return &outboxService{
+		OutboxDB: &outboxValidator{
+			OutboxDB: &outboxGorm{db},
+		},
+	}
+}
+
+//
+// Service
+//
+
+type outboxService struct {
+	OutboxDB
+}
+
+func (ob *outboxService) Enqueue(tx *gorm.DB, m *OutboxMessage) error {
+
+	m.Status = OutboxPending
+	m.Attempts = 0
+	m.NextAttemptAt = time.Now()
+
+	if tx != nil {
+		return NewOutboxService(tx).Create(m)
+	}
+
+	return ob.Create(m)
+}
+
+func (ob *outboxService) Sender(tx *gorm.DB) email.Sender {
+	return outboxSender{outbox: ob, tx: tx}
+}
+
+func (ob *outboxService) Sent(m *OutboxMessage) error {
+
+	now := time.Now()
+
+	m.Status = OutboxSent
+	m.Attempts++
+	m.SentAt = &now
+	m.LastError = ""
+
+	return ob.Update(m)
+}
+
+func (ob *outboxService) Failed(m *OutboxMessage, sendErr error) error {
+
+	m.Attempts++
+	m.LastError = sendErr.Error()
+
+	if m.Attempts >= OutboxMaxAttempts {
+		m.Status = OutboxDead
+		return ob.Update(m)
+	}
+
+	// 1, 2, 4, 8... minutes
+	backoff := outboxBackoff << uint(m.Attempts-1)
+	m.NextAttemptAt = time.Now().Add(backoff)
+
+	return ob.Update(m)
+}
+
+func (ob *outboxService) Retry(m *OutboxMessage) error {
+
+	if m.Status != OutboxDead {
+		return nil
+	}
+
+	m.Status = OutboxPending
+	m.Attempts = 0
+	m.NextAttemptAt = time.Now()
+
+	return ob.Update(m)
+}
+
+// outboxSender is an email.Sender that only stores the messages in
+// the outbox, the delivery job is what actually sends them. This way
+// requests don't wait on the email provider, nor fail with it.
+type outboxSender struct {
+	outbox OutboxService
+	tx     *gorm.DB
+}
+
+func (s outboxSender) Send(m *email.Message) error {
+	return s.outbox.Enqueue(s.tx, &OutboxMessage{
+		Sender:          m.From,
+		Recipient:       m.To,
+		ReplyTo:         m.ReplyTo,
+		ListUnsubscribe: m.ListUnsubscribe,
+		Subject:         m.Subject,
+		Text:            m.Text,
+		HTML:            m.HTML,
+	})
+}
+
+// transaction runs fn within a transaction, which is committed if fn
+// succeeds and rolled back otherwise.
+func transaction(db *gorm.DB, fn func(tx *gorm.DB) error) error {
+
+	tx := db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit().Error
+}
+
+//
+// Gorm
+//
+
+type outboxGorm struct {
+	db *gorm.DB
+}
+
+func (og *outboxGorm) ByID(id uint) (*OutboxMessage, error) {
+
+	var m OutboxMessage
+
+	if err := first(og.db.Where("id = ?", id), &m); err != nil {
+		return nil, err
+	}
+
+	return &m, nil
+}
+
+func (og *outboxGorm) ByStatus(status string) ([]OutboxMessage, error) {
+
+	messages := make([]OutboxMessage, 0)
+
+	db := og.db.Where("status = ?", status).Order("updated_at DESC")
+	if err := all(db, &messages); err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+// Claim locks the due messages for the duration of a transaction,
+// skipping the ones another worker already locked, and pushes their
+// next attempt past the lease so they aren't claimed twice.
+func (og *outboxGorm) Claim(now time.Time, limit int) ([]OutboxMessage, error) {
+
+	tx := og.db.Begin()
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+
+	messages := make([]OutboxMessage, 0)
+
+	db := tx.Set("gorm:query_option", "FOR UPDATE SKIP LOCKED").
+		Where("status = ? AND next_attempt_at <= ?", OutboxPending,
+			now).
+		Order("next_attempt_at").
+		Limit(limit)
+	if err := all(db, &messages); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if len(messages) == 0 {
+		return messages, tx.Commit().Error
+	}
+
+	ids := make([]uint, 0, len(messages))
+	for _, m := range messages {
+		ids = append(ids, m.ID)
+	}
+
+	err := tx.Model(&OutboxMessage{}).Where("id IN (?)", ids).
+		UpdateColumn("next_attempt_at", now.Add(outboxLease)).Error
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	return messages, tx.Commit().Error
+}
+
+func (og *outboxGorm) Create(m *OutboxMessage) error {
+	return og.db.Create(m).Error
+}
+
+func (og *outboxGorm) Update(m *OutboxMessage) error {
+	return og.db.Save(m).Error
+}
+
+// Delete deletes the message for good, it may hold the address of a
+// user who has since deleted their account.
+func (og *outboxGorm) Delete(id uint) error {
+	m := OutboxMessage{Model: gorm.Model{ID: id}}
+	return og.db.Unscoped().Delete(&m).Error
+}
+
+func (og *outboxGorm) DeleteSent(before time.Time) error {
+	return og.db.Unscoped().
+		Where("status = ? AND sent_at < ?", OutboxSent, before).
+		Delete(&OutboxMessage{}).Error
+}
+
+//
+// Validators
+//
+
+type outboxValidator struct {
+	OutboxDB
+}
+
+type outboxValFn func(*OutboxMessage) error
+
+func runOutboxValFns(m *OutboxMessage, fns ...outboxValFn) error {
+	for _, fn := range fns {
+		if err := fn(m); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (ov *outboxValidator) recipientRequired(m *OutboxMessage) error {
+	if strings.TrimSpace(m.Recipient) == "" {
+		return ErrRecipientRequired
+	}
+
+	return nil
+}
+
+func (ov *outboxValidator) truncateError(m *OutboxMessage) error {
+	if len(m.LastError) > maxErrorLength {
+		m.LastError = m.LastError[:maxErrorLength]
+	}
+
+	return nil
+}
+
+func (ov *outboxValidator) Create(m *OutboxMessage) error {
+
+	err := runOutboxValFns(m, ov.recipientRequired, ov.truncateError)
+	if err != nil {
+		return err
+	}
+
+	return ov.OutboxDB.Create(m)
+}
+
+func (ov *outboxValidator) Update(m *OutboxMessage) error {
+
+	err := runOutboxValFns(m, ov.recipientRequired, ov.truncateError)
+	if err != nil {
+		return err
+	}
+
+	return ov.OutboxDB.Update(m)
+}
+
+func (ov *outboxValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+
+	return ov.OutboxDB.Delete(id)
+}
@@ -15,7 +15,7 @@ import (
 
 type pwReset struct {
 	gorm.Model
-	UserID    uint   `gorm:"not null"`
+	UserID    uint   `gorm:"not null;index"`
 	Token     string `gorm:"-"`
 	TokenHash string `gorm:"not null;unique_index"`
 }
@@ -28,6 +28,7 @@ type pwResetDB interface {
 	ByToken(token string) (*pwReset, error)
 	Create(pwr *pwReset) error
 	Delete(id uint) error
+	DeleteByUserID(userID uint) error
 }
 
 func (pwrg *pwResetGorm) ByToken(token string) (*pwReset, error) {
@@ -55,6 +56,11 @@ func (pwrg *pwResetGorm) Delete(id uint) error {
 	return pwrg.db.Delete(&pwr).Error
 }
 
+func (pwrg *pwResetGorm) DeleteByUserID(userID uint) error {
+	return pwrg.db.Where("user_id = ?", userID).
+		Delete(&pwReset{}).Error
+}
+
 /////////////////////////////////////////////////////////////////////
 //
 // Validator structures and methods
@@ -124,14 +130,17 @@ func (pwrv *pwResetValidator) hmacToken(pwr *pwReset) error {
 
 func (pwrv *pwResetValidator) ByToken(token string) (*pwReset, error) {
 
-	pwr := pwReset{Token: token}
+	// The token may have been hashed with a previous HMAC key
+	for _, hashed := range pwrv.hmac.HashAll(token) {
+		found, err := pwrv.pwResetDB.ByToken(hashed)
+		if err == ErrNotFound {
+			continue
+		}
 
-	err := runPwResetValFns(&pwr, pwrv.hmacToken)
-	if err != nil {
-		return nil, err
+		return found, err
 	}
 
-	return pwrv.pwResetDB.ByToken(pwr.TokenHash)
+	return nil, ErrNotFound
 }
 
 func (pwrv *pwResetValidator) Create(pwr *pwReset) error {
@@ -154,3 +163,12 @@ func (pwrv *pwResetValidator) Delete(id uint) error {
 
 	return pwrv.pwResetDB.Delete(id)
 }
+
+func (pwrv *pwResetValidator) DeleteByUserID(userID uint) error {
+
+	if userID <= 0 {
+		return ErrUserIDRequired
+	}
+
+	return pwrv.pwResetDB.DeleteByUserID(userID)
+}
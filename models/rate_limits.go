@@ -0,0 +1,106 @@
+package models
+
+import (
+	"sort"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"lenslockedbr.com/ratelimit"
+)
+
+var _ RateLimitStore = &rateLimitGorm{}
+
+// rateLimitBucket is the persisted state of a ratelimit.Bucket. This
+// allows several instances of the application to share their limits.
+type rateLimitBucket struct {
+	Key     string `gorm:"primary_key"`
+	Tokens  float64
+	Updated time.Time
+}
+
+// RateLimitStore is a ratelimit.Store backed by Postgres. Its buckets
+// are kept until they are deleted with DeleteIdle.
+type RateLimitStore interface {
+	ratelimit.Store
+
+	// DeleteIdle deletes the buckets last updated before the time.
+	// Those idle for longer than it takes to refill them are full,
+	// the same as the buckets that don't exist yet.
+	DeleteIdle(before time.Time) error
+}
+
+// NewRateLimitStore returns a ratelimit.Store backed by Postgres.
+func NewRateLimitStore(db *gorm.DB) RateLimitStore {
+	return &rateLimitGorm{db}
+}
+
+type rateLimitGorm struct {
+	db *gorm.DB
+}
+
+// Take locks the row of the bucket for the duration of a transaction
+// so that concurrent requests on different instances can't both take
+// the last token.
+func (rlg *rateLimitGorm) Take(keys []string, l ratelimit.Limit) (time.Duration, error) {
+
+	// Locking the rows in the same order keeps concurrent requests
+	// with overlapping keys from deadlocking.
+	keys = append([]string(nil), keys...)
+	sort.Strings(keys)
+
+	tx := rlg.db.Begin()
+	if tx.Error != nil {
+		return 0, tx.Error
+	}
+
+	rows := make([]rateLimitBucket, 0, len(keys))
+	buckets := make([]*ratelimit.Bucket, 0, len(keys))
+
+	for _, key := range keys {
+		// Make sure the row exists before locking it. A new
+		// bucket starts with a zero Updated time, which
+		// ratelimit.Bucket treats as full.
+		err := tx.Exec("INSERT INTO rate_limit_buckets "+
+			"(key, tokens, updated) VALUES (?, 0, ?) "+
+			"ON CONFLICT (key) DO NOTHING", key, time.Time{}).Error
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+
+		var rlb rateLimitBucket
+		err = first(tx.Set("gorm:query_option", "FOR UPDATE").
+			Where("key = ?", key), &rlb)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+
+		rows = append(rows, rlb)
+		buckets = append(buckets, &ratelimit.Bucket{
+			Tokens:  rlb.Tokens,
+			Updated: rlb.Updated,
+		})
+	}
+
+	wait := ratelimit.TakeAll(time.Now(), l, buckets...)
+
+	for i := range rows {
+		err := tx.Model(&rows[i]).UpdateColumns(map[string]interface{}{
+			"tokens":  buckets[i].Tokens,
+			"updated": buckets[i].Updated,
+		}).Error
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+
+	return wait, tx.Commit().Error
+}
+
+func (rlg *rateLimitGorm) DeleteIdle(before time.Time) error {
+	return rlg.db.Where("updated < ?", before).
+		Delete(&rateLimitBucket{}).Error
+}
@@ -3,6 +3,8 @@ package models
 import (
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/postgres"
+
+	"lenslockedbr.com/hash"
 )
 
 // ServicesConfig is really just a function, but I find using types like
@@ -13,7 +15,29 @@ type Services struct {
 	User    UserService
 	Gallery GalleryService
 	Image   ImageService
+	Avatar  AvatarService
+
+	LoginAttempt LoginAttemptService
+	RateLimit    RateLimitStore
+	Export       ExportService
+	Identity     IdentityService
+
+	Impersonation ImpersonationService
+	Audit         AuditService
+	Studio        StudioService
+	Collaborator  CollaboratorService
+	Outbox        OutboxService
+	Suppression   SuppressionService
+	Notification  NotificationService
+	Contact       ContactService
+	Comment       CommentService
+	Follow        FollowService
+	Activity      ActivityService
+
 	db      *gorm.DB
+	files   FileStore
+	peppers hash.Keyring
+	hmac    hash.HMAC
 }
 
 func NewServices(cfgs ...ServicesConfig) (*Services, error) {
@@ -40,13 +64,42 @@ func (s *Services) Close() error {
 
 // Automigrate will attempt to automatically migrate all tables
 func (s *Services) AutoMigrate() error {
-	return s.db.AutoMigrate(&User{}, &Gallery{}, &pwReset{}).Error
+	err := s.db.AutoMigrate(&User{}, &Gallery{}, &pwReset{},
+		&loginAttempt{}, &rateLimitBucket{}, &emailChange{},
+		&Export{}, &Identity{}, &loginLink{},
+		&Impersonation{}, &AuditEvent{}, &Studio{},
+		&Membership{}, &Collaborator{}, &OutboxMessage{},
+		&Suppression{}, &Notification{}, &NotificationPref{},
+		&ContactMessage{}, &Comment{}, &Follow{},
+		&Activity{}).Error
+	if err != nil {
+		return err
+	}
+
+	// Usernames are optional, so only the ones that are set have
+	// to be unique, whatever their case. Gorm can't create partial
+	// indexes. It replaces idx_users_username, which wasn't on
+	// lower(username).
+	err = s.db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS " +
+		usernameIndex + " ON users (lower(username)) " +
+		"WHERE username <> ''").Error
+	if err != nil {
+		return err
+	}
+
+	return s.db.Exec("DROP INDEX IF EXISTS idx_users_username").Error
 }
 
 // DestructiveReset drops all tables and rebuilds them
 func (s *Services) DestructiveReset() error {
-	err := s.db.DropTableIfExists(&User{}, &Gallery{}, &pwReset{}).
-		Error
+	err := s.db.DropTableIfExists(&User{}, &Gallery{}, &pwReset{},
+		&loginAttempt{}, &rateLimitBucket{}, &emailChange{},
+		&Export{}, &Identity{}, &loginLink{},
+		&Impersonation{}, &AuditEvent{}, &Studio{},
+		&Membership{}, &Collaborator{}, &OutboxMessage{},
+		&Suppression{}, &Notification{}, &NotificationPref{},
+		&ContactMessage{}, &Comment{}, &Follow{},
+		&Activity{}).Error
 	if err != nil {
 		return err
 	}
@@ -74,23 +127,179 @@ func WithLogMode(mode bool) ServicesConfig {
 	}
 }
 
-func WithUser(pepper, hmacKey string) ServicesConfig {
+// WithKeys sets the pepper and HMAC keyrings used by the services that
+// follow it, so it must come before them.
+func WithKeys(peppers, hmacKeys hash.Keyring) ServicesConfig {
 	return func(s *Services) error {
-		s.User = NewUserService(s.db, pepper, hmacKey)
+		s.peppers = peppers
+		s.hmac = hash.NewHMACKeyring(hmacKeys)
 		return nil
 	}
 }
 
+// WithUser sets up the user service. If cfg.BreachCorpus is not empty,
+// the breached password corpus is opened, see BreachCorpus.
+func WithUser(cfg UserConfig) ServicesConfig {
+	return func(s *Services) error {
+		var breached *BreachCorpus
+		if cfg.BreachCorpus != "" {
+			bc, err := OpenBreachCorpus(cfg.BreachCorpus)
+			if err != nil {
+				return err
+			}
+			breached = bc
+		}
+
+		s.User = NewUserService(s.db, s.peppers, s.hmac, cfg, breached)
+		return nil
+	}
+}
+
+// WithGallery sets up the gallery service, it must come after
+// WithStudio and WithCollaborator.
 func WithGallery() ServicesConfig {
 	return func(s *Services) error {
-		s.Gallery = NewGalleryService(s.db)
+		s.Gallery = NewGalleryService(s.db, s.Studio, s.Collaborator)
+		return nil
+	}
+}
+
+func WithCollaborator() ServicesConfig {
+	return func(s *Services) error {
+		s.Collaborator = NewCollaboratorService(s.db, s.hmac)
+		return nil
+	}
+}
+
+func WithStudio() ServicesConfig {
+	return func(s *Services) error {
+		s.Studio = NewStudioService(s.db)
+		return nil
+	}
+}
+
+// WithFiles sets where the images and avatars are kept, which is the
+// images directory on the local disk by default. It must come before
+// WithImage and WithAvatar.
+func WithFiles(files FileStore) ServicesConfig {
+	return func(s *Services) error {
+		s.files = files
 		return nil
 	}
 }
 
 func WithImage() ServicesConfig {
 	return func(s *Services) error {
-		s.Image = NewImageService()
+		s.Image = NewImageService(s.fileStore())
+		return nil
+	}
+}
+
+func WithAvatar() ServicesConfig {
+	return func(s *Services) error {
+		s.Avatar = NewAvatarService(s.fileStore())
+		return nil
+	}
+}
+
+// fileStore returns the FileStore shared by the images and avatars.
+func (s *Services) fileStore() FileStore {
+	if s.files == nil {
+		s.files = NewDiskStore(imagesDir)
+	}
+
+	return s.files
+}
+
+func WithLoginAttempt() ServicesConfig {
+	return func(s *Services) error {
+		s.LoginAttempt = NewLoginAttemptService(s.db)
+		return nil
+	}
+}
+
+func WithRateLimit() ServicesConfig {
+	return func(s *Services) error {
+		s.RateLimit = NewRateLimitStore(s.db)
+		return nil
+	}
+}
+
+// WithIdentity sets up the identity service, it must come after
+// WithUser.
+func WithIdentity() ServicesConfig {
+	return func(s *Services) error {
+		s.Identity = NewIdentityService(s.db, s.User)
+		return nil
+	}
+}
+
+func WithImpersonation() ServicesConfig {
+	return func(s *Services) error {
+		s.Impersonation = NewImpersonationService(s.db, s.hmac)
+		return nil
+	}
+}
+
+func WithAudit() ServicesConfig {
+	return func(s *Services) error {
+		s.Audit = NewAuditService(s.db)
+		return nil
+	}
+}
+
+func WithOutbox() ServicesConfig {
+	return func(s *Services) error {
+		s.Outbox = NewOutboxService(s.db)
+		return nil
+	}
+}
+
+func WithSuppression() ServicesConfig {
+	return func(s *Services) error {
+		s.Suppression = NewSuppressionService(s.db)
+		return nil
+	}
+}
+
+func WithNotification() ServicesConfig {
+	return func(s *Services) error {
+		s.Notification = NewNotificationService(s.db, s.hmac)
+		return nil
+	}
+}
+
+func WithContact() ServicesConfig {
+	return func(s *Services) error {
+		s.Contact = NewContactService(s.db, s.hmac)
+		return nil
+	}
+}
+
+func WithComment() ServicesConfig {
+	return func(s *Services) error {
+		s.Comment = NewCommentService(s.db)
+		return nil
+	}
+}
+
+func WithFollow() ServicesConfig {
+	return func(s *Services) error {
+		s.Follow = NewFollowService(s.db)
+		return nil
+	}
+}
+
+func WithActivity() ServicesConfig {
+	return func(s *Services) error {
+		s.Activity = NewActivityService(s.db)
+		return nil
+	}
+}
+
+func WithExport() ServicesConfig {
+	return func(s *Services) error {
+		s.Export = NewExportService(s.db, s.hmac)
 		return nil
 	}
 }
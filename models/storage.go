@@ -0,0 +1,172 @@
+package models
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// imagesDir is where the disk store keeps the images of galleries and
+// the avatars of users, relative to where our Go application is run
+// from. It is what is served under /images/.
+const imagesDir = "images"
+
+// FileStore is where the files of images and avatars are kept. Paths
+// are slash separated and relative to the root of the store, eg:
+// galleries/1/beach.jpg
+type FileStore interface {
+	// Write stores what is read from r at path, replacing the file
+	// that was there. The file is never seen partially written.
+	Write(path string, r io.Reader) error
+
+	// WriteDir stores the files, by name, as the only ones in dir,
+	// replacing whatever it held. If it fails, dir is left as it
+	// was, so it never holds some new files and some old ones.
+	WriteDir(dir string, files map[string][]byte) error
+
+	// List returns the names of the files in dir, sorted. A dir
+	// that doesn't exist has no files.
+	List(dir string) ([]string, error)
+
+	// Size returns how many bytes the file at path takes.
+	Size(path string) (int64, error)
+
+	Remove(path string) error
+	RemoveAll(dir string) error
+}
+
+// NewDiskStore creates a FileStore that keeps the files on the local
+// disk under root.
+func NewDiskStore(root string) FileStore {
+	return &diskStore{root: root}
+}
+
+type diskStore struct {
+	root string
+}
+
+func (ds *diskStore) Write(path string, r io.Reader) error {
+
+	dst := ds.path(path)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	// Written next to the destination, so the rename never crosses
+	// file systems
+	f, err := os.CreateTemp(filepath.Dir(dst),
+		"."+filepath.Base(dst)+".tmp-*")
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, r)
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return os.Rename(f.Name(), dst)
+}
+
+func (ds *diskStore) WriteDir(dir string, files map[string][]byte) error {
+
+	dst := ds.path(dir)
+	parent := filepath.Dir(dst)
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.MkdirTemp(parent, "."+filepath.Base(dst)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	if err := os.Chmod(tmp, 0755); err != nil {
+		return err
+	}
+
+	for name, data := range files {
+		err := os.WriteFile(filepath.Join(tmp, name), data, 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The old files are moved out of the way first, and back if the
+	// new ones can't take their place
+	old, err := os.MkdirTemp(parent, "."+filepath.Base(dst)+".old-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(old)
+
+	moved := filepath.Join(old, filepath.Base(dst))
+	err = os.Rename(dst, moved)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := os.Rename(tmp, dst); err != nil {
+		if _, sErr := os.Stat(moved); sErr == nil {
+			os.Rename(moved, dst)
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (ds *diskStore) List(dir string) ([]string, error) {
+
+	entries, err := os.ReadDir(ds.path(dir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		// Files still being written are hidden
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+func (ds *diskStore) Size(path string) (int64, error) {
+
+	fi, err := os.Stat(ds.path(path))
+	if err != nil {
+		return 0, err
+	}
+
+	return fi.Size(), nil
+}
+
+func (ds *diskStore) Remove(path string) error {
+	return os.Remove(ds.path(path))
+}
+
+func (ds *diskStore) RemoveAll(dir string) error {
+	return os.RemoveAll(ds.path(dir))
+}
+
+func (ds *diskStore) path(path string) string {
+	return filepath.Join(ds.root, filepath.FromSlash(path))
+}
@@ -0,0 +1,467 @@
+package models
+
+import (
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// StudioOwner members can do anything to the studio and its
+	// galleries, including managing who its members are.
+	StudioOwner = "owner"
+
+	// StudioEditor members can create and edit the galleries of the
+	// studio, but not delete them.
+	StudioEditor = "editor"
+
+	// StudioViewer members can only see the galleries of the studio.
+	StudioViewer = "viewer"
+
+	// ErrForbidden is returned when a user tries to do something to
+	// a gallery or studio they are not allowed to.
+	ErrForbidden modelError = "models: you don't have permission to " +
+		"do that"
+
+	ErrStudioNameRequired modelError = "models: studio name is required"
+
+	ErrMemberRoleInvalid modelError = "models: role must be owner, " +
+		"editor or viewer"
+
+	// ErrAlreadyMember is returned when adding someone to a studio
+	// they are already a member of.
+	ErrAlreadyMember modelError = "models: that user is already a " +
+		"member of the studio"
+
+	// ErrLastOwner is returned when removing or demoting the only
+	// owner of a studio, which would leave nobody to manage it.
+	ErrLastOwner modelError = "models: a studio must have at least " +
+		"one owner"
+
+	// ErrSoleOwnerDeletion is returned when the only owner of a
+	// studio asks for their account to be deleted.
+	ErrSoleOwnerDeletion modelError = "models: you are the only owner " +
+		"of a studio, make another member an owner before deleting " +
+		"your account"
+)
+
+// Permission is what a user wants to do with a gallery. Each one
+// includes the ones before it.
+type Permission int
+
+const (
+	// permNone is not being allowed to do anything to the gallery.
+	permNone Permission = iota - 1
+
+	// PermView is seeing the gallery among your galleries.
+	PermView
+
+	// PermUpload is adding images to the gallery.
+	PermUpload
+
+	// PermEdit is creating the gallery, changing its title and
+	// deleting its images.
+	PermEdit
+
+	// PermManage is deleting the gallery.
+	PermManage
+)
+
+// rolePermissions is the most each studio role is allowed to do.
+var rolePermissions = map[string]Permission{
+	StudioViewer: PermView,
+	StudioEditor: PermEdit,
+	StudioOwner:  PermManage,
+}
+
+// StudioRoles lists the roles, from the most to the least powerful.
+var StudioRoles = []string{StudioOwner, StudioEditor, StudioViewer}
+
+var _ StudioDB = &studioGorm{}
+
+// Studio is a team of users that own galleries together. Galleries
+// with a StudioID belong to the studio rather than to the member who
+// created them.
+type Studio struct {
+	gorm.Model
+	Name string `gorm:"not null"`
+}
+
+// Membership makes a user a member of a studio with one of the studio
+// roles.
+type Membership struct {
+	gorm.Model
+	StudioID uint   `gorm:"not null;unique_index:idx_memberships_studio_user"`
+	UserID   uint   `gorm:"not null;unique_index:idx_memberships_studio_user;index"`
+	Role     string `gorm:"not null"`
+}
+
+// Can returns true if the role of the member allows them to do perm to
+// the galleries of the studio.
+func (m *Membership) Can(perm Permission) bool {
+	max, ok := rolePermissions[m.Role]
+	return ok && perm <= max
+}
+
+// CanEdit returns true if the member can create and edit galleries,
+// eg: to show them the links to do it.
+func (m *Membership) CanEdit() bool {
+	return m.Can(PermEdit)
+}
+
+// CanManage returns true if the member can delete galleries and
+// manage the members of the studio.
+func (m *Membership) CanManage() bool {
+	return m.Can(PermManage)
+}
+
+// StudioDB is used to interact with the studios and memberships
+// databases.
+//
+// For single studio or membership queries, if it is not found
+// ErrNotFound is returned.
+type StudioDB interface {
+	ByID(id uint) (*Studio, error)
+
+	// ByUserID returns the studios the user is a member of.
+	ByUserID(userID uint) ([]Studio, error)
+
+	// Create creates the studio with the user as its owner.
+	Create(studio *Studio, owner *User) error
+
+	Membership(studioID, userID uint) (*Membership, error)
+	Members(studioID uint) ([]Membership, error)
+
+	CreateMembership(m *Membership) error
+	UpdateMembership(m *Membership) error
+	DeleteMembership(id uint) error
+}
+
+type StudioService interface {
+	StudioDB
+
+	// AddMember makes the user a member of the studio.
+	AddMember(studio *Studio, user *User, role string) error
+
+	// SetRole changes the role of the member. ErrLastOwner is
+	// returned if they are the only owner of the studio.
+	SetRole(m *Membership, role string) error
+
+	// RemoveMember removes the member from the studio. ErrLastOwner
+	// is returned if they are the only owner of the studio.
+	RemoveMember(m *Membership) error
+
+	// SoleOwned returns the studios the user is the only owner of.
+	SoleOwned(userID uint) ([]Studio, error)
+}
+
+func NewStudioService(db *gorm.DB) StudioService {
+	return &studioService{
+		StudioDB: &studioValidator{
+			StudioDB: &studioGorm{db},
+		},
+	}
+}
+
+//
+// Service
+//
+
+type studioService struct {
+	StudioDB
+}
+
+func (ss *studioService) AddMember(studio *Studio, user *User, role string) error {
+
+	_, err := ss.Membership(studio.ID, user.ID)
+	switch err {
+	case nil:
+		return ErrAlreadyMember
+	case ErrNotFound:
+	default:
+		return err
+	}
+
+	return ss.CreateMembership(&Membership{
+		StudioID: studio.ID,
+		UserID:   user.ID,
+		Role:     role,
+	})
+}
+
+func (ss *studioService) SetRole(m *Membership, role string) error {
+
+	if m.Role == StudioOwner && role != StudioOwner {
+		if err := ss.keepOwner(m); err != nil {
+			return err
+		}
+	}
+
+	m.Role = role
+
+	return ss.UpdateMembership(m)
+}
+
+func (ss *studioService) RemoveMember(m *Membership) error {
+
+	if m.Role == StudioOwner {
+		if err := ss.keepOwner(m); err != nil {
+			return err
+		}
+	}
+
+	return ss.DeleteMembership(m.ID)
+}
+
+func (ss *studioService) SoleOwned(userID uint) ([]Studio, error) {
+
+	studios, err := ss.ByUserID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	sole := make([]Studio, 0)
+	for _, studio := range studios {
+		m, err := ss.Membership(studio.ID, userID)
+		if err != nil {
+			return nil, err
+		}
+
+		if m.Role != StudioOwner {
+			continue
+		}
+
+		switch err := ss.keepOwner(m); err {
+		case nil:
+		case ErrLastOwner:
+			sole = append(sole, studio)
+		default:
+			return nil, err
+		}
+	}
+
+	return sole, nil
+}
+
+// keepOwner returns ErrLastOwner unless the studio has an owner other
+// than the member.
+func (ss *studioService) keepOwner(m *Membership) error {
+
+	members, err := ss.Members(m.StudioID)
+	if err != nil {
+		return err
+	}
+
+	for _, other := range members {
+		if other.Role == StudioOwner && other.ID != m.ID {
+			return nil
+		}
+	}
+
+	return ErrLastOwner
+}
+
+//
+// Gorm
+//
+
+type studioGorm struct {
+	db *gorm.DB
+}
+
+func (sg *studioGorm) ByID(id uint) (*Studio, error) {
+
+	var studio Studio
+
+	err := first(sg.db.Where("id = ?", id), &studio)
+	if err != nil {
+		return nil, err
+	}
+
+	return &studio, nil
+}
+
+func (sg *studioGorm) ByUserID(userID uint) ([]Studio, error) {
+
+	studios := make([]Studio, 0)
+
+	db := sg.db.Joins("JOIN memberships ON "+
+		"memberships.studio_id = studios.id AND "+
+		"memberships.deleted_at IS NULL").
+		Where("memberships.user_id = ?", userID).
+		Order("studios.name")
+	if err := all(db, &studios); err != nil {
+		return nil, err
+	}
+
+	return studios, nil
+}
+
+// Create creates the studio and the membership of its owner in a single
+// transaction, so there is never a studio without an owner.
+func (sg *studioGorm) Create(studio *Studio, owner *User) error {
+
+	tx := sg.db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	if err := tx.Create(studio).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	m := Membership{
+		StudioID: studio.ID,
+		UserID:   owner.ID,
+		Role:     StudioOwner,
+	}
+	if err := tx.Create(&m).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit().Error
+}
+
+func (sg *studioGorm) Membership(studioID, userID uint) (*Membership, error) {
+
+	var m Membership
+
+	db := sg.db.Where("studio_id = ? AND user_id = ?", studioID, userID)
+	if err := first(db, &m); err != nil {
+		return nil, err
+	}
+
+	return &m, nil
+}
+
+func (sg *studioGorm) Members(studioID uint) ([]Membership, error) {
+
+	members := make([]Membership, 0)
+
+	db := sg.db.Where("studio_id = ?", studioID).Order("created_at")
+	if err := all(db, &members); err != nil {
+		return nil, err
+	}
+
+	return members, nil
+}
+
+func (sg *studioGorm) CreateMembership(m *Membership) error {
+	return sg.db.Create(m).Error
+}
+
+func (sg *studioGorm) UpdateMembership(m *Membership) error {
+	return sg.db.Save(m).Error
+}
+
+// DeleteMembership deletes the membership for good, so the user can be
+// added to the studio again.
+func (sg *studioGorm) DeleteMembership(id uint) error {
+	m := Membership{Model: gorm.Model{ID: id}}
+	return sg.db.Unscoped().Delete(&m).Error
+}
+
+//
+// Validators
+//
+
+type studioValidator struct {
+	StudioDB
+}
+
+type studioValFn func(*Studio) error
+
+func runStudioValFns(studio *Studio, fns ...studioValFn) error {
+	for _, fn := range fns {
+		if err := fn(studio); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type membershipValFn func(*Membership) error
+
+func runMembershipValFns(m *Membership, fns ...membershipValFn) error {
+	for _, fn := range fns {
+		if err := fn(m); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (sv *studioValidator) trimName(studio *Studio) error {
+	studio.Name = strings.TrimSpace(studio.Name)
+	return nil
+}
+
+func (sv *studioValidator) nameRequired(studio *Studio) error {
+	if studio.Name == "" {
+		return ErrStudioNameRequired
+	}
+
+	return nil
+}
+
+func (sv *studioValidator) idsRequired(m *Membership) error {
+	if m.StudioID <= 0 || m.UserID <= 0 {
+		return ErrIDInvalid
+	}
+
+	return nil
+}
+
+func (sv *studioValidator) roleValid(m *Membership) error {
+	if _, ok := rolePermissions[m.Role]; !ok {
+		return ErrMemberRoleInvalid
+	}
+
+	return nil
+}
+
+func (sv *studioValidator) Create(studio *Studio, owner *User) error {
+
+	err := runStudioValFns(studio, sv.trimName, sv.nameRequired)
+	if err != nil {
+		return err
+	}
+
+	if owner == nil || owner.ID <= 0 {
+		return ErrUserIDRequired
+	}
+
+	return sv.StudioDB.Create(studio, owner)
+}
+
+func (sv *studioValidator) CreateMembership(m *Membership) error {
+
+	err := runMembershipValFns(m, sv.idsRequired, sv.roleValid)
+	if err != nil {
+		return err
+	}
+
+	return sv.StudioDB.CreateMembership(m)
+}
+
+func (sv *studioValidator) UpdateMembership(m *Membership) error {
+
+	err := runMembershipValFns(m, sv.idsRequired, sv.roleValid)
+	if err != nil {
+		return err
+	}
+
+	return sv.StudioDB.UpdateMembership(m)
+}
+
+func (sv *studioValidator) DeleteMembership(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+
+	return sv.StudioDB.DeleteMembership(id)
+}
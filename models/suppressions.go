@@ -0,0 +1,237 @@
+package models
+
+import (
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// SuppressionBounce is an address emails can't be delivered to,
+	// eg: because it doesn't exist.
+	SuppressionBounce = "bounce"
+
+	// SuppressionComplaint is an address whose owner reported our
+	// emails as spam.
+	SuppressionComplaint = "complaint"
+
+	// maxSuppressionDetail is the size of the detail column
+	maxSuppressionDetail = 255
+
+	ErrSuppressionReasonInvalid modelError = "models: suppression " +
+		"reason must be bounce or complaint"
+)
+
+var _ SuppressionDB = &suppressionGorm{}
+
+// Suppression is an email address we stop sending non-critical emails
+// to, because they bounced or were reported as spam. Only one is kept
+// per address, with the latest reason.
+type Suppression struct {
+	gorm.Model
+	Email  string `gorm:"not null;unique_index"`
+	Reason string `gorm:"not null"`
+	Detail string `gorm:"not null;default:''"`
+}
+
+// SuppressionDB is used to interact with the suppressions database.
+//
+// For single suppression queries, if the suppression is not found
+// ErrNotFound is returned.
+type SuppressionDB interface {
+	ByEmail(email string) (*Suppression, error)
+
+	Create(s *Suppression) error
+	Update(s *Suppression) error
+
+	// DeleteByEmail deletes the suppression of the address, if
+	// there is one.
+	DeleteByEmail(email string) error
+}
+
+type SuppressionService interface {
+	SuppressionDB
+
+	// Suppress records that emails to the address bounced or were
+	// complained about, updating the reason if it already was.
+	Suppress(email, reason, detail string) error
+
+	// Suppressed returns true if non-critical emails shouldn't be
+	// sent to the address.
+	Suppressed(email string) (bool, error)
+}
+
+func NewSuppressionService(db *gorm.DB) SuppressionService {
+	return &suppressionService{
+		SuppressionDB: &suppressionValidator{
+			SuppressionDB: &suppressionGorm{db},
+		},
+	}
+}
+
+//
+// Service
+//
+
+type suppressionService struct {
+	SuppressionDB
+}
+
+func (ss *suppressionService) Suppress(email, reason, detail string) error {
+
+	s, err := ss.ByEmail(email)
+	switch err {
+	case nil:
+		s.Reason = reason
+		s.Detail = detail
+		return ss.Update(s)
+	case ErrNotFound:
+	default:
+		return err
+	}
+
+	return ss.Create(&Suppression{
+		Email:  email,
+		Reason: reason,
+		Detail: detail,
+	})
+}
+
+func (ss *suppressionService) Suppressed(email string) (bool, error) {
+
+	_, err := ss.ByEmail(email)
+	switch err {
+	case nil:
+		return true, nil
+	case ErrNotFound:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+//
+// Gorm
+//
+
+type suppressionGorm struct {
+	db *gorm.DB
+}
+
+func (sg *suppressionGorm) ByEmail(email string) (*Suppression, error) {
+
+	var s Suppression
+
+	if err := first(sg.db.Where("email = ?", email), &s); err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+func (sg *suppressionGorm) Create(s *Suppression) error {
+	return sg.db.Create(s).Error
+}
+
+func (sg *suppressionGorm) Update(s *Suppression) error {
+	return sg.db.Save(s).Error
+}
+
+// DeleteByEmail deletes the suppression for good, so the address can
+// be suppressed again if it bounces again.
+func (sg *suppressionGorm) DeleteByEmail(email string) error {
+	return sg.db.Unscoped().Where("email = ?", email).
+		Delete(&Suppression{}).Error
+}
+
+//
+// Validators
+//
+
+type suppressionValidator struct {
+	SuppressionDB
+}
+
+type suppressionValFn func(*Suppression) error
+
+func runSuppressionValFns(s *Suppression, fns ...suppressionValFn) error {
+	for _, fn := range fns {
+		if err := fn(s); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (sv *suppressionValidator) normalizeEmail(s *Suppression) error {
+	s.Email = normalizeEmail(s.Email)
+	return nil
+}
+
+func (sv *suppressionValidator) emailRequired(s *Suppression) error {
+	if s.Email == "" {
+		return ErrEmailRequired
+	}
+
+	return nil
+}
+
+func (sv *suppressionValidator) reasonValid(s *Suppression) error {
+	switch s.Reason {
+	case SuppressionBounce, SuppressionComplaint:
+		return nil
+	default:
+		return ErrSuppressionReasonInvalid
+	}
+}
+
+func (sv *suppressionValidator) truncateDetail(s *Suppression) error {
+	if len(s.Detail) > maxSuppressionDetail {
+		s.Detail = s.Detail[:maxSuppressionDetail]
+	}
+
+	return nil
+}
+
+// ByEmail normalizes the address first, as it is whenever a
+// suppression is saved.
+func (sv *suppressionValidator) ByEmail(email string) (*Suppression, error) {
+	return sv.SuppressionDB.ByEmail(normalizeEmail(email))
+}
+
+func (sv *suppressionValidator) Create(s *Suppression) error {
+
+	err := runSuppressionValFns(s, sv.normalizeEmail,
+		sv.emailRequired,
+		sv.reasonValid,
+		sv.truncateDetail)
+	if err != nil {
+		return err
+	}
+
+	return sv.SuppressionDB.Create(s)
+}
+
+func (sv *suppressionValidator) Update(s *Suppression) error {
+
+	err := runSuppressionValFns(s, sv.normalizeEmail,
+		sv.emailRequired,
+		sv.reasonValid,
+		sv.truncateDetail)
+	if err != nil {
+		return err
+	}
+
+	return sv.SuppressionDB.Update(s)
+}
+
+func (sv *suppressionValidator) DeleteByEmail(email string) error {
+	return sv.SuppressionDB.DeleteByEmail(normalizeEmail(email))
+}
+
+// normalizeEmail lowercases the address and trims the spaces around
+// it, like the addresses of users.
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
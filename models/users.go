@@ -1,13 +1,14 @@
 package models
 
 import (
+	"fmt"
 	"regexp"
 	"strings"
 	"time"
 
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/postgres"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/lib/pq"
 
 	"lenslockedbr.com/hash"
 	"lenslockedbr.com/rand"
@@ -49,6 +50,22 @@ var (
 	// without a user password provided.
 	ErrPasswordRequired modelError = "models: password is required"
 
+	// ErrPasswordTooCommon is returned when a user tries to set a
+	// password that is in our list of commonly used passwords.
+	ErrPasswordTooCommon modelError = "models: password is too " +
+		"common and easy to guess, please choose another one"
+
+	// ErrPasswordPersonal is returned when a user tries to set a
+	// password that contains their email address or name.
+	ErrPasswordPersonal modelError = "models: password must not " +
+		"contain your email address or name"
+
+	// ErrPasswordBreached is returned when a user tries to set a
+	// password that is known to have leaked in a data breach.
+	ErrPasswordBreached modelError = "models: password has appeared " +
+		"in a data breach and is unsafe to use, please choose " +
+		"another one"
+
 	// ErrRememberRequired is returned when a create or update is
 	// attempted without a user remember token hash
 	ErrRememberRequired modelError = "models: remember token " +
@@ -61,10 +78,86 @@ var (
 
 	ErrTokenInvalid modelError = "models: token provided is not valid"
 
+	// ErrPepperNotFound is returned when a password hash was made
+	// with a pepper that is no longer in the keyring.
+	ErrPepperNotFound modelError = "models: pepper used for the " +
+		"password hash was not found"
+
+	// ErrEmailUnchanged is returned when a user requests to change
+	// their email address to the one they already have.
+	ErrEmailUnchanged modelError = "models: new email address is " +
+		"the same as the current one"
+
+	// ErrAccountDisabled is returned when someone tries to sign in
+	// to an account that was disabled by an admin.
+	ErrAccountDisabled modelError = "models: this account has been " +
+		"disabled, please contact support"
+
+	// ErrDisableSelf is returned when an admin tries to disable
+	// their own account.
+	ErrDisableSelf modelError = "models: you can't disable your own " +
+		"account"
+
+	// ErrRoleInvalid is returned when a user is given a role that
+	// doesn't exist.
+	ErrRoleInvalid modelError = "models: role is not valid"
+
+	// ErrUsernameInvalid is returned when a username isn't made of
+	// 3 to 30 lowercase letters, digits, dashes and underscores, or
+	// doesn't start and end with a letter or digit.
+	ErrUsernameInvalid modelError = "models: usernames must be 3 to " +
+		"30 letters, digits, dashes or underscores, starting and " +
+		"ending with a letter or digit"
+
+	// ErrUsernameReserved is returned when a username is one of
+	// ReservedUsernames.
+	ErrUsernameReserved modelError = "models: that username is reserved"
+
+	// ErrUsernameTaken is returned when a username is already used
+	// by another user.
+	ErrUsernameTaken modelError = "models: that username is already taken"
+
+	// ErrBioTooLong is returned when a bio is longer than MaxBio.
+	ErrBioTooLong modelError = "models: bio must be at most 500 " +
+		"characters long"
+
+	// MaxBio is the longest bio a user can have.
+	MaxBio = 500
+
+	// AccountDeletionGracePeriod is how long we wait before
+	// deleting an account after the user asked us to, giving them
+	// a chance to change their mind.
+	AccountDeletionGracePeriod = 7 * 24 * time.Hour
+
+	// DefaultResetTTL is how long a password reset token is valid
+	// for when UserConfig doesn't say otherwise.
+	DefaultResetTTL = 12 * time.Hour
+
+	// LoginLinkTTL is how long a sign in link sent by email is
+	// valid for.
+	LoginLinkTTL = 15 * time.Minute
+
+	// UserSearchLimit is the maximum number of users returned by
+	// Search.
+	UserSearchLimit = 50
+
 	_ UserDB      = &userGorm{}
 	_ UserService = &userService{}
 )
 
+// ReservedUsernames can't be picked by users, because they are our
+// routes or could be mistaken for us.
+var ReservedUsernames = map[string]bool{
+	"about": true, "account": true, "admin": true, "api": true,
+	"assets": true, "auth": true, "contact": true, "dev": true,
+	"faq": true, "forgot": true, "galleries": true, "help": true,
+	"images": true, "invites": true, "lenslocked": true,
+	"lenslockedbr": true, "login": true, "logout": true,
+	"notifications": true, "reset": true, "root": true,
+	"settings": true, "signup": true, "staff": true, "studios": true,
+	"support": true, "webhooks": true, "www": true,
+}
+
 type User struct {
 	gorm.Model
 	Name         string
@@ -72,8 +165,79 @@ type User struct {
 	Email        string `gorm:"not null;unique_index"`
 	Password     string `gorm:"-"`
 	PasswordHash string `gorm:"not null"`
+	PepperID     string `gorm:"not null;default:''"`
 	Remember     string `gorm:"-"`
 	RememberHash string `gorm:"not nill;unique_index"`
+
+	// Role is either RoleUser or RoleAdmin
+	Role string `gorm:"not null;default:'user'"`
+
+	// Locale is the language we email the user in, eg: "pt-BR"
+	Locale string `gorm:"not null;default:'en'"`
+
+	// NotifyFrequency is how often notifications are emailed, either
+	// NotifyInstant or NotifyDaily
+	NotifyFrequency string `gorm:"not null;default:'instant'"`
+
+	// Username is the optional handle of the public profile of the
+	// user, at /u/{username}. Those set are unique.
+	Username string `gorm:"not null;default:''"`
+	Bio      string `gorm:"type:text;not null;default:''"`
+
+	// AvatarVersion is when, in unix seconds, the user last uploaded
+	// an avatar, so browsers don't show a cached older one. It is
+	// zero when they have none.
+	AvatarVersion int64 `gorm:"not null;default:0"`
+
+	// DisabledAt is set when an admin disabled the account, the
+	// user can't sign in until it is enabled again.
+	DisabledAt *time.Time
+
+	// PurgeAt is set when the user asked for their account to be
+	// deleted. Everything we hold on them is removed once it has
+	// passed, unless the deletion is cancelled before then.
+	PurgeAt *time.Time
+
+	// ReverifyEmailAt is set when emails to the user bounced or
+	// were reported as spam. The user is asked to confirm their
+	// address again, which clears it.
+	ReverifyEmailAt *time.Time
+}
+
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// IsAdmin returns true if the user can access the admin console.
+func (u *User) IsAdmin() bool {
+	return u.Role == RoleAdmin
+}
+
+// ProfileURL returns the path of the public profile of the user, or an
+// empty string if they haven't picked a username.
+func (u *User) ProfileURL() string {
+	if u.Username == "" {
+		return ""
+	}
+
+	return "/u/" + u.Username
+}
+
+// AvatarURL returns the path of the avatar of the user in one of
+// AvatarSizes, or an empty string if they haven't uploaded one.
+func (u *User) AvatarURL(size int) string {
+	if u.AvatarVersion == 0 {
+		return ""
+	}
+
+	a := Avatar{UserID: u.ID, Size: size}
+	return fmt.Sprintf("%s?v=%d", a.Path(), u.AvatarVersion)
+}
+
+// Disabled returns true if an admin disabled the account.
+func (u *User) Disabled() bool {
+	return u.DisabledAt != nil
 }
 
 // UserDB is used to interact with the users database.
@@ -93,11 +257,18 @@ type UserDB interface {
 	// Methods for querying for single users
 	ByID(id uint) (*User, error)
 	ByEmail(email string) (*User, error)
+	ByUsername(username string) (*User, error)
 	ByRemember(token string) (*User, error)
 	ByAge(age int) (*User, error)
 
 	// Methods for querying multiples users
 	InAgeRange(min, max int) ([]User, error)
+	PurgeDue(now time.Time) ([]User, error)
+
+	// Search returns up to UserSearchLimit users whose name or
+	// email address contains the query, newest first. An empty
+	// query returns the newest users.
+	Search(query string) ([]User, error)
 
 	// Methods for altering users
 	Create(user *User) error
@@ -126,31 +297,121 @@ type UserService interface {
 
 	// InitiateReset will complete all the model-related taks to
 	// start the password reset process for the user with the
-	// provided email address. Once completed, it will return the
-	// token, or an error if there was one.
-	InitiateReset(email string) (string, error)
+	// provided email address, and mail them the token along with
+	// it. Any token previously issued to the user stops working.
+	InitiateReset(email string, mail Mail) error
 
 	// CompleteReset will complete all the model-related tasks to
 	// complete the password reset process for the user that the
-	// token matches, including updating that user's pw.
+	// token matches, including updating that user's pw and
+	// setting a new remember token, which signs out every session.
 	// If the token has expired, or if it is invalid for any other
 	// reason the ErrTokenInvalid error will be returned.
 	CompleteReset(token, newPw string) (*User, error)
+
+	// InitiateLoginLink mails a single use token that signs in
+	// the user with the provided email address, replacing any
+	// token previously issued to them.
+	InitiateLoginLink(email string, mail Mail) error
+
+	// CompleteLoginLink returns the user that the token matches,
+	// and makes sure the token can't be used again. If the token
+	// has expired, or if it is invalid for any other reason the
+	// ErrTokenInvalid error will be returned.
+	CompleteLoginLink(token string) (*User, error)
+
+	// ChangePassword will update the user's password after
+	// verifying the current one, returning ErrPasswordIncorrect if
+	// it doesn't match. A new remember token is also set on the
+	// user, which signs out every other session.
+	ChangePassword(user *User, current, newPw string) error
+
+	// InitiateEmailChange will verify the user's password and the
+	// new email address, and then mail the token that must be
+	// used with CompleteEmailChange to apply the change. Any
+	// previous pending change for the user is discarded.
+	InitiateEmailChange(user *User, password, newEmail string, mail Mail) error
+
+	// CompleteEmailChange will update the email address of the
+	// user that the token matches. If the token has expired, or if
+	// it is invalid for any other reason the ErrTokenInvalid error
+	// will be returned.
+	CompleteEmailChange(token string) (*User, error)
+
+	// InitiateEmailReverify mails a token, used with
+	// CompleteEmailChange like the token of an email change, that
+	// confirms the user still receives emails at their current
+	// address.
+	InitiateEmailReverify(user *User, mail Mail) error
+
+	// RequireEmailReverify flags the user as having to confirm
+	// their email address again.
+	RequireEmailReverify(user *User) error
+
+	// ScheduleDeletion will verify the user's password and mark
+	// the account to be purged once AccountDeletionGracePeriod has
+	// passed, and mail the user about it. A new remember token is
+	// set on the user, which signs out every other session.
+	ScheduleDeletion(user *User, password string, mail Mail) error
+
+	// CancelDeletion will unmark an account scheduled for deletion.
+	CancelDeletion(user *User) error
+
+	// Disable prevents the user from signing in, and signs out
+	// every session they have.
+	Disable(user *User) error
+
+	// Enable lets a disabled user sign in again.
+	Enable(user *User) error
+}
+
+// UserConfig holds the settings of the user service.
+type UserConfig struct {
+	// PasswordHash are the argon2id params used for new hashes.
+	PasswordHash hash.Argon2Params
+
+	// BreachCorpus is the path of a breached password corpus that
+	// new passwords are checked against. It is optional, see
+	// BreachCorpus.
+	BreachCorpus string
+
+	// ResetTTL is how long a password reset token is valid for.
+	// DefaultResetTTL is used when it is zero.
+	ResetTTL time.Duration
 }
 
 type userService struct {
 	UserDB
-	pepper    string
-	pwResetDB pwResetDB
+	db            *gorm.DB
+	outbox        OutboxService
+	uv            *userValidator
+	peppers       hash.Keyring
+	hasher        hash.PasswordHasher
+	pwResetDB     pwResetDB
+	emailChangeDB emailChangeDB
+	loginLinkDB   loginLinkDB
+	resetTTL      time.Duration
+
+	// dummyHash is compared against when no user exists with the
+	// email address provided to Authenticate, so that a failed
+	// login takes about the same time whether or not the account
+	// exists.
+	dummyHash string
 }
 
 // userValidator is our validation layer that validates and normalizes
 // data before passing it on to the next UserDB in our interface chain.
 type userValidator struct {
 	UserDB
-	hmac       hash.HMAC
-	pepper     string
-	emailRegex *regexp.Regexp
+	hmac          hash.HMAC
+	hasher        hash.PasswordHasher
+	peppers       hash.Keyring
+	emailRegex    *regexp.Regexp
+	usernameRegex *regexp.Regexp
+
+	// breached is optional, when nil passwords are not checked
+	// against a breach corpus.
+	breached *BreachCorpus
 }
 
 type userValFn func(*User) error
@@ -188,11 +449,22 @@ func (e modelError) Public() string {
 // need to return a pointer here. Don't forget to update this first
 // line - we removed the * character at the end where we write
 // (UserService, error)
-func NewUserService(db *gorm.DB, pepper, hmacKey string) UserService {
+func NewUserService(db *gorm.DB, peppers hash.Keyring, hmac hash.HMAC,
+	cfg UserConfig, breached *BreachCorpus) UserService {
 
 	u := &userGorm{db}
-	hmac := hash.NewHMAC(hmacKey)
-	uv := newUserValidator(u, hmac, pepper)
+	hasher := hash.NewPasswordHasher(cfg.PasswordHash)
+	uv := newUserValidator(u, hmac, hasher, peppers)
+	uv.breached = breached
+
+	// The error is ignored on purpose: it only happens if we can't
+	// read random bytes, and an empty hash still fails to compare.
+	dummyHash, _ := hasher.Hash("lenslockedbr.com")
+
+	resetTTL := cfg.ResetTTL
+	if resetTTL <= 0 {
+		resetTTL = DefaultResetTTL
+	}
 
 	// We also need to update how we construct the user service.
 	// We no longer have a UserService type to construct, and
@@ -202,18 +474,32 @@ func NewUserService(db *gorm.DB, pepper, hmacKey string) UserService {
 	//   func (us *userService) <- this uses a pointer
 	return &userService{
 		UserDB:    uv,
-		pepper:    pepper,
+		db:        db,
+		outbox:    NewOutboxService(db),
+		uv:        uv,
+		peppers:   peppers,
+		hasher:    hasher,
 		pwResetDB: newPwResetValidator(&pwResetGorm{db}, hmac),
+		emailChangeDB: newEmailChangeValidator(&emailChangeGorm{db},
+			hmac),
+		loginLinkDB: newLoginLinkValidator(&loginLinkGorm{db},
+			hmac),
+		dummyHash: dummyHash,
+		resetTTL:  resetTTL,
 	}
 }
 
-func newUserValidator(udb UserDB, hmac hash.HMAC, pepper string) *userValidator {
+func newUserValidator(udb UserDB, hmac hash.HMAC,
+	hasher hash.PasswordHasher, peppers hash.Keyring) *userValidator {
 	return &userValidator{
-		UserDB: udb,
-		hmac:   hmac,
-		pepper: pepper,
+		UserDB:  udb,
+		hmac:    hmac,
+		hasher:  hasher,
+		peppers: peppers,
 		emailRegex: regexp.MustCompile(
 			`^[a-z0-9._%+\-]+@[a-z0-9.\-]+\.[a-z]{2,16}$`),
+		usernameRegex: regexp.MustCompile(
+			`^[a-z0-9][a-z0-9_\-]{1,28}[a-z0-9]$`),
 	}
 }
 
@@ -223,7 +509,10 @@ func (u *userValidator) Create(user *User) error {
 
 	err := runUserValFns(user, u.passwordRequired,
 		u.passwordMinLength,
-		u.bcryptPassword,
+		u.passwordNotCommon,
+		u.passwordNotPersonal,
+		u.passwordNotBreached,
+		u.hashPassword,
 		u.passwordHashRequired,
 		u.setRememberIfUnset,
 		u.rememberMinBytes,
@@ -232,7 +521,14 @@ func (u *userValidator) Create(user *User) error {
 		u.normalizeEmail,
 		u.requireEmail,
 		u.emailFormat,
-		u.emailIsAvail)
+		u.emailIsAvail,
+		u.normalizeUsername,
+		u.usernameFormat,
+		u.usernameNotReserved,
+		u.usernameIsAvail,
+		u.bioLength,
+		u.roleValid,
+		u.notifyFrequencyValid)
 	if err != nil {
 		return err
 	}
@@ -243,14 +539,17 @@ func (u *userValidator) Create(user *User) error {
 // Create will create the provided user and backfill data like
 // the ID, CreatedAt, and UpdatedAt fields.
 func (u *userGorm) Create(user *User) error {
-	return u.db.Create(user).Error
+	return usernameTaken(u.db.Create(user).Error)
 }
 
 // Update will hash a remember token if it is provided
 func (u *userValidator) Update(user *User) error {
 
 	err := runUserValFns(user, u.passwordMinLength,
-		u.bcryptPassword,
+		u.passwordNotCommon,
+		u.passwordNotPersonal,
+		u.passwordNotBreached,
+		u.hashPassword,
 		u.passwordHashRequired,
 		u.rememberMinBytes,
 		u.hmacRemember,
@@ -258,7 +557,14 @@ func (u *userValidator) Update(user *User) error {
 		u.normalizeEmail,
 		u.requireEmail,
 		u.emailFormat,
-		u.emailIsAvail)
+		u.emailIsAvail,
+		u.normalizeUsername,
+		u.usernameFormat,
+		u.usernameNotReserved,
+		u.usernameIsAvail,
+		u.bioLength,
+		u.roleValid,
+		u.notifyFrequencyValid)
 	if err != nil {
 		return err
 	}
@@ -269,7 +575,7 @@ func (u *userValidator) Update(user *User) error {
 // Update will update the provided user with all of the data in
 // the provided user object.
 func (u *userGorm) Update(user *User) error {
-	return u.db.Save(user).Error
+	return usernameTaken(u.db.Save(user).Error)
 }
 
 // Delete will delete the user with the provided ID
@@ -301,41 +607,88 @@ func (u *userGorm) Delete(id uint) error {
 // If the email and password are both valid, this will return
 // user, nil
 // Otherwise if another error is encountered this will return nil, error
+//
+// Legacy bcrypt hashes, argon2id hashes using outdated params, and
+// hashes made with a previous pepper are transparently upgraded once
+// the password has been verified.
 func (u *userService) Authenticate(email, password string) (*User, error) {
 	foundUser, err := u.ByEmail(email)
 	if err != nil {
+		if err == ErrNotFound {
+			u.hasher.Compare(u.dummyHash,
+				password+u.peppers.Current().Secret)
+		}
 		return nil, err
 	}
 
-	err = bcrypt.CompareHashAndPassword(
-		[]byte(foundUser.PasswordHash),
-		[]byte(password+u.pepper))
+	if err := u.checkPassword(foundUser, password); err != nil {
+		return nil, err
+	}
+
+	// Only told once the password is right, so that it doesn't
+	// help anyone guessing passwords.
+	if foundUser.Disabled() {
+		return nil, ErrAccountDisabled
+	}
+
+	if u.hasher.NeedsRehash(foundUser.PasswordHash) ||
+		foundUser.PepperID != u.peppers.Current().ID {
+		// We already know the password is right, so we hash it
+		// directly instead of running it through the password
+		// rules again. If this fails we'll try on the next login.
+		foundUser.Password = password
+		if err := u.uv.hashPassword(foundUser); err == nil {
+			u.Update(foundUser)
+		}
+	}
+
+	return foundUser, nil
+}
+
+// checkPassword compares the password provided with the user's
+// password hash, using the pepper the hash was made with. It returns
+// ErrPasswordIncorrect if they don't match.
+func (u *userService) checkPassword(user *User, password string) error {
+	pepper, ok := u.peppers.ByID(user.PepperID)
+	if !ok {
+		return ErrPepperNotFound
+	}
+
+	err := u.hasher.Compare(user.PasswordHash, password+pepper.Secret)
 
 	switch err {
 	case nil:
-		return foundUser, nil
-	case bcrypt.ErrMismatchedHashAndPassword:
-		return nil, ErrPasswordIncorrect
+		return nil
+	case hash.ErrPasswordMismatch:
+		return ErrPasswordIncorrect
 	default:
-		return nil, err
+		return err
 	}
 }
 
-func (u *userService) InitiateReset(email string) (string, error) {
+func (u *userService) InitiateReset(email string, mail Mail) error {
 
 	user, err := u.ByEmail(email)
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	pwr := pwReset{
-		UserID: user.ID,
-	}
-	if err := u.pwResetDB.Create(&pwr); err != nil {
-		return "", err
-	}
+	return u.transaction(func(tu *userService, tx *gorm.DB) error {
+
+		// Only the latest token sent to the user may be used
+		if err := tu.pwResetDB.DeleteByUserID(user.ID); err != nil {
+			return err
+		}
 
-	return pwr.Token, nil
+		pwr := pwReset{
+			UserID: user.ID,
+		}
+		if err := tu.pwResetDB.Create(&pwr); err != nil {
+			return err
+		}
+
+		return mail(pwr.Token, u.outbox.Sender(tx))
+	})
 }
 
 func (u *userService) CompleteReset(token, newPw string) (*User, error) {
@@ -348,7 +701,7 @@ func (u *userService) CompleteReset(token, newPw string) (*User, error) {
 		return nil, err
 	}
 
-	if time.Now().Sub(pwr.CreatedAt) > (12 * time.Hour) {
+	if time.Now().Sub(pwr.CreatedAt) > u.resetTTL {
 		return nil, ErrTokenInvalid
 	}
 
@@ -357,20 +710,302 @@ func (u *userService) CompleteReset(token, newPw string) (*User, error) {
 		return nil, err
 	}
 
+	// Whoever asked for the reset may not be the only one holding
+	// a session, so all of them are signed out.
+	remember, err := rand.RememberToken()
+	if err != nil {
+		return nil, err
+	}
+
+	user.Password = newPw
+	user.Remember = remember
+	err = u.Update(user)
+	if err != nil {
+		return nil, err
+	}
+
+	u.pwResetDB.DeleteByUserID(user.ID)
+
+	return user, nil
+}
+
+func (u *userService) InitiateLoginLink(email string, mail Mail) error {
+
+	user, err := u.ByEmail(email)
+	if err != nil {
+		return err
+	}
+
+	return u.transaction(func(tu *userService, tx *gorm.DB) error {
+
+		if err := tu.loginLinkDB.DeleteByUserID(user.ID); err != nil {
+			return err
+		}
+
+		ll := loginLink{
+			UserID: user.ID,
+		}
+		if err := tu.loginLinkDB.Create(&ll); err != nil {
+			return err
+		}
+
+		return mail(ll.Token, u.outbox.Sender(tx))
+	})
+}
+
+func (u *userService) CompleteLoginLink(token string) (*User, error) {
+
+	ll, err := u.loginLinkDB.ByToken(token)
+	if err != nil {
+		if err == ErrNotFound {
+			return nil, ErrTokenInvalid
+		}
+		return nil, err
+	}
+
+	// Used or not, the link is gone once someone clicks it
+	if err := u.loginLinkDB.Delete(ll.ID); err != nil {
+		return nil, err
+	}
+
+	if time.Now().Sub(ll.CreatedAt) > LoginLinkTTL {
+		return nil, ErrTokenInvalid
+	}
+
+	return u.ByID(ll.UserID)
+}
+
+func (u *userService) ChangePassword(user *User, current, newPw string) error {
+
+	if err := u.checkPassword(user, current); err != nil {
+		return err
+	}
+
+	if newPw == "" {
+		return ErrPasswordRequired
+	}
+
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+
 	user.Password = newPw
+	user.Remember = token
+
+	return u.Update(user)
+}
+
+func (u *userService) InitiateEmailChange(user *User, password, newEmail string, mail Mail) error {
+
+	if err := u.checkPassword(user, password); err != nil {
+		return err
+	}
+
+	// Run the new address through the same chain used when
+	// creating or updating a user, but without saving it yet.
+	change := User{
+		Model: gorm.Model{ID: user.ID},
+		Email: newEmail,
+	}
+	err := runUserValFns(&change, u.uv.normalizeEmail,
+		u.uv.requireEmail,
+		u.uv.emailFormat,
+		u.uv.emailIsAvail)
+	if err != nil {
+		return err
+	}
+
+	if change.Email == user.Email {
+		return ErrEmailUnchanged
+	}
+
+	return u.transaction(func(tu *userService, tx *gorm.DB) error {
+
+		if err := tu.emailChangeDB.DeleteByUserID(user.ID); err != nil {
+			return err
+		}
+
+		ec := emailChange{
+			UserID: user.ID,
+			Email:  change.Email,
+		}
+		if err := tu.emailChangeDB.Create(&ec); err != nil {
+			return err
+		}
+
+		return mail(ec.Token, u.outbox.Sender(tx))
+	})
+}
+
+func (u *userService) CompleteEmailChange(token string) (*User, error) {
+
+	ec, err := u.emailChangeDB.ByToken(token)
+	if err != nil {
+		if err == ErrNotFound {
+			return nil, ErrTokenInvalid
+		}
+		return nil, err
+	}
+
+	if time.Now().Sub(ec.CreatedAt) > (24 * time.Hour) {
+		return nil, ErrTokenInvalid
+	}
+
+	user, err := u.ByID(ec.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	user.Email = ec.Email
+	user.ReverifyEmailAt = nil
 	err = u.Update(user)
 	if err != nil {
 		return nil, err
 	}
 
-	u.pwResetDB.Delete(pwr.ID)
+	u.emailChangeDB.Delete(ec.ID)
 
 	return user, nil
 }
 
-// bcryptPassword will hash a user's password with an app-wide pepper
-// and bcrypt, which salts for us.
-func (u *userValidator) bcryptPassword(user *User) error {
+func (u *userService) InitiateEmailReverify(user *User, mail Mail) error {
+	return u.transaction(func(tu *userService, tx *gorm.DB) error {
+
+		if err := tu.emailChangeDB.DeleteByUserID(user.ID); err != nil {
+			return err
+		}
+
+		ec := emailChange{
+			UserID: user.ID,
+			Email:  user.Email,
+		}
+		if err := tu.emailChangeDB.Create(&ec); err != nil {
+			return err
+		}
+
+		return mail(ec.Token, u.outbox.Sender(tx))
+	})
+}
+
+func (u *userService) RequireEmailReverify(user *User) error {
+
+	if user.ReverifyEmailAt != nil {
+		return nil
+	}
+
+	now := time.Now()
+	user.ReverifyEmailAt = &now
+
+	return u.Update(user)
+}
+
+func (u *userService) ScheduleDeletion(user *User, password string, mail Mail) error {
+
+	if err := u.checkPassword(user, password); err != nil {
+		return err
+	}
+
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+
+	purgeAt := time.Now().Add(AccountDeletionGracePeriod)
+	user.PurgeAt = &purgeAt
+	user.Remember = token
+
+	return u.transaction(func(tu *userService, tx *gorm.DB) error {
+		if err := tu.Update(user); err != nil {
+			return err
+		}
+
+		return mail("", u.outbox.Sender(tx))
+	})
+}
+
+// transaction runs fn with a copy of the service that reads and writes
+// within a transaction, along with the transaction itself. It is only
+// committed if fn succeeds.
+func (u *userService) transaction(fn func(tu *userService,
+	tx *gorm.DB) error) error {
+
+	return transaction(u.db, func(tx *gorm.DB) error {
+		uv := *u.uv
+		uv.UserDB = &userGorm{tx}
+
+		tu := *u
+		tu.UserDB = &uv
+		tu.uv = &uv
+		tu.pwResetDB = newPwResetValidator(&pwResetGorm{tx}, uv.hmac)
+		tu.emailChangeDB = newEmailChangeValidator(
+			&emailChangeGorm{tx}, uv.hmac)
+		tu.loginLinkDB = newLoginLinkValidator(&loginLinkGorm{tx},
+			uv.hmac)
+
+		return fn(&tu, tx)
+	})
+}
+
+func (u *userService) CancelDeletion(user *User) error {
+	user.PurgeAt = nil
+	return u.Update(user)
+}
+
+func (u *userService) Disable(user *User) error {
+
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	user.DisabledAt = &now
+	user.Remember = token
+
+	return u.Update(user)
+}
+
+func (u *userService) Enable(user *User) error {
+	user.DisabledAt = nil
+	return u.Update(user)
+}
+
+// notifyFrequencyValid defaults the frequency to NotifyInstant, and
+// makes sure it is one of the frequencies we know about.
+func (u *userValidator) notifyFrequencyValid(user *User) error {
+
+	switch user.NotifyFrequency {
+	case "":
+		user.NotifyFrequency = NotifyInstant
+	case NotifyInstant, NotifyDaily:
+	default:
+		return ErrNotifyFrequencyInvalid
+	}
+
+	return nil
+}
+
+// roleValid defaults the role to RoleUser, and makes sure it is one
+// of the roles we know about.
+func (u *userValidator) roleValid(user *User) error {
+
+	switch user.Role {
+	case "":
+		user.Role = RoleUser
+	case RoleUser, RoleAdmin:
+	default:
+		return ErrRoleInvalid
+	}
+
+	return nil
+}
+
+// hashPassword will hash a user's password with the current app-wide
+// pepper and argon2id, which salts for us. Unlike bcrypt, argon2id
+// doesn't silently ignore anything past the first 72 bytes of the
+// password. The ID of the pepper is kept so it can be rotated.
+func (u *userValidator) hashPassword(user *User) error {
 
 	if user.Password == "" {
 		// We DO NOT need to run this if the password
@@ -378,14 +1013,14 @@ func (u *userValidator) bcryptPassword(user *User) error {
 		return nil
 	}
 
-	pwBytes := []byte(user.Password + u.pepper)
-	hashedBytes, err := bcrypt.GenerateFromPassword(pwBytes,
-		bcrypt.DefaultCost)
+	pepper := u.peppers.Current()
+	hashed, err := u.hasher.Hash(user.Password + pepper.Secret)
 	if err != nil {
 		return err
 	}
 
-	user.PasswordHash = string(hashedBytes)
+	user.PasswordHash = hashed
+	user.PepperID = pepper.ID
 	user.Password = ""
 
 	return nil
@@ -476,6 +1111,65 @@ func (u *userValidator) emailIsAvail(user *User) error {
 	return nil
 }
 
+func (u *userValidator) normalizeUsername(user *User) error {
+	user.Username = strings.ToLower(strings.TrimSpace(user.Username))
+	user.Username = strings.TrimPrefix(user.Username, "@")
+
+	return nil
+}
+
+// usernameFormat lets usernames be empty, as they are optional.
+func (u *userValidator) usernameFormat(user *User) error {
+	if user.Username == "" {
+		return nil
+	}
+
+	if !u.usernameRegex.MatchString(user.Username) {
+		return ErrUsernameInvalid
+	}
+
+	return nil
+}
+
+func (u *userValidator) usernameNotReserved(user *User) error {
+	if ReservedUsernames[user.Username] {
+		return ErrUsernameReserved
+	}
+
+	return nil
+}
+
+func (u *userValidator) usernameIsAvail(user *User) error {
+	if user.Username == "" {
+		return nil
+	}
+
+	existing, err := u.ByUsername(user.Username)
+	if err == ErrNotFound {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if user.ID != existing.ID {
+		return ErrUsernameTaken
+	}
+
+	return nil
+}
+
+func (u *userValidator) bioLength(user *User) error {
+	user.Bio = strings.TrimSpace(user.Bio)
+
+	if len(user.Bio) > MaxBio {
+		return ErrBioTooLong
+	}
+
+	return nil
+}
+
 func (u *userValidator) passwordMinLength(user *User) error {
 	if user.Password == "" {
 		return nil
@@ -488,6 +1182,63 @@ func (u *userValidator) passwordMinLength(user *User) error {
 	return nil
 }
 
+func (u *userValidator) passwordNotCommon(user *User) error {
+	if user.Password == "" {
+		return nil
+	}
+
+	if commonPasswords.Contains(user.Password) {
+		return ErrPasswordTooCommon
+	}
+
+	return nil
+}
+
+// passwordNotPersonal rejects passwords containing the user's email
+// address, the part of it before the @, their full name, or any part
+// of their name long enough to matter.
+func (u *userValidator) passwordNotPersonal(user *User) error {
+	if user.Password == "" {
+		return nil
+	}
+
+	pw := strings.ToLower(user.Password)
+	email := strings.ToLower(strings.TrimSpace(user.Email))
+	name := strings.ToLower(user.Name)
+
+	personal := strings.Fields(name)
+	personal = append(personal, strings.Join(personal, ""))
+	if email != "" {
+		personal = append(personal, email,
+			strings.SplitN(email, "@", 2)[0])
+	}
+
+	for _, p := range personal {
+		if len(p) >= 4 && strings.Contains(pw, p) {
+			return ErrPasswordPersonal
+		}
+	}
+
+	return nil
+}
+
+func (u *userValidator) passwordNotBreached(user *User) error {
+	if user.Password == "" || u.breached == nil {
+		return nil
+	}
+
+	found, err := u.breached.Contains(user.Password)
+	if err != nil {
+		return err
+	}
+
+	if found {
+		return ErrPasswordBreached
+	}
+
+	return nil
+}
+
 func (u *userValidator) passwordRequired(user *User) error {
 	if user.Password == "" {
 		return ErrPasswordRequired
@@ -590,6 +1341,55 @@ func (u *userValidator) ByEmail(email string) (*User, error) {
 	return u.UserDB.ByEmail(user.Email)
 }
 
+// ByUsername looks up the user with the username.
+func (u *userGorm) ByUsername(username string) (*User, error) {
+	var user User
+
+	db := u.db.Where("username = ?", username)
+	if err := first(db, &user); err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// usernameIndex is the unique index on the usernames of users, see
+// Services.AutoMigrate.
+const usernameIndex = "idx_users_lower_username"
+
+// usernameTaken returns ErrUsernameTaken in place of the error of
+// breaking usernameIndex, which is what happens when two users pick
+// the same username at once, after both passed usernameIsAvail.
+func usernameTaken(err error) error {
+	if pqErr, ok := err.(*pq.Error); ok &&
+		pqErr.Code.Name() == "unique_violation" &&
+		pqErr.Constraint == usernameIndex {
+		return ErrUsernameTaken
+	}
+
+	return err
+}
+
+// ByUsername will normalize the username before passing it on to the
+// database layer to perform the query. Users without a username are
+// never found.
+func (u *userValidator) ByUsername(username string) (*User, error) {
+	user := User{
+		Username: username,
+	}
+
+	err := runUserValFns(&user, u.normalizeUsername)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.Username == "" {
+		return nil, ErrNotFound
+	}
+
+	return u.UserDB.ByUsername(user.Username)
+}
+
 // ByAge will look up a user with the provided age.
 // If the user is found, we will return a nil error
 // If the user is not found, we will return ErrNotFound
@@ -639,18 +1439,65 @@ func (u *userGorm) ByRemember(rememberHashed string) (*User, error) {
 }
 
 // ByRemember will hash the remember token and then call ByRemember on
-// the subsequent UserDB layer.
+// the subsequent UserDB layer. Since the token may have been hashed
+// with a previous HMAC key, every key is tried, and a match on an old
+// key is re-hashed with the current one.
 func (u *userValidator) ByRemember(token string) (*User, error) {
 
-	user := User{
-		Remember: token,
+	for _, hashed := range u.hmac.HashAll(token) {
+		user, err := u.UserDB.ByRemember(hashed)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if !u.hmac.IsCurrent(user.RememberHash) {
+			user.Remember = token
+			if err := u.Update(user); err != nil {
+				return nil, err
+			}
+		}
+
+		return user, nil
 	}
 
-	if err := runUserValFns(&user, u.hmacRemember); err != nil {
+	return nil, ErrNotFound
+}
+
+// PurgeDue returns every user whose account deletion was scheduled
+// to happen before now.
+func (u *userGorm) PurgeDue(now time.Time) ([]User, error) {
+
+	users := make([]User, 0)
+
+	db := u.db.Where("purge_at IS NOT NULL AND purge_at <= ?", now)
+	err := all(db, &users)
+	if err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// Search looks for users by name or email address.
+func (u *userGorm) Search(query string) ([]User, error) {
+
+	users := make([]User, 0)
+
+	db := u.db.Order("created_at DESC").Limit(UserSearchLimit)
+	if query != "" {
+		like := "%" + escapeLike(strings.ToLower(query)) + "%"
+		db = db.Where("LOWER(name) LIKE ? OR email LIKE ?", like,
+			like)
+	}
+
+	if err := all(db, &users); err != nil {
 		return nil, err
 	}
 
-	return u.UserDB.ByRemember(user.RememberHash)
+	return users, nil
 }
 
 /////////////////////////////////////////////////////////////////////
@@ -659,11 +1506,9 @@ func (u *userValidator) ByRemember(token string) (*User, error) {
 //
 /////////////////////////////////////////////////////////////////////
 
-//
 // first will query using the provided gorm.DB and it will get
 // the first item returned and place it into dst. If nothing is
 // found in the query, it will return ErrNotFound
-//
 func first(db *gorm.DB, dst interface{}) error {
 	err := db.First(dst).Error
 	if err == gorm.ErrRecordNotFound {
@@ -679,3 +1524,10 @@ func all(db *gorm.DB, dst interface{}) error {
 	}
 	return err
 }
+
+// escapeLike escapes the characters with a special meaning in a LIKE
+// pattern, so they only match themselves.
+func escapeLike(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+	return r.Replace(s)
+}
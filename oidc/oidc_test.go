@@ -0,0 +1,286 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const (
+	testClientID = "lenslocked"
+	testNonce    = "the-nonce"
+	testKid      = "key-1"
+)
+
+// mockIssuer is an OpenID Connect provider listening on localhost. Its
+// token endpoint hands out whatever ID token is set on it.
+type mockIssuer struct {
+	*httptest.Server
+	key     *rsa.PrivateKey
+	idToken string
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &mockIssuer{key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration",
+		func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, map[string]string{
+				"issuer":                 m.URL,
+				"authorization_endpoint": m.URL + "/authorize",
+				"token_endpoint":         m.URL + "/token",
+				"jwks_uri":               m.URL + "/jwks",
+			})
+		})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		pub := m.key.PublicKey
+		writeJSON(w, map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": testKid,
+				"use": "sig",
+				"n": base64.RawURLEncoding.EncodeToString(
+					pub.N.Bytes()),
+				"e": base64.RawURLEncoding.EncodeToString(
+					big.NewInt(int64(pub.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost ||
+			r.FormValue("code") != "the-code" {
+			w.WriteHeader(http.StatusBadRequest)
+			writeJSON(w, map[string]string{"error": "invalid_grant"})
+			return
+		}
+		writeJSON(w, map[string]string{"id_token": m.idToken})
+	})
+
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+
+	return m
+}
+
+// claims returns the claims of a valid ID token for testClientID.
+func (m *mockIssuer) claims() map[string]interface{} {
+	now := time.Now()
+
+	return map[string]interface{}{
+		"iss":            m.URL,
+		"sub":            "1234",
+		"aud":            testClientID,
+		"exp":            now.Add(time.Hour).Unix(),
+		"iat":            now.Unix(),
+		"nonce":          testNonce,
+		"email":          "jon@example.com",
+		"email_verified": true,
+	}
+}
+
+// sign makes an RS256 ID token of the claims signed with key.
+func sign(t *testing.T, key *rsa.PrivateKey, claims interface{}) string {
+	t.Helper()
+
+	header, err := json.Marshal(map[string]string{
+		"alg": "RS256",
+		"kid": testKid,
+		"typ": "JWT",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." +
+		base64.RawURLEncoding.EncodeToString(payload)
+
+	sum := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func TestExchange(t *testing.T) {
+
+	m := newMockIssuer(t)
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		key    *rsa.PrivateKey
+		modify func(c map[string]interface{})
+		valid  bool
+	}{
+		{
+			name:  "valid",
+			valid: true,
+		},
+		{
+			name: "signed by another key",
+			key:  otherKey,
+		},
+		{
+			name: "wrong issuer",
+			modify: func(c map[string]interface{}) {
+				c["iss"] = "https://evil.example.com"
+			},
+		},
+		{
+			name: "wrong audience",
+			modify: func(c map[string]interface{}) {
+				c["aud"] = "someone-else"
+			},
+		},
+		{
+			name: "several audiences without azp",
+			modify: func(c map[string]interface{}) {
+				c["aud"] = []string{testClientID, "someone-else"}
+			},
+		},
+		{
+			name: "several audiences authorized to another party",
+			modify: func(c map[string]interface{}) {
+				c["aud"] = []string{testClientID, "someone-else"}
+				c["azp"] = "someone-else"
+			},
+		},
+		{
+			name: "several audiences authorized to us",
+			modify: func(c map[string]interface{}) {
+				c["aud"] = []string{testClientID, "someone-else"}
+				c["azp"] = testClientID
+			},
+			valid: true,
+		},
+		{
+			name: "wrong nonce",
+			modify: func(c map[string]interface{}) {
+				c["nonce"] = "another-nonce"
+			},
+		},
+		{
+			name: "expired",
+			modify: func(c map[string]interface{}) {
+				c["exp"] = time.Now().Add(-clockSkew - time.Minute).Unix()
+			},
+		},
+		{
+			name: "expired within the clock skew",
+			modify: func(c map[string]interface{}) {
+				c["exp"] = time.Now().Add(-clockSkew / 2).Unix()
+			},
+			valid: true,
+		},
+		{
+			name: "no subject",
+			modify: func(c map[string]interface{}) {
+				delete(c, "sub")
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+
+			claims := m.claims()
+			if tc.modify != nil {
+				tc.modify(claims)
+			}
+
+			key := tc.key
+			if key == nil {
+				key = m.key
+			}
+			m.idToken = sign(t, key, claims)
+
+			p := NewProvider(Config{
+				Issuer:      m.URL,
+				ClientID:    testClientID,
+				RedirectURL: "http://localhost:3000/oidc/callback",
+			}, m.Client())
+
+			got, err := p.Exchange(context.Background(), "the-code",
+				testNonce)
+
+			if !tc.valid {
+				if !errors.Is(err, ErrInvalidToken) {
+					t.Fatalf("Exchange() error = %v, want %v",
+						err, ErrInvalidToken)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Exchange() error = %v", err)
+			}
+			if got.Subject != "1234" || got.Email != "jon@example.com" {
+				t.Errorf("Exchange() = %+v", got)
+			}
+		})
+	}
+}
+
+func TestExchangeBadCode(t *testing.T) {
+
+	m := newMockIssuer(t)
+
+	p := NewProvider(Config{
+		Issuer:   m.URL,
+		ClientID: testClientID,
+	}, m.Client())
+
+	_, err := p.Exchange(context.Background(), "wrong-code", testNonce)
+	if !errors.Is(err, ErrExchange) {
+		t.Fatalf("Exchange() error = %v, want %v", err, ErrExchange)
+	}
+}
+
+func TestDiscoverWrongIssuer(t *testing.T) {
+
+	m := newMockIssuer(t)
+
+	// The discovery document names the server's URL, not this one
+	p := NewProvider(Config{
+		Issuer:   m.URL + "/",
+		ClientID: testClientID,
+	}, m.Client())
+
+	_, err := p.AuthCodeURL(context.Background(), "state", testNonce)
+	if err == nil {
+		t.Fatal("AuthCodeURL() error = nil, want issuer mismatch")
+	}
+}
@@ -0,0 +1,218 @@
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// keysRefreshEvery limits how often the signing keys are fetched again
+// when an ID token is signed with a key we don't know yet.
+const keysRefreshEvery = time.Minute
+
+var (
+	// ErrExchange is returned by Exchange when the provider doesn't
+	// give us an ID token for the authorization code.
+	ErrExchange = errors.New("oidc: authorization code exchange failed")
+)
+
+// Config holds what we need to know about the provider and about our
+// registration with it. Issuer is the URL the provider identifies
+// itself with, eg: https://accounts.google.com, and is where its
+// discovery document is looked up. Any issuer works, including a mock
+// provider listening on http://localhost.
+type Config struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+
+	// Scopes defaults to openid, email and profile.
+	Scopes []string
+}
+
+// Provider signs users in with an OpenID Connect provider using the
+// authorization code flow.
+type Provider struct {
+	cfg    Config
+	client *http.Client
+
+	// now is used to validate the expiration of ID tokens
+	now func() time.Time
+
+	mu            sync.Mutex
+	meta          *metadata
+	keys          map[string]publicKey
+	keysFetchedAt time.Time
+}
+
+// metadata is the part of the discovery document that we use.
+type metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// NewProvider creates a Provider. The discovery document is only
+// fetched when it is first needed, so the application can start while
+// the provider is unreachable. If client is nil one with a sensible
+// timeout is used.
+func NewProvider(cfg Config, client *http.Client) *Provider {
+
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"openid", "email", "profile"}
+	}
+
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	return &Provider{
+		cfg:    cfg,
+		client: client,
+		now:    time.Now,
+	}
+}
+
+// AuthCodeURL returns the URL of the provider's login page that the
+// user should be redirected to. The state and nonce must be kept by
+// the caller and checked again when the user comes back.
+func (p *Provider) AuthCodeURL(ctx context.Context, state, nonce string) (string, error) {
+
+	meta, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", p.cfg.ClientID)
+	v.Set("redirect_uri", p.cfg.RedirectURL)
+	v.Set("scope", strings.Join(p.cfg.Scopes, " "))
+	v.Set("state", state)
+	v.Set("nonce", nonce)
+
+	sep := "?"
+	if strings.Contains(meta.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+
+	return meta.AuthorizationEndpoint + sep + v.Encode(), nil
+}
+
+// Exchange trades the authorization code the provider sent the user
+// back with for an ID token, verifies it and returns its claims. The
+// nonce is the one given to AuthCodeURL.
+func (p *Provider) Exchange(ctx context.Context, code, nonce string) (*Claims, error) {
+
+	meta, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.cfg.RedirectURL)
+	form.Set("client_id", p.cfg.ClientID)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID),
+		url.QueryEscape(p.cfg.ClientSecret))
+
+	var token struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	err = json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&token)
+	if err != nil && resp.StatusCode == http.StatusOK {
+		return nil, err
+	}
+
+	if token.Error != "" {
+		return nil, fmt.Errorf("%w: %s %s", ErrExchange, token.Error,
+			token.ErrorDescription)
+	}
+	if resp.StatusCode != http.StatusOK || token.IDToken == "" {
+		return nil, fmt.Errorf("%w: status %d", ErrExchange,
+			resp.StatusCode)
+	}
+
+	return p.verify(ctx, meta, token.IDToken, nonce)
+}
+
+// discover fetches and caches the provider's discovery document.
+func (p *Provider) discover(ctx context.Context) (*metadata, error) {
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.meta != nil {
+		return p.meta, nil
+	}
+
+	var meta metadata
+
+	wellKnown := strings.TrimSuffix(p.cfg.Issuer, "/") +
+		"/.well-known/openid-configuration"
+	if err := p.getJSON(ctx, wellKnown, &meta); err != nil {
+		return nil, err
+	}
+
+	if meta.Issuer != p.cfg.Issuer {
+		return nil, fmt.Errorf("oidc: issuer %q does not match the "+
+			"configured one %q", meta.Issuer, p.cfg.Issuer)
+	}
+	if meta.AuthorizationEndpoint == "" || meta.TokenEndpoint == "" ||
+		meta.JWKSURI == "" {
+		return nil, errors.New("oidc: incomplete discovery document")
+	}
+
+	p.meta = &meta
+
+	return p.meta, nil
+}
+
+func (p *Provider) getJSON(ctx context.Context, url string, v interface{}) error {
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("oidc: GET %s: status %d", url,
+			resp.StatusCode)
+	}
+
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"lenslockedbr.com/email"
+	"lenslockedbr.com/models"
+)
+
+// outboxBatch is how many messages deliverEmails sends at a time.
+const outboxBatch = 50
+
+// deliverEmails sends, every interval, the messages of the outbox that
+// are due with the sender. Sent messages are deleted once
+// models.OutboxRetention has passed. It is meant to be run in its own
+// goroutine and never returns.
+func deliverEmails(services *models.Services, sender email.Sender,
+	interval time.Duration) {
+
+	for {
+		messages, err := services.Outbox.Claim(time.Now(), outboxBatch)
+		if err != nil {
+			log.Println("deliver emails:", err)
+		}
+
+		for _, m := range messages {
+			m := m
+			deliverEmail(services, sender, &m)
+		}
+
+		before := time.Now().Add(-models.OutboxRetention)
+		if err := services.Outbox.DeleteSent(before); err != nil {
+			log.Println("deliver emails:", err)
+		}
+
+		// Keep going while there is a backlog
+		if len(messages) == outboxBatch {
+			continue
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+func deliverEmail(services *models.Services, sender email.Sender,
+	m *models.OutboxMessage) {
+
+	err := sender.Send(&email.Message{
+		From:            m.Sender,
+		To:              m.Recipient,
+		ReplyTo:         m.ReplyTo,
+		ListUnsubscribe: m.ListUnsubscribe,
+		Subject:         m.Subject,
+		Text:            m.Text,
+		HTML:            m.HTML,
+	})
+	if err == nil {
+		err = services.Outbox.Sent(m)
+		if err != nil {
+			log.Printf("deliver email %d: %v\n", m.ID, err)
+		}
+		return
+	}
+
+	log.Printf("deliver email %d, attempt %d: %v\n", m.ID,
+		m.Attempts+1, err)
+
+	if err := services.Outbox.Failed(m, err); err != nil {
+		log.Printf("deliver email %d: %v\n", m.ID, err)
+	}
+}
@@ -0,0 +1,157 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// sweepEvery is how often the MemoryStore drops buckets that have been
+// idle long enough to be full again.
+const sweepEvery = time.Minute
+
+// Limit describes a token bucket. The bucket holds up to Burst tokens
+// and refills at a rate of Burst tokens every Per.
+type Limit struct {
+	Burst int
+	Per   time.Duration
+}
+
+// Bucket is the state of a single token bucket. It is exported so
+// that stores other than the MemoryStore can persist it.
+type Bucket struct {
+	Tokens  float64
+	Updated time.Time
+}
+
+// Take refills the bucket based on the time elapsed since it was last
+// updated and then tries to take a single token from it.
+// If a token was taken it returns 0, otherwise it returns how long the
+// caller has to wait until a token will be available.
+func (b *Bucket) Take(now time.Time, l Limit) time.Duration {
+
+	wait := b.Wait(now, l)
+	if wait == 0 && l.Burst > 0 && l.Per > 0 {
+		b.Tokens--
+	}
+
+	return wait
+}
+
+// Wait refills the bucket like Take does, but only returns how long
+// the caller has to wait until a token will be available, without
+// taking it. It returns 0 if one is available now.
+func (b *Bucket) Wait(now time.Time, l Limit) time.Duration {
+
+	if l.Burst <= 0 || l.Per <= 0 {
+		return 0
+	}
+
+	perToken := l.Per / time.Duration(l.Burst)
+
+	if b.Updated.IsZero() {
+		b.Tokens = float64(l.Burst)
+	} else if elapsed := now.Sub(b.Updated); elapsed > 0 {
+		b.Tokens += float64(elapsed) / float64(perToken)
+		if b.Tokens > float64(l.Burst) {
+			b.Tokens = float64(l.Burst)
+		}
+	}
+	b.Updated = now
+
+	if b.Tokens >= 1 {
+		return 0
+	}
+
+	return time.Duration((1 - b.Tokens) * float64(perToken))
+}
+
+// TakeAll takes a token from every one of the buckets, but only if
+// all of them have one, so a request rejected by one bucket doesn't
+// drain the others. It returns the longest wait among them otherwise.
+func TakeAll(now time.Time, l Limit, buckets ...*Bucket) time.Duration {
+
+	var wait time.Duration
+
+	for _, b := range buckets {
+		if w := b.Wait(now, l); w > wait {
+			wait = w
+		}
+	}
+
+	if wait > 0 {
+		return wait
+	}
+
+	for _, b := range buckets {
+		b.Take(now, l)
+	}
+
+	return 0
+}
+
+// Store keeps track of token buckets by key.
+type Store interface {
+
+	// Take tries to take a token from each of the buckets
+	// identified by keys, creating full buckets for those that
+	// don't exist yet. Tokens are only taken if every bucket has
+	// one, in which case it returns 0, otherwise how long until
+	// they all will.
+	Take(keys []string, l Limit) (time.Duration, error)
+}
+
+// MemoryStore is a Store that keeps every bucket in memory. It is only
+// suitable when a single instance of the application is running.
+type MemoryStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*memoryBucket
+	lastSweep time.Time
+}
+
+type memoryBucket struct {
+	Bucket
+	limit Limit
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets:   make(map[string]*memoryBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+func (ms *MemoryStore) Take(keys []string, l Limit) (time.Duration, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(ms.lastSweep) > sweepEvery {
+		ms.sweep(now)
+	}
+
+	buckets := make([]*Bucket, 0, len(keys))
+	for _, key := range keys {
+		b, ok := ms.buckets[key]
+		if !ok {
+			b = &memoryBucket{}
+			ms.buckets[key] = b
+		}
+		b.limit = l
+
+		buckets = append(buckets, &b.Bucket)
+	}
+
+	return TakeAll(now, l, buckets...), nil
+}
+
+// sweep removes every bucket that would be full by now, since those
+// behave exactly like a bucket that doesn't exist yet.
+func (ms *MemoryStore) sweep(now time.Time) {
+	for key, b := range ms.buckets {
+		if now.Sub(b.Updated) >= b.limit.Per {
+			delete(ms.buckets, key)
+		}
+	}
+
+	ms.lastSweep = now
+}
@@ -0,0 +1,108 @@
+package realip
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+var (
+	mu      sync.RWMutex
+	trusted []*net.IPNet
+)
+
+// TrustProxies sets the proxies, as CIDRs or single addresses, whose
+// X-Forwarded-For and X-Real-IP headers are honored. In production we
+// run behind Caddy on the same host, so only loopback is trusted by
+// default. Requests from anywhere else are identified by the address
+// of their connection, whatever headers they send.
+func TrustProxies(proxies ...string) error {
+
+	nets := make([]*net.IPNet, 0, len(proxies))
+
+	for _, p := range proxies {
+		if !strings.Contains(p, "/") {
+			if ip := net.ParseIP(p); ip != nil && ip.To4() != nil {
+				p += "/32"
+			} else {
+				p += "/128"
+			}
+		}
+
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return err
+		}
+		nets = append(nets, n)
+	}
+
+	mu.Lock()
+	trusted = nets
+	mu.Unlock()
+
+	return nil
+}
+
+// FromRequest returns the IP address of the client that made the
+// request. The forwarding headers are only honored when the request
+// came from a trusted proxy, in which case the right-most address in
+// X-Forwarded-For that isn't one of our proxies is the client, since
+// everything to the left of it was sent by the client itself.
+func FromRequest(r *http.Request) string {
+
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remote = r.RemoteAddr
+	}
+
+	if !isTrusted(remote) {
+		return remote
+	}
+
+	if fwd := r.Header.Values("X-Forwarded-For"); len(fwd) > 0 {
+		hops := strings.Split(strings.Join(fwd, ","), ",")
+
+		client := ""
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if net.ParseIP(hop) == nil {
+				break
+			}
+
+			client = hop
+			if !isTrusted(hop) {
+				break
+			}
+		}
+
+		if client != "" {
+			return client
+		}
+	}
+
+	if ip := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(ip) != nil {
+		return ip
+	}
+
+	return remote
+}
+
+func isTrusted(addr string) bool {
+
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+
+	mu.RLock()
+	defer mu.RUnlock()
+
+	for _, n := range trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -36,6 +36,12 @@ type Data struct {
 	Alert *Alert
 	User  *models.User
 	Yield interface{}
+
+	// Impersonator is the admin acting as User, if any
+	Impersonator *models.User
+
+	// Notifications are the latest unread notifications of User
+	Notifications []models.Notification
 }
 
 func (d *Data) SetAlert(err error) {
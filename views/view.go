@@ -72,6 +72,8 @@ func (v *View) Render(w http.ResponseWriter, r *http.Request,
 	}
 
 	vd.User = context.User(r.Context())
+	vd.Impersonator = context.Impersonator(r.Context())
+	vd.Notifications = context.Notifications(r.Context())
 
 	csrfField := csrf.TemplateField(r)
 	tpl := v.Template.Funcs(template.FuncMap{
@@ -110,28 +112,24 @@ func layoutFiles() []string {
 	return files
 }
 
-//
 // addTemplate takes in a slice of strings representing file paths
 // for templates, and it prepends the TemplateDir directory to each
 // string in the slice
 //
 // Eg the input {"home"} would result in the output {"views/home"}
 // if TemplateDir == "views/"
-//
 func addTemplatePath(files []string) {
 	for i, f := range files {
 		files[i] = TemplateDir + f
 	}
 }
 
-//
 // addTemplateExt takes in a slice of strings representing file paths
 // for templates, and it appends the TemplateExt extension to each
 // string in the slice
 //
 // Eg the input {"home"} would result in the output {"home.gohtml"}
 // if TemplateExt == ".gohtml"
-//
 func addTemplateExt(files []string) {
 	for i, f := range files {
 		files[i] = f + TemplateExt